@@ -66,6 +66,16 @@ func GetDBPath() string {
 	return fmt.Sprintf("%s/%s.db", GetDBFolderPath(), GetName())
 }
 
+// GetSecretKeyPath returns the file holding the key that encrypts secret settings.
+// It is kept next to the database, but never inside it or its backups.
+func GetSecretKeyPath() string {
+	secretKeyPath := os.Getenv("XUI_SECRET_KEY_FILE")
+	if secretKeyPath == "" {
+		secretKeyPath = fmt.Sprintf("%s/%s.key", GetDBFolderPath(), GetName())
+	}
+	return secretKeyPath
+}
+
 func GetLogFolder() string {
 	logFolderPath := os.Getenv("XUI_LOG_FOLDER")
 	if logFolderPath == "" {
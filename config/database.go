@@ -2,8 +2,14 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 // DatabaseType represents the type of database
@@ -12,6 +18,7 @@ type DatabaseType string
 const (
 	DatabaseTypeSQLite     DatabaseType = "sqlite"
 	DatabaseTypePostgreSQL DatabaseType = "postgres"
+	DatabaseTypeMySQL      DatabaseType = "mysql"
 )
 
 // DatabaseConfig holds database configuration
@@ -19,6 +26,17 @@ type DatabaseConfig struct {
 	Type     DatabaseType   `json:"type"`
 	SQLite   SQLiteConfig   `json:"sqlite"`
 	Postgres PostgresConfig `json:"postgres"`
+	MySQL    MySQLConfig    `json:"mysql"`
+
+	// Read replicas of a PostgreSQL or MySQL primary, sharing its credentials and options
+	Replicas      []ReplicaConfig `json:"replicas"`
+	MaxReplicaLag int             `json:"maxReplicaLag"` // seconds a replica may fall behind before reads go to the primary
+}
+
+// ReplicaConfig holds the address of a read replica
+type ReplicaConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
 }
 
 // SQLiteConfig holds SQLite specific configuration
@@ -35,6 +53,29 @@ type PostgresConfig struct {
 	Password string `json:"password"`
 	SSLMode  string `json:"sslMode"`
 	TimeZone string `json:"timeZone"`
+
+	// Connection pool settings, zero leaves the database/sql default in place
+	MaxOpenConns     int `json:"maxOpenConns"`
+	MaxIdleConns     int `json:"maxIdleConns"`
+	ConnMaxLifetime  int `json:"connMaxLifetime"`  // seconds
+	StatementTimeout int `json:"statementTimeout"` // seconds, sent to the server as statement_timeout
+}
+
+// MySQLConfig holds MySQL and MariaDB specific configuration
+type MySQLConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Database string `json:"database"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Charset  string `json:"charset"`
+	TLS      string `json:"tls"` // false, true, skip-verify or preferred
+	TimeZone string `json:"timeZone"`
+
+	// Connection pool settings, zero leaves the database/sql default in place
+	MaxOpenConns    int `json:"maxOpenConns"`
+	MaxIdleConns    int `json:"maxIdleConns"`
+	ConnMaxLifetime int `json:"connMaxLifetime"` // seconds, keep below the server wait_timeout
 }
 
 // GetDSN returns the data source name for the database
@@ -43,7 +84,7 @@ func (c *DatabaseConfig) GetDSN() string {
 	case DatabaseTypeSQLite:
 		return c.SQLite.Path
 	case DatabaseTypePostgreSQL:
-		return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s TimeZone=%s",
+		dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s TimeZone=%s",
 			c.Postgres.Host,
 			c.Postgres.Username,
 			c.Postgres.Password,
@@ -52,11 +93,75 @@ func (c *DatabaseConfig) GetDSN() string {
 			c.Postgres.SSLMode,
 			c.Postgres.TimeZone,
 		)
+		if c.Postgres.StatementTimeout > 0 {
+			dsn += fmt.Sprintf(" statement_timeout=%d", c.Postgres.StatementTimeout*1000)
+		}
+		return dsn
+	case DatabaseTypeMySQL:
+		return c.MySQL.getDSN()
 	default:
 		return c.SQLite.Path
 	}
 }
 
+// GetReplicaConfig returns the configuration connecting to replica i
+func (c *DatabaseConfig) GetReplicaConfig(i int) *DatabaseConfig {
+	replica := *c
+	replica.Replicas = nil
+	switch c.Type {
+	case DatabaseTypePostgreSQL:
+		replica.Postgres.Host = c.Replicas[i].Host
+		if c.Replicas[i].Port > 0 {
+			replica.Postgres.Port = c.Replicas[i].Port
+		}
+	case DatabaseTypeMySQL:
+		replica.MySQL.Host = c.Replicas[i].Host
+		if c.Replicas[i].Port > 0 {
+			replica.MySQL.Port = c.Replicas[i].Port
+		}
+	}
+	return &replica
+}
+
+// ParseReplicas parses a comma separated list of host[:port] replica addresses
+func ParseReplicas(value string) ([]ReplicaConfig, error) {
+	var replicas []ReplicaConfig
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		replica := ReplicaConfig{Host: addr}
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid replica port in %q", addr)
+			}
+			replica = ReplicaConfig{Host: host, Port: p}
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+func (c *MySQLConfig) getDSN() string {
+	cfg := mysql.NewConfig()
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	cfg.DBName = c.Database
+	cfg.User = c.Username
+	cfg.Passwd = c.Password
+	cfg.TLSConfig = c.TLS
+	cfg.ParseTime = true
+	if loc, err := time.LoadLocation(c.TimeZone); err == nil {
+		cfg.Loc = loc
+	}
+	if c.Charset != "" {
+		cfg.Params = map[string]string{"charset": c.Charset}
+	}
+	return cfg.FormatDSN()
+}
+
 // GetDefaultDatabaseConfig returns default database configuration
 func GetDefaultDatabaseConfig() *DatabaseConfig {
 	return &DatabaseConfig{
@@ -72,7 +177,27 @@ func GetDefaultDatabaseConfig() *DatabaseConfig {
 			Password: "",
 			SSLMode:  "disable",
 			TimeZone: "UTC",
+
+			MaxOpenConns:     25,
+			MaxIdleConns:     5,
+			ConnMaxLifetime:  1800,
+			StatementTimeout: 30,
 		},
+		MySQL: MySQLConfig{
+			Host:     "localhost",
+			Port:     3306,
+			Database: "x_ui",
+			Username: "x_ui",
+			Password: "",
+			Charset:  "utf8mb4",
+			TLS:      "false",
+			TimeZone: "UTC",
+
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 1800,
+		},
+		MaxReplicaLag: 10,
 	}
 }
 
@@ -104,9 +229,62 @@ func (c *DatabaseConfig) ValidateConfig() error {
 		if c.Postgres.Port <= 0 || c.Postgres.Port > 65535 {
 			return fmt.Errorf("PostgreSQL port must be between 1 and 65535")
 		}
+		if c.Postgres.MaxOpenConns < 0 || c.Postgres.MaxIdleConns < 0 {
+			return fmt.Errorf("PostgreSQL connection limits cannot be negative")
+		}
+		if c.Postgres.MaxOpenConns > 0 && c.Postgres.MaxIdleConns > c.Postgres.MaxOpenConns {
+			return fmt.Errorf("PostgreSQL max idle connections cannot exceed max open connections")
+		}
+		if c.Postgres.ConnMaxLifetime < 0 || c.Postgres.StatementTimeout < 0 {
+			return fmt.Errorf("PostgreSQL connection lifetime and statement timeout cannot be negative")
+		}
+	case DatabaseTypeMySQL:
+		if c.MySQL.Host == "" {
+			return fmt.Errorf("MySQL host cannot be empty")
+		}
+		if c.MySQL.Database == "" {
+			return fmt.Errorf("MySQL database name cannot be empty")
+		}
+		if c.MySQL.Username == "" {
+			return fmt.Errorf("MySQL username cannot be empty")
+		}
+		if c.MySQL.Port <= 0 || c.MySQL.Port > 65535 {
+			return fmt.Errorf("MySQL port must be between 1 and 65535")
+		}
+		switch c.MySQL.TLS {
+		case "", "false", "true", "skip-verify", "preferred":
+		default:
+			return fmt.Errorf("MySQL TLS mode must be false, true, skip-verify or preferred")
+		}
+		if _, err := time.LoadLocation(c.MySQL.TimeZone); err != nil {
+			return fmt.Errorf("invalid MySQL time zone %q: %w", c.MySQL.TimeZone, err)
+		}
+		if c.MySQL.MaxOpenConns < 0 || c.MySQL.MaxIdleConns < 0 {
+			return fmt.Errorf("MySQL connection limits cannot be negative")
+		}
+		if c.MySQL.MaxOpenConns > 0 && c.MySQL.MaxIdleConns > c.MySQL.MaxOpenConns {
+			return fmt.Errorf("MySQL max idle connections cannot exceed max open connections")
+		}
+		if c.MySQL.ConnMaxLifetime < 0 {
+			return fmt.Errorf("MySQL connection lifetime cannot be negative")
+		}
 	default:
 		return fmt.Errorf("unsupported database type: %s", c.Type)
 	}
+	if len(c.Replicas) > 0 && c.Type == DatabaseTypeSQLite {
+		return fmt.Errorf("read replicas require PostgreSQL or MySQL")
+	}
+	for _, replica := range c.Replicas {
+		if replica.Host == "" {
+			return fmt.Errorf("replica host cannot be empty")
+		}
+		if replica.Port < 0 || replica.Port > 65535 {
+			return fmt.Errorf("replica port must be between 1 and 65535")
+		}
+	}
+	if c.MaxReplicaLag < 0 {
+		return fmt.Errorf("max replica lag cannot be negative")
+	}
 	return nil
 }
 
@@ -115,6 +293,11 @@ func (c *DatabaseConfig) IsPostgreSQL() bool {
 	return c.Type == DatabaseTypePostgreSQL
 }
 
+// IsMySQL returns true if the database type is MySQL or MariaDB
+func (c *DatabaseConfig) IsMySQL() bool {
+	return c.Type == DatabaseTypeMySQL
+}
+
 // IsSQLite returns true if the database type is SQLite
 func (c *DatabaseConfig) IsSQLite() bool {
 	return c.Type == DatabaseTypeSQLite
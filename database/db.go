@@ -3,49 +3,59 @@ package database
 import (
 	"bufio"
 	"bytes"
+	"database/sql"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"x-ui/config"
 	"x-ui/database/model"
 	"x-ui/util/crypto"
 	"x-ui/xray"
 
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-var db *gorm.DB
+var (
+	db            *gorm.DB
+	currentConfig *config.DatabaseConfig
+)
 
 const (
 	defaultUsername = "admin"
 	defaultPassword = "admin"
 )
 
-func initModels() error {
-	models := []any{
+// getModels returns every model holding panel data, ordered so that referenced tables come first.
+// Tables are created by the versioned migrations in migration.go, which also keep
+// schema_migrations out of this list.
+func getModels() []any {
+	return []any{
 		&model.User{},
 		&model.Inbound{},
+		&model.Client{},
 		&model.OutboundTraffics{},
 		&model.Setting{},
 		&model.InboundClientIps{},
 		&xray.ClientTraffic{},
 		&model.HistoryOfSeeders{},
+		&model.DeletedItem{},
+		&model.XrayRevision{},
+		&model.Plan{},
+		&model.ClientGroup{},
+		&model.GroupMember{},
+		&model.ClientIdentity{},
+		&model.InboundTemplate{},
+		&model.ScheduledAction{},
 	}
-	for _, model := range models {
-		if err := db.AutoMigrate(model); err != nil {
-			log.Printf("Error auto migrating model: %v", err)
-			return err
-		}
-	}
-	return nil
 }
 
 func initUser() error {
@@ -71,45 +81,6 @@ func initUser() error {
 	return nil
 }
 
-func runSeeders(isUsersEmpty bool) error {
-	empty, err := isTableEmpty("history_of_seeders")
-	if err != nil {
-		log.Printf("Error checking if users table is empty: %v", err)
-		return err
-	}
-
-	if empty && isUsersEmpty {
-		hashSeeder := &model.HistoryOfSeeders{
-			SeederName: "UserPasswordHash",
-		}
-		return db.Create(hashSeeder).Error
-	} else {
-		var seedersHistory []string
-		db.Model(&model.HistoryOfSeeders{}).Pluck("seeder_name", &seedersHistory)
-
-		if !slices.Contains(seedersHistory, "UserPasswordHash") && !isUsersEmpty {
-			var users []model.User
-			db.Find(&users)
-
-			for _, user := range users {
-				hashedPassword, err := crypto.HashPasswordAsBcrypt(user.Password)
-				if err != nil {
-					log.Printf("Error hashing password for user '%s': %v", user.Username, err)
-					return err
-				}
-				db.Model(&user).Update("password", hashedPassword)
-			}
-
-			hashSeeder := &model.HistoryOfSeeders{
-				SeederName: "UserPasswordHash",
-			}
-			return db.Create(hashSeeder).Error
-		}
-	}
-
-	return nil
-}
-
 func isTableEmpty(tableName string) (bool, error) {
 	var count int64
 	err := db.Table(tableName).Count(&count).Error
@@ -146,6 +117,19 @@ func loadEnvFile(filename string) error {
 	return scanner.Err()
 }
 
+// getEnvInt overwrites target with the integer value of the environment variable name, if set
+func getEnvInt(name string, target *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	if v, err := strconv.Atoi(value); err == nil {
+		*target = v
+	} else {
+		log.Printf("Warning: ignoring invalid %s value %q", name, value)
+	}
+}
+
 // getDatabaseConfig retrieves database configuration from settings
 func getDatabaseConfig() (*config.DatabaseConfig, error) {
 	// Load environment variables from file if it exists
@@ -186,36 +170,92 @@ func getDatabaseConfig() (*config.DatabaseConfig, error) {
 		if timeZone := os.Getenv("DB_TIMEZONE"); timeZone != "" {
 			dbConfig.Postgres.TimeZone = timeZone
 		}
+		getEnvInt("DB_MAX_OPEN_CONNS", &dbConfig.Postgres.MaxOpenConns)
+		getEnvInt("DB_MAX_IDLE_CONNS", &dbConfig.Postgres.MaxIdleConns)
+		getEnvInt("DB_CONN_MAX_LIFETIME", &dbConfig.Postgres.ConnMaxLifetime)
+		getEnvInt("DB_STATEMENT_TIMEOUT", &dbConfig.Postgres.StatementTimeout)
+	} else if dbConfig.Type == config.DatabaseTypeMySQL {
+		if host := os.Getenv("DB_HOST"); host != "" {
+			dbConfig.MySQL.Host = host
+		}
+		getEnvInt("DB_PORT", &dbConfig.MySQL.Port)
+		if database := os.Getenv("DB_NAME"); database != "" {
+			dbConfig.MySQL.Database = database
+		}
+		if username := os.Getenv("DB_USER"); username != "" {
+			dbConfig.MySQL.Username = username
+		}
+		if password := os.Getenv("DB_PASSWORD"); password != "" {
+			dbConfig.MySQL.Password = password
+		}
+		if charset := os.Getenv("DB_CHARSET"); charset != "" {
+			dbConfig.MySQL.Charset = charset
+		}
+		if tls := os.Getenv("DB_TLS"); tls != "" {
+			dbConfig.MySQL.TLS = tls
+		}
+		if timeZone := os.Getenv("DB_TIMEZONE"); timeZone != "" {
+			dbConfig.MySQL.TimeZone = timeZone
+		}
+		getEnvInt("DB_MAX_OPEN_CONNS", &dbConfig.MySQL.MaxOpenConns)
+		getEnvInt("DB_MAX_IDLE_CONNS", &dbConfig.MySQL.MaxIdleConns)
+		getEnvInt("DB_CONN_MAX_LIFETIME", &dbConfig.MySQL.ConnMaxLifetime)
 	}
 
+	if replicas := os.Getenv("DB_REPLICAS"); replicas != "" {
+		var err error
+		dbConfig.Replicas, err = config.ParseReplicas(replicas)
+		if err != nil {
+			return nil, err
+		}
+	}
+	getEnvInt("DB_REPLICA_MAX_LAG", &dbConfig.MaxReplicaLag)
+
 	return dbConfig, nil
 }
 
 func InitDB(dbPath string) error {
+	dbConfig, err := panelDatabaseConfig(dbPath)
+	if err != nil {
+		return err
+	}
+	return InitDBWithConfig(dbConfig)
+}
+
+// panelDatabaseConfig returns the configuration of the panel database, the SQLite file at
+// dbPath unless the environment sets another database.
+func panelDatabaseConfig(dbPath string) (*config.DatabaseConfig, error) {
 	// Try to get configuration from environment file first
 	dbConfig, err := getDatabaseConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// If still using SQLite and dbPath is provided, use it
 	if dbConfig.Type == config.DatabaseTypeSQLite && dbPath != "" {
 		dbConfig.SQLite.Path = dbPath
 	}
+	return dbConfig, nil
+}
 
-	return InitDBWithConfig(dbConfig)
+// OpenPanelDB opens the panel database InitDB would use, without migrating it or making
+// it the panel database.
+func OpenPanelDB(dbPath string) (*gorm.DB, error) {
+	dbConfig, err := panelDatabaseConfig(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbConfig.EnsureDirectoryExists(); err != nil {
+		return nil, err
+	}
+	return OpenDB(dbConfig)
 }
 
-// InitDBWithConfig initializes database with provided configuration
-func InitDBWithConfig(dbConfig *config.DatabaseConfig) error {
+// OpenDB opens a connection for the provided configuration without touching the panel database
+func OpenDB(dbConfig *config.DatabaseConfig) (*gorm.DB, error) {
 	// Validate configuration
 	if err := dbConfig.ValidateConfig(); err != nil {
-		return err
-	}
-
-	// Ensure directory exists for SQLite
-	if err := dbConfig.EnsureDirectoryExists(); err != nil {
-		return err
+		return nil, err
 	}
 
 	var gormLogger logger.Interface
@@ -230,65 +270,115 @@ func InitDBWithConfig(dbConfig *config.DatabaseConfig) error {
 	}
 
 	// Open database connection based on type
-	var err error
 	switch dbConfig.Type {
 	case config.DatabaseTypeSQLite:
-		db, err = gorm.Open(sqlite.Open(dbConfig.GetDSN()), c)
+		return gorm.Open(sqlite.Open(dbConfig.GetDSN()), c)
 	case config.DatabaseTypePostgreSQL:
-		db, err = gorm.Open(postgres.Open(dbConfig.GetDSN()), c)
+		conn, err := gorm.Open(postgres.Open(dbConfig.GetDSN()), c)
+		if err != nil {
+			return nil, err
+		}
+		sqlDB, err := conn.DB()
+		if err != nil {
+			return nil, err
+		}
+		configurePool(sqlDB, dbConfig.Postgres.MaxOpenConns, dbConfig.Postgres.MaxIdleConns, dbConfig.Postgres.ConnMaxLifetime)
+		return conn, nil
+	case config.DatabaseTypeMySQL:
+		conn, err := gorm.Open(mysql.Open(dbConfig.GetDSN()), c)
+		if err != nil {
+			return nil, err
+		}
+		sqlDB, err := conn.DB()
+		if err != nil {
+			return nil, err
+		}
+		configurePool(sqlDB, dbConfig.MySQL.MaxOpenConns, dbConfig.MySQL.MaxIdleConns, dbConfig.MySQL.ConnMaxLifetime)
+		return conn, nil
 	default:
-		return fmt.Errorf("unsupported database type: %s", dbConfig.Type)
+		return nil, fmt.Errorf("unsupported database type: %s", dbConfig.Type)
 	}
+}
 
+// CheckSQLiteFile makes sure the file at path is a panel database this binary is able to
+// migrate, without touching the panel database.
+func CheckSQLiteFile(path string) error {
+	sqliteConfig := config.GetDefaultDatabaseConfig()
+	sqliteConfig.SQLite.Path = path
+	conn, err := OpenDB(sqliteConfig)
 	if err != nil {
 		return err
 	}
-
-	if err := initModels(); err != nil {
-		return err
+	if sqlDB, err := conn.DB(); err == nil {
+		defer sqlDB.Close()
 	}
-
-	isUsersEmpty, err := isTableEmpty("users")
+	version, err := SchemaVersion(conn)
 	if err != nil {
 		return err
 	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d), please update x-ui",
+			version, LatestSchemaVersion())
+	}
+	if !conn.Migrator().HasTable(&model.User{}) {
+		return fmt.Errorf("not an x-ui database")
+	}
+	return nil
+}
 
-	if err := initUser(); err != nil {
-		return err
+// configurePool applies connection pool limits to sqlDB, zero values keep the defaults.
+// connMaxLifetime is in seconds.
+func configurePool(sqlDB *sql.DB, maxOpenConns, maxIdleConns, connMaxLifetime int) {
+	if maxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(maxOpenConns)
+	}
+	if maxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(maxIdleConns)
 	}
-	return runSeeders(isUsersEmpty)
+	if connMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(time.Duration(connMaxLifetime) * time.Second)
+	}
+	// Drop idle connections before a server side idle timeout or restart can break them
+	sqlDB.SetConnMaxIdleTime(5 * time.Minute)
 }
 
-// TestDatabaseConnection tests database connection with provided configuration
-func TestDatabaseConnection(dbConfig *config.DatabaseConfig) error {
+// InitDBWithConfig initializes database with provided configuration
+func InitDBWithConfig(dbConfig *config.DatabaseConfig) error {
 	// Validate configuration
 	if err := dbConfig.ValidateConfig(); err != nil {
 		return err
 	}
 
-	var gormLogger logger.Interface
-	if config.IsDebug() {
-		gormLogger = logger.Default
-	} else {
-		gormLogger = logger.Discard
+	// Ensure directory exists for SQLite
+	if err := dbConfig.EnsureDirectoryExists(); err != nil {
+		return err
 	}
 
-	c := &gorm.Config{
-		Logger: gormLogger,
+	// Migrate before switching, so the panel keeps its database when the new one is unusable
+	conn, err := OpenDB(dbConfig)
+	if err != nil {
+		return err
 	}
-
-	// Test database connection based on type
-	var testDB *gorm.DB
-	var err error
-	switch dbConfig.Type {
-	case config.DatabaseTypeSQLite:
-		testDB, err = gorm.Open(sqlite.Open(dbConfig.GetDSN()), c)
-	case config.DatabaseTypePostgreSQL:
-		testDB, err = gorm.Open(postgres.Open(dbConfig.GetDSN()), c)
-	default:
-		return fmt.Errorf("unsupported database type: %s", dbConfig.Type)
+	if err := ApplyMigrations(conn); err != nil {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+		return err
 	}
 
+	stopHealthCheck()
+	stopReplicas()
+	db = conn
+	currentConfig = dbConfig
+	startHealthCheck(db)
+	startReplicas(dbConfig)
+
+	return initUser()
+}
+
+// TestDatabaseConnection tests database connection with provided configuration
+func TestDatabaseConnection(dbConfig *config.DatabaseConfig) error {
+	testDB, err := OpenDB(dbConfig)
 	if err != nil {
 		return err
 	}
@@ -304,6 +394,8 @@ func TestDatabaseConnection(dbConfig *config.DatabaseConfig) error {
 }
 
 func CloseDB() error {
+	stopHealthCheck()
+	stopReplicas()
 	if db != nil {
 		sqlDB, err := db.DB()
 		if err != nil {
@@ -314,10 +406,17 @@ func CloseDB() error {
 	return nil
 }
 
+// GetDB returns the handle of the primary database, used for all writes and for reads
+// that must see them. See GetReadDB for reads that can go to a replica.
 func GetDB() *gorm.DB {
 	return db
 }
 
+// GetDBConfig returns the configuration the panel database was opened with
+func GetDBConfig() *config.DatabaseConfig {
+	return currentConfig
+}
+
 func IsNotFound(err error) bool {
 	return err == gorm.ErrRecordNotFound
 }
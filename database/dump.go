@@ -0,0 +1,228 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"x-ui/config"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	// DumpFormat identifies a logical database dump produced by ExportDump.
+	DumpFormat = "x-ui-dump"
+	// DumpVersion is the newest dump layout this binary can read and the one it writes.
+	DumpVersion = 1
+)
+
+// Dump is a database independent snapshot of every panel table.
+// Rows are keyed by column name so a dump taken from one backend can be restored into another.
+type Dump struct {
+	Format        string                      `json:"format"`
+	Version       int                         `json:"version"`
+	SchemaVersion int                         `json:"schemaVersion"`
+	AppVersion    string                      `json:"appVersion"`
+	Source        string                      `json:"source"`
+	CreatedAt     int64                       `json:"createdAt"`
+	Tables        map[string][]map[string]any `json:"tables"`
+}
+
+func parseModel(tx *gorm.DB, model any) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+// ExportDump reads every table of tx into a new Dump.
+func ExportDump(tx *gorm.DB) (*Dump, error) {
+	schemaVersion, err := SchemaVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+	dump := &Dump{
+		Format:        DumpFormat,
+		Version:       DumpVersion,
+		SchemaVersion: schemaVersion,
+		AppVersion:    config.GetVersion(),
+		Source:        tx.Dialector.Name(),
+		CreatedAt:     time.Now().Unix() * 1000,
+		Tables:        make(map[string][]map[string]any),
+	}
+	ctx := context.Background()
+	for _, model := range getModels() {
+		sch, err := parseModel(tx, model)
+		if err != nil {
+			return nil, err
+		}
+		rows := reflect.New(reflect.SliceOf(sch.ModelType))
+		err = tx.Model(model).Order(sch.PrioritizedPrimaryField.DBName).Find(rows.Interface()).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to export table %s: %w", sch.Table, err)
+		}
+		records := make([]map[string]any, 0, rows.Elem().Len())
+		for i := 0; i < rows.Elem().Len(); i++ {
+			row := rows.Elem().Index(i)
+			record := make(map[string]any, len(sch.DBNames))
+			for _, name := range sch.DBNames {
+				record[name], _ = sch.FieldsByDBName[name].ValueOf(ctx, row)
+			}
+			records = append(records, record)
+		}
+		dump.Tables[sch.Table] = records
+	}
+	return dump, nil
+}
+
+// ParseDump decodes a dump and checks that this binary is able to restore it.
+func ParseDump(data []byte) (*Dump, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	dump := &Dump{}
+	if err := decoder.Decode(dump); err != nil {
+		return nil, fmt.Errorf("invalid dump file: %w", err)
+	}
+	if dump.Format != DumpFormat {
+		return nil, fmt.Errorf("invalid dump format: %q", dump.Format)
+	}
+	if dump.Version < 1 || dump.Version > DumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d, this binary supports up to %d", dump.Version, DumpVersion)
+	}
+	if dump.SchemaVersion > LatestSchemaVersion() {
+		return nil, fmt.Errorf("dump schema version %d is newer than this binary supports (%d)", dump.SchemaVersion, LatestSchemaVersion())
+	}
+	return dump, nil
+}
+
+// IsDump reports whether file looks like a JSON dump rather than a database file.
+func IsDump(file io.ReaderAt) (bool, error) {
+	buf := make([]byte, 1)
+	_, err := file.ReadAt(buf, 0)
+	if err != nil {
+		return false, err
+	}
+	return buf[0] == '{', nil
+}
+
+// ImportDump replaces the content of every table in db with the rows of dump.
+// The schema of db must be at LatestSchemaVersion; data of a dump taken at an older
+// version is migrated after the import. It runs in a single transaction, so the
+// database is left untouched on failure.
+func ImportDump(db *gorm.DB, dump *Dump) error {
+	models := getModels()
+	schemas := make(map[string]*schema.Schema, len(models))
+	for _, model := range models {
+		sch, err := parseModel(db, model)
+		if err != nil {
+			return err
+		}
+		schemas[sch.Table] = sch
+	}
+	for table := range dump.Tables {
+		if _, ok := schemas[table]; !ok {
+			return fmt.Errorf("dump contains unknown table %s", table)
+		}
+	}
+
+	ctx := context.Background()
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Clear tables in reverse order so rows referencing other tables go first
+		for i := len(models) - 1; i >= 0; i-- {
+			if err := tx.Where("1 = 1").Delete(models[i]).Error; err != nil {
+				return fmt.Errorf("failed to clear table: %w", err)
+			}
+		}
+
+		for _, model := range models {
+			sch, _ := parseModel(tx, model)
+			records := dump.Tables[sch.Table]
+			if len(records) == 0 {
+				continue
+			}
+			rows := reflect.MakeSlice(reflect.SliceOf(reflect.PointerTo(sch.ModelType)), 0, len(records))
+			for _, record := range records {
+				row := reflect.New(sch.ModelType)
+				for name, value := range record {
+					field, ok := sch.FieldsByDBName[name]
+					if !ok {
+						return fmt.Errorf("dump contains unknown column %s.%s", sch.Table, name)
+					}
+					if number, ok := value.(json.Number); ok {
+						value = number.String()
+					}
+					if value == nil {
+						continue
+					}
+					if err := field.Set(ctx, row.Elem(), value); err != nil {
+						return fmt.Errorf("invalid value for %s.%s: %w", sch.Table, name, err)
+					}
+				}
+				rows = reflect.Append(rows, row)
+			}
+			if err := tx.Model(model).CreateInBatches(rows.Interface(), 100).Error; err != nil {
+				return fmt.Errorf("failed to import table %s: %w", sch.Table, err)
+			}
+
+			var count int64
+			if err := tx.Model(model).Count(&count).Error; err != nil {
+				return err
+			}
+			if count != int64(len(records)) {
+				return fmt.Errorf("table %s has %d rows after import, expected %d", sch.Table, count, len(records))
+			}
+		}
+
+		if err := ResetSequences(tx); err != nil {
+			return err
+		}
+
+		// Bring data from an older schema into the current shape
+		for _, m := range migrations {
+			if m.version <= dump.SchemaVersion {
+				continue
+			}
+			if err := m.up(tx); err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s to the dump: %w", m.version, m.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ResetSequences moves PostgreSQL id sequences past the highest imported id.
+// Other databases derive the next id from the table content and need no action.
+func ResetSequences(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	for _, model := range getModels() {
+		sch, err := parseModel(tx, model)
+		if err != nil {
+			return err
+		}
+		pk := sch.PrioritizedPrimaryField
+		if pk == nil || !pk.AutoIncrement {
+			continue
+		}
+		err = tx.Exec(fmt.Sprintf(
+			"SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false)",
+			sch.Table, pk.DBName, pk.DBName, sch.Table)).Error
+		if err != nil {
+			return fmt.Errorf("failed to reset sequence of %s: %w", sch.Table, err)
+		}
+	}
+	return nil
+}
+
+// Marshal encodes the dump as indented JSON.
+func (d *Dump) Marshal() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+
+	"gorm.io/gorm"
+)
+
+const (
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+)
+
+// DBStatus describes the state of the panel database connection and its pool.
+type DBStatus struct {
+	Type         string  `json:"type"`
+	Connected    bool    `json:"connected"`
+	Latency      float64 `json:"latency"` // milliseconds taken by the last ping
+	Error        string  `json:"error"`
+	LastCheck    int64   `json:"lastCheck"`
+	MaxOpen      int     `json:"maxOpen"`
+	Open         int     `json:"open"`
+	InUse        int     `json:"inUse"`
+	Idle         int     `json:"idle"`
+	WaitCount    int64   `json:"waitCount"`
+	WaitDuration int64   `json:"waitDuration"` // milliseconds
+
+	Replicas []ReplicaStatus `json:"replicas"`
+}
+
+var (
+	healthLock  sync.Mutex
+	health      DBStatus
+	healthSQLDB *sql.DB
+	healthStop  chan struct{}
+)
+
+// startHealthCheck pings conn periodically until stopHealthCheck is called.
+func startHealthCheck(conn *gorm.DB) {
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return
+	}
+	stop := make(chan struct{})
+	healthLock.Lock()
+	health = DBStatus{Connected: true}
+	healthSQLDB = sqlDB
+	healthStop = stop
+	healthLock.Unlock()
+
+	checkHealth(sqlDB)
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checkHealth(sqlDB)
+			}
+		}
+	}()
+}
+
+func stopHealthCheck() {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	if healthStop != nil {
+		close(healthStop)
+		healthStop = nil
+	}
+	healthSQLDB = nil
+}
+
+// checkHealth pings the database and records the outcome. database/sql throws
+// away connections the driver reports as broken and dials new ones, so after a
+// PostgreSQL restart the pool is refilled here instead of in the next job.
+func checkHealth(sqlDB *sql.DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := sqlDB.PingContext(ctx)
+	latency := time.Since(start)
+
+	healthLock.Lock()
+	wasConnected := health.Connected
+	health.Connected = err == nil
+	health.Latency = float64(latency.Microseconds()) / 1000
+	health.LastCheck = time.Now().Unix() * 1000
+	if err != nil {
+		health.Error = err.Error()
+	} else {
+		health.Error = ""
+	}
+	healthLock.Unlock()
+
+	if err != nil && wasConnected {
+		logger.Warning("Database connection lost:", err)
+	} else if err == nil && !wasConnected {
+		logger.Info("Database connection restored")
+	}
+}
+
+// GetDBStatus returns the result of the last health check together with the current pool statistics.
+func GetDBStatus() DBStatus {
+	healthLock.Lock()
+	status := health
+	sqlDB := healthSQLDB
+	healthLock.Unlock()
+
+	status.Type = string(GetDialect())
+	status.Replicas = GetReplicaStatus()
+	if sqlDB != nil {
+		stats := sqlDB.Stats()
+		status.MaxOpen = stats.MaxOpenConnections
+		status.Open = stats.OpenConnections
+		status.InUse = stats.InUse
+		status.Idle = stats.Idle
+		status.WaitCount = stats.WaitCount
+		status.WaitDuration = stats.WaitDuration.Milliseconds()
+	}
+	return status
+}
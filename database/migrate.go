@@ -0,0 +1,164 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"x-ui/config"
+
+	"gorm.io/gorm"
+)
+
+// TableReport holds the verification result of one copied table.
+type TableReport struct {
+	Table          string
+	SourceRows     int
+	DestRows       int
+	SourceChecksum string
+	DestChecksum   string
+}
+
+// OK reports whether the destination table matches the source table.
+func (r TableReport) OK() bool {
+	return r.SourceRows == r.DestRows && r.SourceChecksum == r.DestChecksum
+}
+
+// MigrationReport describes the outcome of CopyDatabase.
+type MigrationReport struct {
+	Tables []TableReport
+}
+
+// OK reports whether every table was copied without differences.
+func (r *MigrationReport) OK() bool {
+	for _, table := range r.Tables {
+		if !table.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// tableChecksum hashes the rows of a table in primary key order.
+// Rows are encoded as JSON objects, whose keys are sorted, so the result
+// does not depend on the database the rows were read from.
+func tableChecksum(rows []map[string]any) (string, error) {
+	hash := sha256.New()
+	for _, row := range rows {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(data)
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isDatabaseEmpty reports whether none of the panel tables of tx contain rows.
+func isDatabaseEmpty(tx *gorm.DB) (bool, error) {
+	for _, model := range getModels() {
+		if !tx.Migrator().HasTable(model) {
+			continue
+		}
+		var count int64
+		if err := tx.Model(model).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CopyDatabase copies every panel table from src to dst, keeping ids, and verifies the result.
+// The source is left untouched and must be at LatestSchemaVersion, the destination schema
+// is created when missing. Unless force is set, dst must be empty.
+func CopyDatabase(src, dst *config.DatabaseConfig, force bool) (*MigrationReport, error) {
+	if src.Type == dst.Type && src.GetDSN() == dst.GetDSN() {
+		return nil, fmt.Errorf("source and destination are the same database")
+	}
+	if err := dst.EnsureDirectoryExists(); err != nil {
+		return nil, err
+	}
+
+	srcDB, err := OpenDB(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source database: %w", err)
+	}
+	if sqlDB, err := srcDB.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	dstDB, err := OpenDB(dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open destination database: %w", err)
+	}
+	if sqlDB, err := dstDB.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	// The source is only read, so it has to be at the schema the destination is created with
+	version, err := SchemaVersion(srcDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source schema version: %w", err)
+	}
+	if version != LatestSchemaVersion() {
+		return nil, fmt.Errorf("source database schema version %d is not the latest (%d), run x-ui migrate on it first",
+			version, LatestSchemaVersion())
+	}
+
+	if !force {
+		empty, err := isDatabaseEmpty(dstDB)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, fmt.Errorf("destination database is not empty")
+		}
+	}
+
+	if err := ApplyMigrations(dstDB); err != nil {
+		return nil, fmt.Errorf("failed to create destination schema: %w", err)
+	}
+
+	// Read the source inside a transaction to get a consistent snapshot
+	var dump *Dump
+	err = srcDB.Transaction(func(tx *gorm.DB) error {
+		dump, err = ExportDump(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ImportDump(dstDB, dump); err != nil {
+		return nil, err
+	}
+
+	copied, err := ExportDump(dstDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read back destination database: %w", err)
+	}
+
+	report := &MigrationReport{}
+	for table, rows := range dump.Tables {
+		tableReport := TableReport{
+			Table:      table,
+			SourceRows: len(rows),
+			DestRows:   len(copied.Tables[table]),
+		}
+		if tableReport.SourceChecksum, err = tableChecksum(rows); err != nil {
+			return nil, err
+		}
+		if tableReport.DestChecksum, err = tableChecksum(copied.Tables[table]); err != nil {
+			return nil, err
+		}
+		report.Tables = append(report.Tables, tableReport)
+	}
+	sort.Slice(report.Tables, func(i, j int) bool {
+		return report.Tables[i].Table < report.Tables[j].Table
+	})
+	return report, nil
+}
@@ -0,0 +1,571 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/crypto"
+	"x-ui/util/random"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// migration is one step of the schema history. Up moves the database from the
+// previous version to this one and Down reverts it. Both run inside a transaction
+// together with the update of the schema_migrations table.
+//
+// Migrations that change a table should call AutoMigrate on the model rather than
+// alter columns by hand: a fresh database created by an earlier migration already
+// gets the current struct definition, and AutoMigrate is a no-op in that case.
+//
+// When a dump taken at an older schema version is restored, its rows are loaded
+// into tables at the latest version and the Up steps newer than the dump are run
+// on them in order, so schema changes in Up must tolerate an up to date table.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// migrations lists every schema version in ascending order. Never edit or reorder
+// a released entry, append a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial_schema",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(initialModels()...)
+		},
+		down: func(tx *gorm.DB) error {
+			models := initialModels()
+			slices.Reverse(models)
+			return tx.Migrator().DropTable(models...)
+		},
+	},
+	{
+		version: 2,
+		name:    "hash_user_passwords",
+		up:      hashUserPasswords,
+		// Hashed passwords cannot be turned back into plain text, older versions
+		// of the panel read the bcrypt hashes just fine.
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 3,
+		name:    "fix_inbound_clients",
+		up:      fixInboundClients,
+		// The fixed settings are still valid for older versions.
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 4,
+		name:    "clients_table",
+		up:      moveClientsToTable,
+		down:    moveClientsToSettings,
+	},
+	{
+		version: 5,
+		name:    "recycle_bin",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&model.DeletedItem{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&model.DeletedItem{})
+		},
+	},
+	{
+		version: 6,
+		name:    "xray_revisions",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&model.XrayRevision{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&model.XrayRevision{})
+		},
+	},
+	{
+		version: 7,
+		name:    "client_groups",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&model.Plan{}, &model.ClientGroup{}, &model.GroupMember{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&model.GroupMember{}, &model.ClientGroup{}, &model.Plan{})
+		},
+	},
+	{
+		version: 8,
+		name:    "client_identities",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&model.ClientIdentity{}, &xray.ClientTraffic{})
+		},
+		down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&xray.ClientTraffic{}, "IdentityId"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable(&model.ClientIdentity{})
+		},
+	},
+	{
+		version: 9,
+		name:    "inbound_templates",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&model.InboundTemplate{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&model.InboundTemplate{})
+		},
+	},
+	{
+		version: 10,
+		name:    "scheduled_actions",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&model.ScheduledAction{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&model.ScheduledAction{})
+		},
+	},
+}
+
+// initialModels returns the tables present before versioned migrations were introduced.
+func initialModels() []any {
+	return []any{
+		&model.User{},
+		&model.Inbound{},
+		&model.OutboundTraffics{},
+		&model.Setting{},
+		&model.InboundClientIps{},
+		&xray.ClientTraffic{},
+		&model.HistoryOfSeeders{},
+	}
+}
+
+// LatestSchemaVersion returns the newest schema version known to this binary.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// AppliedMigrations returns the migrations recorded in tx, oldest first.
+func AppliedMigrations(tx *gorm.DB) ([]model.SchemaMigration, error) {
+	if !tx.Migrator().HasTable(&model.SchemaMigration{}) {
+		return nil, nil
+	}
+	var applied []model.SchemaMigration
+	err := tx.Model(&model.SchemaMigration{}).Order("version").Find(&applied).Error
+	return applied, err
+}
+
+// PendingMigrations returns the migrations of this binary not applied to tx yet, oldest
+// first. Their AppliedAt is 0.
+func PendingMigrations(tx *gorm.DB) ([]model.SchemaMigration, error) {
+	applied, err := AppliedMigrations(tx)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+	var pending []model.SchemaMigration
+	for _, m := range migrations {
+		if !done[m.version] {
+			pending = append(pending, model.SchemaMigration{Version: m.version, Name: m.name})
+		}
+	}
+	return pending, nil
+}
+
+// SchemaVersion returns the schema version of tx, 0 for an empty database.
+func SchemaVersion(tx *gorm.DB) (int, error) {
+	applied, err := AppliedMigrations(tx)
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+	return applied[len(applied)-1].Version, nil
+}
+
+// ApplyMigrations brings tx up to LatestSchemaVersion.
+func ApplyMigrations(tx *gorm.DB) error {
+	return MigrateTo(tx, LatestSchemaVersion())
+}
+
+// MigrateTo moves the schema of tx to the target version, applying pending
+// migrations or reverting applied ones as needed. It refuses to touch a database
+// whose schema is newer than this binary, since it does not know how to revert it.
+func MigrateTo(tx *gorm.DB, target int) error {
+	if target < 0 || target > LatestSchemaVersion() {
+		return fmt.Errorf("unknown schema version %d, this binary supports up to %d", target, LatestSchemaVersion())
+	}
+	if err := tx.AutoMigrate(&model.SchemaMigration{}); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	applied, err := AppliedMigrations(tx)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, m := range applied {
+		if m.Version > LatestSchemaVersion() {
+			return fmt.Errorf("database schema version %d is newer than this binary supports (%d), please update x-ui",
+				m.Version, LatestSchemaVersion())
+		}
+		done[m.Version] = true
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= target || !done[m.version] {
+			continue
+		}
+		logger.Infof("Reverting database migration %d_%s", m.version, m.name)
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&model.SchemaMigration{}, m.version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to revert migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version > target || done[m.version] {
+			continue
+		}
+		logger.Infof("Applying database migration %d_%s", m.version, m.name)
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&model.SchemaMigration{
+				Version:   m.version,
+				Name:      m.name,
+				AppliedAt: time.Now().Unix() * 1000,
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// hashUserPasswords replaces plain text passwords with bcrypt hashes. Databases
+// that went through the former "UserPasswordHash" seeder are already hashed.
+func hashUserPasswords(tx *gorm.DB) error {
+	var seedersHistory []string
+	if err := tx.Model(&model.HistoryOfSeeders{}).Pluck("seeder_name", &seedersHistory).Error; err != nil {
+		return err
+	}
+	if slices.Contains(seedersHistory, "UserPasswordHash") {
+		return nil
+	}
+
+	var users []model.User
+	if err := tx.Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		hashedPassword, err := crypto.HashPasswordAsBcrypt(user.Password)
+		if err != nil {
+			return fmt.Errorf("failed to hash password for user '%s': %w", user.Username, err)
+		}
+		if err := tx.Model(&user).Update("password", hashedPassword).Error; err != nil {
+			return err
+		}
+	}
+
+	// Keep the seeder record so older versions do not hash the passwords again
+	return tx.Create(&model.HistoryOfSeeders{SeederName: "UserPasswordHash"}).Error
+}
+
+// fixInboundClients cleans up client settings written by old versions of the panel,
+// creates missing traffic rows and removes orphaned ones.
+func fixInboundClients(tx *gorm.DB) error {
+	var inbounds []*model.Inbound
+	if err := tx.Model(model.Inbound{}).Find(&inbounds).Error; err != nil {
+		return err
+	}
+
+	emails := make(map[string]bool)
+	for _, inbound := range inbounds {
+		// Remove the default listen address from tags
+		if strings.Contains(inbound.Tag, "0.0.0.0:") {
+			inbound.Tag = strings.ReplaceAll(inbound.Tag, "0.0.0.0:", "")
+			if err := tx.Model(inbound).Update("tag", inbound.Tag).Error; err != nil {
+				return err
+			}
+		}
+
+		settings := map[string]any{}
+		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+			continue
+		}
+
+		// Collect emails of every protocol, so only traffics of removed clients are dropped
+		clients, _ := settings["clients"].([]any)
+		for _, client := range clients {
+			if c, ok := client.(map[string]any); ok {
+				if email, ok := c["email"].(string); ok {
+					emails[email] = true
+				}
+			}
+		}
+
+		switch inbound.Protocol {
+		case model.VMESS, model.VLESS, model.Trojan:
+		default:
+			continue
+		}
+
+		changed := false
+		for _, client := range clients {
+			c, ok := client.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			// Add email='' if it is not exists
+			if _, ok := c["email"]; !ok {
+				c["email"] = ""
+				changed = true
+			}
+
+			// Convert string tgId to int64
+			if tgIdStr, ok := c["tgId"].(string); ok {
+				tgIdInt64, err := strconv.ParseInt(strings.ReplaceAll(tgIdStr, " ", ""), 10, 64)
+				if err == nil {
+					c["tgId"] = tgIdInt64
+					changed = true
+				}
+			}
+
+			// Remove "flow": "xtls-rprx-direct"
+			if c["flow"] == "xtls-rprx-direct" {
+				c["flow"] = ""
+				changed = true
+			}
+		}
+		if changed {
+			modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
+			if err != nil {
+				return err
+			}
+			inbound.Settings = string(modifiedSettings)
+			if err := tx.Model(inbound).Update("settings", inbound.Settings).Error; err != nil {
+				return err
+			}
+		}
+
+		// Add client traffic row for all clients which has email
+		var modelClients struct {
+			Clients []model.Client `json:"clients"`
+		}
+		json.Unmarshal([]byte(inbound.Settings), &modelClients)
+		for _, client := range modelClients.Clients {
+			if len(client.Email) == 0 {
+				continue
+			}
+			var count int64
+			if err := tx.Model(xray.ClientTraffic{}).Where("email = ?", client.Email).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			err := tx.Create(&xray.ClientTraffic{
+				InboundId:  inbound.Id,
+				Email:      client.Email,
+				Total:      client.TotalGB,
+				ExpiryTime: client.ExpiryTime,
+				Enable:     true,
+				Reset:      client.Reset,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := migrateExternalProxy(tx, inbound); err != nil {
+			return err
+		}
+	}
+
+	// Remove orphaned traffics
+	var traffics []xray.ClientTraffic
+	if err := tx.Select("id", "inbound_id", "email").Find(&traffics).Error; err != nil {
+		return err
+	}
+	var orphaned []int
+	for _, traffic := range traffics {
+		if traffic.InboundId == 0 || !emails[traffic.Email] {
+			orphaned = append(orphaned, traffic.Id)
+		}
+	}
+	if len(orphaned) > 0 {
+		return tx.Where("id IN ?", orphaned).Delete(xray.ClientTraffic{}).Error
+	}
+	return nil
+}
+
+// migrateExternalProxy moves the old TLS MultiDomain setting of inbound to External Proxy.
+func migrateExternalProxy(tx *gorm.DB, inbound *model.Inbound) error {
+	switch inbound.Protocol {
+	case model.VMESS, model.VLESS, model.Trojan:
+	default:
+		return nil
+	}
+	var stream map[string]any
+	if err := json.Unmarshal([]byte(inbound.StreamSettings), &stream); err != nil || stream["security"] != "tls" {
+		return nil
+	}
+	tlsSettings, ok := stream["tlsSettings"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	settings, ok := tlsSettings["settings"].(map[string]any)
+	if !ok || settings["domains"] == nil {
+		return nil
+	}
+
+	if domains, ok := settings["domains"].([]any); ok {
+		for _, domain := range domains {
+			if domainMap, ok := domain.(map[string]any); ok {
+				domainMap["forceTls"] = "same"
+				domainMap["port"] = inbound.Port
+				domainMap["dest"], _ = domainMap["domain"].(string)
+				delete(domainMap, "domain")
+			}
+		}
+	}
+	stream["externalProxy"] = settings["domains"]
+	delete(settings, "domains")
+
+	newStream, err := json.MarshalIndent(stream, " ", "  ")
+	if err != nil {
+		return err
+	}
+	return tx.Model(inbound).Update("stream_settings", string(newStream)).Error
+}
+
+// clientProtocols lists the protocols whose settings hold a "clients" array.
+var clientProtocols = []model.Protocol{model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks}
+
+// moveClientsToTable moves the "clients" array of every inbound settings into the clients table.
+// Clients without an email, or with an email used twice in the same inbound, get a new one
+// since the table is keyed by inbound and email.
+func moveClientsToTable(tx *gorm.DB) error {
+	if err := tx.AutoMigrate(&model.Client{}); err != nil {
+		return err
+	}
+
+	var inbounds []*model.Inbound
+	if err := tx.Model(model.Inbound{}).Find(&inbounds).Error; err != nil {
+		return err
+	}
+	for _, inbound := range inbounds {
+		settings := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+			continue
+		}
+		rawClients, ok := settings["clients"]
+		if !ok {
+			continue
+		}
+
+		var items []json.RawMessage
+		json.Unmarshal(rawClients, &items)
+		emails := make(map[string]bool, len(items))
+		clients := make([]model.Client, 0, len(items))
+		for _, item := range items {
+			client := model.Client{}
+			// Fields with an unexpected type, like an empty string tgId, are left zero
+			json.Unmarshal(item, &client)
+			client.InboundId = inbound.Id
+
+			email := client.Email
+			if email == "" {
+				email = strings.ToLower(random.Seq(8))
+			}
+			for i := 1; emails[email]; i++ {
+				email = fmt.Sprintf("%s-%d", client.Email, i)
+			}
+			emails[email] = true
+			if email != client.Email {
+				logger.Warningf("Client %q of inbound %d renamed to %q", client.Email, inbound.Id, email)
+				client.Email = email
+				err := tx.Create(&xray.ClientTraffic{
+					InboundId:  inbound.Id,
+					Email:      client.Email,
+					Total:      client.TotalGB,
+					ExpiryTime: client.ExpiryTime,
+					Enable:     true,
+					Reset:      client.Reset,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			clients = append(clients, client)
+		}
+		if len(clients) > 0 {
+			if err := tx.CreateInBatches(clients, 100).Error; err != nil {
+				return fmt.Errorf("failed to move clients of inbound %d: %w", inbound.Id, err)
+			}
+		}
+
+		delete(settings, "clients")
+		newSettings, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(inbound).Update("settings", string(newSettings)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveClientsToSettings writes the clients table back into the settings of every inbound and drops it.
+func moveClientsToSettings(tx *gorm.DB) error {
+	var inbounds []*model.Inbound
+	if err := tx.Model(model.Inbound{}).Find(&inbounds).Error; err != nil {
+		return err
+	}
+	for _, inbound := range inbounds {
+		clients := []model.Client{}
+		if err := tx.Where("inbound_id = ?", inbound.Id).Order("id").Find(&clients).Error; err != nil {
+			return err
+		}
+		if len(clients) == 0 && !slices.Contains(clientProtocols, inbound.Protocol) {
+			continue
+		}
+		settings := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+			settings = map[string]json.RawMessage{}
+		}
+		rawClients, err := json.Marshal(clients)
+		if err != nil {
+			return err
+		}
+		settings["clients"] = rawClients
+		newSettings, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(inbound).Update("settings", string(newSettings)).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Migrator().DropTable(&model.Client{})
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"x-ui/util/json_util"
@@ -67,6 +68,12 @@ type HistoryOfSeeders struct {
 	SeederName string `json:"seederName"`
 }
 
+type SchemaMigration struct {
+	Version   int    `json:"version" gorm:"primaryKey;autoIncrement:false"`
+	Name      string `json:"name"`
+	AppliedAt int64  `json:"appliedAt"`
+}
+
 func (i *Inbound) GenXrayInboundConfig() *xray.InboundConfig {
 	listen := i.Listen
 	if listen != "" {
@@ -90,18 +97,125 @@ type Setting struct {
 	Value string `json:"value" form:"value"`
 }
 
+// Client is a user of an inbound. Clients are stored in their own table and
+// merged into the "clients" array of Inbound.Settings when an inbound is loaded.
 type Client struct {
-	ID         string `json:"id"`
+	RowId      int    `json:"-" gorm:"column:id;primaryKey;autoIncrement"`
+	InboundId  int    `json:"-" gorm:"index:idx_clients_inbound_email,unique"`
+	ID         string `json:"id" gorm:"column:uuid;index"`
 	Security   string `json:"security"`
-	Password   string `json:"password"`
+	Password   string `json:"password" gorm:"index"`
+	Method     string `json:"method,omitempty"`
 	Flow       string `json:"flow"`
-	Email      string `json:"email"`
+	Email      string `json:"email" gorm:"index:idx_clients_inbound_email,unique"`
 	LimitIP    int    `json:"limitIp"`
 	TotalGB    int64  `json:"totalGB" form:"totalGB"`
 	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
 	Enable     bool   `json:"enable" form:"enable"`
-	TgID       int64  `json:"tgId" form:"tgId"`
-	SubID      string `json:"subId" form:"subId"`
+	TgID       int64  `json:"tgId" form:"tgId" gorm:"index"`
+	SubID      string `json:"subId" form:"subId" gorm:"index"`
 	Comment    string `json:"comment" form:"comment"`
 	Reset      int    `json:"reset" form:"reset"`
 }
+
+// DeletedItem is an inbound or a client kept in the recycle bin after being deleted.
+// Data holds everything needed to restore it, including traffic and IP records.
+type DeletedItem struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Type      string `json:"type"` // "inbound" or "client"
+	InboundId int    `json:"inboundId"`
+	Name      string `json:"name"` // remark of an inbound, email of a client
+	Data      string `json:"-"`
+	DeletedAt int64  `json:"deletedAt" gorm:"index"`
+}
+
+// XrayRevision is a saved Xray template or a config.json generated from one. Diff holds
+// the changes against the previous revision of the same kind, as a JSON list.
+type XrayRevision struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Kind       string `json:"kind" gorm:"index"` // "template" or "config"
+	Author     string `json:"author"`
+	PreviousId int    `json:"previousId"`
+	TemplateId int    `json:"templateId"` // template revision a config was generated from
+	Changes    int    `json:"changes"`    // number of changes against the previous revision
+	Content    string `json:"-"`
+	Diff       string `json:"-"`
+	CreatedAt  int64  `json:"createdAt" gorm:"index"`
+}
+
+// Plan is an offer shared by the clients of its groups. Limits of 0 mean unlimited, and
+// an empty InboundIds allows every inbound.
+type Plan struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name       string `json:"name" gorm:"unique"`
+	TotalGB    int64  `json:"totalGB"` // in bytes, as in the client
+	Days       int    `json:"days"`    // counted from the first use of the client
+	LimitIP    int    `json:"limitIp"`
+	Reset      int    `json:"reset"` // renewal period in days
+	InboundIds []int  `json:"inboundIds" gorm:"serializer:json"`
+}
+
+// ClientGroup is a named set of clients on the same plan.
+type ClientGroup struct {
+	Id      int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name    string `json:"name" gorm:"unique"`
+	PlanId  int    `json:"planId" gorm:"index"`
+	Comment string `json:"comment"`
+}
+
+// GroupMember puts the client with Email in a group. A limit marked as its own is set on
+// the client itself instead of being inherited from the plan.
+type GroupMember struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	GroupId    int    `json:"groupId" gorm:"index"`
+	Email      string `json:"email" gorm:"unique"`
+	OwnTotal   bool   `json:"ownTotal"`
+	OwnExpiry  bool   `json:"ownExpiry"`
+	OwnLimitIP bool   `json:"ownLimitIp"`
+	OwnReset   bool   `json:"ownReset"`
+}
+
+// ClientIdentity is a user with clients on several inbounds. Its clients share its traffic
+// quota, its expiry and its subscription, Up and Down count the traffic of all of them.
+type ClientIdentity struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name       string `json:"name" gorm:"unique"`
+	SubId      string `json:"subId" gorm:"unique"`
+	Enable     bool   `json:"enable"` // false once out of traffic or expired
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`      // in bytes, 0 is unlimited
+	ExpiryTime int64  `json:"expiryTime"` // negative for a duration starting with the first use
+	Reset      int    `json:"reset"`      // renewal period in days
+	Comment    string `json:"comment"`
+}
+
+// InboundTemplate is an inbound kept to create others like it. Its fields may hold
+// parameters written as ${name}, which get their values when it is instantiated.
+type InboundTemplate struct {
+	Id             int      `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name           string   `json:"name" gorm:"unique"`
+	Remark         string   `json:"remark"`
+	Listen         string   `json:"listen"`
+	Protocol       Protocol `json:"protocol"`
+	Settings       string   `json:"settings"`
+	StreamSettings string   `json:"streamSettings"`
+	Sniffing       string   `json:"sniffing"`
+	Allocate       string   `json:"allocate"`
+}
+
+// ScheduledAction is a bulk client action run on the client with Email at RunAt. One with a
+// Schedule, a cron spec, runs again at each of its times, the others run once. Actions of
+// a deleted client go to the recycle bin with it and come back when it is restored.
+type ScheduledAction struct {
+	Id        int             `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email     string          `json:"email" gorm:"index"`
+	Action    string          `json:"action"`
+	Params    json.RawMessage `json:"params" gorm:"serializer:json"` // update, days or trafficGB of the action
+	RunAt     int64           `json:"runAt" gorm:"index"`            // in ms
+	Schedule  string          `json:"schedule"`
+	Status    string          `json:"status"` // pending until a single action has run
+	LastRunAt int64           `json:"lastRunAt"`
+	Result    string          `json:"result"` // why the last run failed
+	Comment   string          `json:"comment"`
+}
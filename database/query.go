@@ -0,0 +1,66 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"x-ui/config"
+
+	"gorm.io/gorm"
+)
+
+// Some queries look inside the JSON stored in inbounds.settings or use functions
+// that differ between databases. The helpers below hide those differences from
+// the service layer.
+
+// GetDialect returns the type of the database the panel is connected to.
+func GetDialect() config.DatabaseType {
+	if currentConfig == nil {
+		return config.DatabaseTypeSQLite
+	}
+	return currentConfig.Type
+}
+
+// pgJSON converts a text column holding JSON into jsonb, treating empty strings as NULL.
+func pgJSON(column string) string {
+	return fmt.Sprintf("NULLIF(%s, '')::jsonb", column)
+}
+
+// pgJSONArray yields expr when it is a jsonb array and NULL otherwise, so it can be
+// safely expanded with jsonb_array_elements.
+func pgJSONArray(expr string) string {
+	return fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'array' THEN %s END", expr, expr)
+}
+
+// InboundIdsByFallbackDest returns a sub query selecting ids of inbounds that have a fallback to dest.
+func InboundIdsByFallbackDest(tx *gorm.DB, dest string) *gorm.DB {
+	switch GetDialect() {
+	case config.DatabaseTypePostgreSQL:
+		fallbacks := pgJSONArray(pgJSON("inbounds.settings") + " -> 'fallbacks'")
+		return tx.Raw(fmt.Sprintf(`SELECT DISTINCT inbounds.id
+			FROM inbounds, jsonb_array_elements(%s) AS fallback
+			WHERE fallback ->> 'dest' = ?`, fallbacks), dest)
+	case config.DatabaseTypeMySQL:
+		// JSON_SEARCH matches LIKE patterns and fails on invalid JSON, hence the escaping and the CASE guard
+		pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(dest)
+		return tx.Raw(`SELECT inbounds.id
+			FROM inbounds
+			WHERE CASE WHEN JSON_VALID(inbounds.settings)
+				THEN JSON_SEARCH(inbounds.settings, 'one', ?, NULL, '$.fallbacks[*].dest') END IS NOT NULL`, pattern)
+	default:
+		return tx.Raw(`SELECT DISTINCT inbounds.id
+			FROM inbounds, JSON_EACH(NULLIF(inbounds.settings, ''), '$.fallbacks') AS fallback
+			WHERE JSON_TYPE(NULLIF(inbounds.settings, ''), '$.fallbacks') = 'array'
+				AND JSON_EXTRACT(fallback.value, '$.dest') = ?`, dest)
+	}
+}
+
+// ILike returns a case-insensitive LIKE condition on column with a single placeholder.
+func ILike(column string) string {
+	switch GetDialect() {
+	case config.DatabaseTypePostgreSQL:
+		return column + " ILIKE ?"
+	default:
+		return column + " LIKE ?"
+	}
+}
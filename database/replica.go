@@ -0,0 +1,273 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+
+	"gorm.io/gorm"
+)
+
+// ReplicaStatus describes the state of a read replica as seen by the last health check.
+type ReplicaStatus struct {
+	Address   string  `json:"address"`
+	Connected bool    `json:"connected"`
+	Lag       float64 `json:"lag"` // seconds behind the primary
+	Serving   bool    `json:"serving"`
+	Error     string  `json:"error"`
+}
+
+type replica struct {
+	config  *config.DatabaseConfig
+	conn    *gorm.DB
+	status  ReplicaStatus
+	stopped bool
+}
+
+var (
+	replicaLock   sync.RWMutex
+	replicas      []*replica
+	replicaNext   atomic.Uint32
+	replicaMaxLag time.Duration
+	replicaStop   chan struct{}
+)
+
+// startReplicas connects to the replicas of dbConfig and keeps checking their health and
+// lag until stopReplicas is called. A replica that cannot be reached now is retried later.
+func startReplicas(dbConfig *config.DatabaseConfig) {
+	if len(dbConfig.Replicas) == 0 {
+		return
+	}
+	list := make([]*replica, 0, len(dbConfig.Replicas))
+	for i := range dbConfig.Replicas {
+		replicaConfig := dbConfig.GetReplicaConfig(i)
+		address := net.JoinHostPort(dbConfig.Replicas[i].Host, strconv.Itoa(replicaPort(replicaConfig)))
+		list = append(list, &replica{config: replicaConfig, status: ReplicaStatus{Address: address}})
+	}
+	stop := make(chan struct{})
+	replicaLock.Lock()
+	replicas = list
+	replicaMaxLag = time.Duration(dbConfig.MaxReplicaLag) * time.Second
+	replicaStop = stop
+	replicaLock.Unlock()
+
+	go func() {
+		checkReplicas(list)
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checkReplicas(list)
+			}
+		}
+	}()
+}
+
+func stopReplicas() {
+	replicaLock.Lock()
+	list := replicas
+	if replicaStop != nil {
+		close(replicaStop)
+		replicaStop = nil
+	}
+	replicas = nil
+	replicaLock.Unlock()
+
+	for _, r := range list {
+		replicaLock.Lock()
+		r.stopped = true
+		conn := r.conn
+		replicaLock.Unlock()
+		closeConn(conn)
+	}
+}
+
+func closeConn(conn *gorm.DB) {
+	if conn == nil {
+		return
+	}
+	if sqlDB, err := conn.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func replicaPort(dbConfig *config.DatabaseConfig) int {
+	if dbConfig.Type == config.DatabaseTypeMySQL {
+		return dbConfig.MySQL.Port
+	}
+	return dbConfig.Postgres.Port
+}
+
+// checkReplicas pings every replica and measures how far it is behind the primary.
+func checkReplicas(list []*replica) {
+	for _, r := range list {
+		// Only the health check goroutine touches conn, readers get it under replicaLock
+		conn := r.conn
+		var err error
+		if conn == nil {
+			conn, err = OpenDB(r.config)
+		}
+		var lag time.Duration
+		if err == nil {
+			lag, err = replicaLag(conn)
+		}
+
+		replicaLock.Lock()
+		if r.stopped {
+			replicaLock.Unlock()
+			if r.conn == nil {
+				closeConn(conn)
+			}
+			return
+		}
+		r.conn = conn
+		wasServing := r.status.Serving
+		r.status.Connected = err == nil
+		r.status.Lag = lag.Seconds()
+		r.status.Serving = err == nil && (replicaMaxLag == 0 || lag <= replicaMaxLag)
+		if err != nil {
+			r.status.Error = err.Error()
+		} else {
+			r.status.Error = ""
+		}
+		serving := r.status.Serving
+		replicaLock.Unlock()
+
+		if wasServing && !serving {
+			if err != nil {
+				logger.Warning("Database replica", r.status.Address, "is down, reading from the primary:", err)
+			} else {
+				logger.Warningf("Database replica %s is %.0fs behind, reading from the primary", r.status.Address, lag.Seconds())
+			}
+		} else if !wasServing && serving {
+			logger.Info("Database replica", r.status.Address, "is serving reads")
+		}
+	}
+}
+
+// replicaLag returns how far the replica behind conn is behind its primary.
+func replicaLag(conn *gorm.DB) (time.Duration, error) {
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	switch conn.Dialector.Name() {
+	case "postgres":
+		// An idle primary sends no transactions to replay, so a replica still streaming
+		// from it that replayed everything it received is up to date. One cut off from
+		// its primary receives nothing either and is judged by its last replay.
+		var inRecovery, streaming, replayed bool
+		var lag sql.NullFloat64
+		err = sqlDB.QueryRowContext(ctx, `SELECT pg_is_in_recovery(),
+			COALESCE((SELECT status = 'streaming' FROM pg_stat_wal_receiver), false),
+			COALESCE(pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn(), false),
+			EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())`).
+			Scan(&inRecovery, &streaming, &replayed, &lag)
+		if err != nil {
+			return 0, err
+		}
+		if !inRecovery {
+			return 0, fmt.Errorf("server is not a replica")
+		}
+		if streaming && replayed {
+			return 0, nil
+		}
+		// NULL means nothing was replayed since the replica started
+		if !lag.Valid {
+			return 0, fmt.Errorf("replica has replayed no transaction")
+		}
+		return time.Duration(lag.Float64 * float64(time.Second)), nil
+	case "mysql":
+		return mysqlReplicaLag(ctx, sqlDB)
+	}
+	return 0, sqlDB.PingContext(ctx)
+}
+
+// mysqlReplicaLag reads Seconds_Behind_Source, called Seconds_Behind_Master before MySQL 8.0.22 and on MariaDB.
+func mysqlReplicaLag(ctx context.Context, sqlDB *sql.DB) (time.Duration, error) {
+	rows, err := sqlDB.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		rows, err = sqlDB.QueryContext(ctx, "SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("server is not a replica")
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, column := range columns {
+		if column != "Seconds_Behind_Source" && column != "Seconds_Behind_Master" {
+			continue
+		}
+		// NULL means the replication threads are not running
+		if values[i] == nil {
+			return 0, fmt.Errorf("replication is stopped")
+		}
+		seconds, err := strconv.Atoi(string(values[i]))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, fmt.Errorf("replica status has no lag column")
+}
+
+// GetReadDB returns a handle for queries that can tolerate slightly stale data, like
+// subscriptions and listings. Replicas that are up and within the allowed lag take
+// turns; without one the primary is returned. Writes always go through GetDB.
+func GetReadDB() *gorm.DB {
+	replicaLock.RLock()
+	defer replicaLock.RUnlock()
+	if len(replicas) > 0 {
+		start := int(replicaNext.Add(1))
+		for i := range replicas {
+			r := replicas[(start+i)%len(replicas)]
+			if r.status.Serving && r.conn != nil {
+				return r.conn
+			}
+		}
+	}
+	return db
+}
+
+// GetReplicaStatus returns the state of every configured read replica.
+func GetReplicaStatus() []ReplicaStatus {
+	replicaLock.RLock()
+	defer replicaLock.RUnlock()
+	status := make([]ReplicaStatus, 0, len(replicas))
+	for _, r := range replicas {
+		status = append(status, r.status)
+	}
+	return status
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 	_ "unsafe"
 
 	"x-ui/config"
@@ -20,6 +23,7 @@ import (
 
 	"github.com/joho/godotenv"
 	"github.com/op/go-logging"
+	"gorm.io/gorm"
 )
 
 func runWebServer() {
@@ -47,6 +51,12 @@ func runWebServer() {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
+	settingService := service.SettingService{}
+	err = settingService.EncryptSecrets()
+	if err != nil {
+		log.Fatalf("Error encrypting secret settings: %v", err)
+	}
+
 	var server *web.Server
 	server = web.NewServer()
 	global.SetWebServer(server)
@@ -337,18 +347,165 @@ func GetListenIP(getListen bool) {
 	}
 }
 
-func migrateDb() {
-	inboundService := service.InboundService{}
+func migrateDb(targetVersion int, showStatus bool, confirm bool) {
+	if targetVersion < 0 && !showStatus {
+		err := database.InitDB(config.GetDBPath())
+		if err != nil {
+			log.Fatal(err)
+		}
+		printSchemaVersion(database.GetDB())
+		fmt.Println("Migration done!")
+		return
+	}
 
-	err := database.InitDB(config.GetDBPath())
+	// Opened as it is, so the status shows what is pending and -to goes straight from the
+	// current version to the target
+	db, err := database.OpenPanelDB(config.GetDBPath())
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Start migrating database...")
-	inboundService.MigrateDB()
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	version, err := database.SchemaVersion(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if showStatus {
+		applied, err := database.AppliedMigrations(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range applied {
+			fmt.Printf("%4d  %-28s %s\n", m.Version, m.Name, time.UnixMilli(m.AppliedAt).Format(time.DateTime))
+		}
+		pending, err := database.PendingMigrations(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range pending {
+			fmt.Printf("%4d  %-28s %s\n", m.Version, m.Name, "pending")
+		}
+		if targetVersion < 0 {
+			printSchemaVersion(db)
+			return
+		}
+	}
+
+	if targetVersion < version && !confirm {
+		fmt.Printf("Migrating to version %d reverts the migrations after it and drops what they added, run again with -confirm to do so\n", targetVersion)
+		os.Exit(1)
+	}
+	fmt.Printf("Migrating database schema to version %d...\n", targetVersion)
+	if err := database.MigrateTo(db, targetVersion); err != nil {
+		log.Fatal(err)
+	}
+	printSchemaVersion(db)
 	fmt.Println("Migration done!")
 }
 
+// printSchemaVersion prints the schema version of db along with the latest one.
+func printSchemaVersion(db *gorm.DB) {
+	version, err := database.SchemaVersion(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Database schema version: %d (latest: %d)\n", version, database.LatestSchemaVersion())
+}
+
+// addDatabaseFlags registers the flags describing one database of migrate-db,
+// using prefix to tell the source from the destination.
+func addDatabaseFlags(fs *flag.FlagSet, prefix string, dbConfig *config.DatabaseConfig) {
+	fs.Func(prefix+"Type", "Database type: sqlite, postgres or mysql", func(value string) error {
+		dbConfig.Type = config.DatabaseType(value)
+		return nil
+	})
+	fs.StringVar(&dbConfig.SQLite.Path, prefix+"Path", dbConfig.SQLite.Path, "SQLite database file")
+	// Server settings apply to both PostgreSQL and MySQL, so each keeps its own default port
+	fs.Func(prefix+"Host", "Database server host (default localhost)", func(value string) error {
+		dbConfig.Postgres.Host, dbConfig.MySQL.Host = value, value
+		return nil
+	})
+	fs.Func(prefix+"Port", "Database server port (default 5432 for PostgreSQL, 3306 for MySQL)", func(value string) error {
+		port, err := strconv.Atoi(value)
+		dbConfig.Postgres.Port, dbConfig.MySQL.Port = port, port
+		return err
+	})
+	fs.Func(prefix+"Name", "Database name (default x_ui)", func(value string) error {
+		dbConfig.Postgres.Database, dbConfig.MySQL.Database = value, value
+		return nil
+	})
+	fs.Func(prefix+"User", "Database user (default x_ui)", func(value string) error {
+		dbConfig.Postgres.Username, dbConfig.MySQL.Username = value, value
+		return nil
+	})
+	fs.Func(prefix+"Password", "Database password", func(value string) error {
+		dbConfig.Postgres.Password, dbConfig.MySQL.Password = value, value
+		return nil
+	})
+	fs.Func(prefix+"TimeZone", "Database time zone (default UTC)", func(value string) error {
+		dbConfig.Postgres.TimeZone, dbConfig.MySQL.TimeZone = value, value
+		return nil
+	})
+	fs.StringVar(&dbConfig.Postgres.SSLMode, prefix+"SSLMode", dbConfig.Postgres.SSLMode, "PostgreSQL SSL mode")
+	fs.StringVar(&dbConfig.MySQL.TLS, prefix+"TLS", dbConfig.MySQL.TLS, "MySQL TLS mode: false, true, skip-verify or preferred")
+	fs.StringVar(&dbConfig.MySQL.Charset, prefix+"Charset", dbConfig.MySQL.Charset, "MySQL connection charset")
+}
+
+func migrateDatabase(src *config.DatabaseConfig, dst *config.DatabaseConfig, force bool) {
+	fmt.Printf("Copying %s database to %s...\n", src.Type, dst.Type)
+	report, err := database.CopyDatabase(src, dst, force)
+	if err != nil {
+		fmt.Println("Database migration failed:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-22s %10s %10s  %s\n", "TABLE", "SOURCE", "DEST", "CHECKSUM")
+	for _, table := range report.Tables {
+		status := "ok"
+		if !table.OK() {
+			status = "MISMATCH " + table.SourceChecksum[:12] + " != " + table.DestChecksum[:12]
+		}
+		fmt.Printf("%-22s %10d %10d  %s\n", table.Table, table.SourceRows, table.DestRows, status)
+	}
+	if !report.OK() {
+		fmt.Println("Verification failed, the destination database does not match the source.")
+		os.Exit(1)
+	}
+	fmt.Println("Migration done and verified!")
+	fmt.Println("Update DB_TYPE and related settings in /etc/x-ui/db.env to switch the panel to the new database.")
+}
+
+func secretKey(rotate bool) {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	settingService := service.SettingService{}
+
+	if !rotate {
+		if err := settingService.EncryptSecrets(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Secret settings are encrypted with the key from", service.SecretKeySource())
+		return
+	}
+
+	newKey, count, err := settingService.RotateSecretKey()
+	if err != nil {
+		fmt.Println("Secret key rotation failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Re-encrypted %d secret settings with a new key.\n", count)
+	if os.Getenv("XUI_SECRET_KEY") != "" {
+		fmt.Println("Set XUI_SECRET_KEY to the new key before restarting the panel:")
+		fmt.Println(base64.StdEncoding.EncodeToString(newKey))
+	} else {
+		fmt.Println("New key saved to", config.GetSecretKeyPath())
+	}
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		runWebServer()
@@ -392,14 +549,38 @@ func main() {
 	settingCmd.StringVar(&tgbotchatid, "tgbotchatid", "", "Set chat ID for Telegram bot notifications")
 	settingCmd.BoolVar(&enabletgbot, "enabletgbot", false, "Enable notifications via Telegram bot")
 
+	migrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var migrateTo int
+	var migrateStatus bool
+	migrateCmd.IntVar(&migrateTo, "to", -1, "Migrate the database schema to this version, reverting newer migrations")
+	var migrateConfirm bool
+	migrateCmd.BoolVar(&migrateStatus, "status", false, "Display applied and pending database migrations")
+	migrateCmd.BoolVar(&migrateConfirm, "confirm", false, "Confirm reverting migrations with -to, which drops what they added")
+
+	migrateDbCmd := flag.NewFlagSet("migrate-db", flag.ExitOnError)
+	srcDbConfig := config.GetDefaultDatabaseConfig()
+	srcDbConfig.SQLite.Path = config.GetDBPath()
+	dstDbConfig := config.GetDefaultDatabaseConfig()
+	dstDbConfig.Type = config.DatabaseTypePostgreSQL
+	var migrateForce bool
+	addDatabaseFlags(migrateDbCmd, "src", srcDbConfig)
+	addDatabaseFlags(migrateDbCmd, "dst", dstDbConfig)
+	migrateDbCmd.BoolVar(&migrateForce, "force", false, "Overwrite a destination database that already has data")
+
+	secretKeyCmd := flag.NewFlagSet("secret-key", flag.ExitOnError)
+	var rotateKey bool
+	secretKeyCmd.BoolVar(&rotateKey, "rotate", false, "Generate a new key and re-encrypt secret settings with it")
+
 	oldUsage := flag.Usage
 	flag.Usage = func() {
 		oldUsage()
 		fmt.Println()
 		fmt.Println("Commands:")
 		fmt.Println("    run            run web panel")
-		fmt.Println("    migrate        migrate form other/old x-ui")
+		fmt.Println("    migrate        apply pending database migrations or revert to a schema version")
+		fmt.Println("    migrate-db     copy all data between SQLite, PostgreSQL and MySQL")
 		fmt.Println("    setting        set settings")
+		fmt.Println("    secret-key     encrypt secret settings or rotate the key encrypting them")
 	}
 
 	flag.Parse()
@@ -417,7 +598,19 @@ func main() {
 		}
 		runWebServer()
 	case "migrate":
-		migrateDb()
+		err := migrateCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		migrateDb(migrateTo, migrateStatus, migrateConfirm)
+	case "migrate-db":
+		err := migrateDbCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		migrateDatabase(srcDbConfig, dstDbConfig, migrateForce)
 	case "setting":
 		err := settingCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -444,6 +637,13 @@ func main() {
 		if enabletgbot {
 			updateTgbotEnableSts(enabletgbot)
 		}
+	case "secret-key":
+		err := secretKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		secretKey(rotateKey)
 	case "cert":
 		err := settingCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -461,5 +661,11 @@ func main() {
 		runCmd.Usage()
 		fmt.Println()
 		settingCmd.Usage()
+		fmt.Println()
+		migrateCmd.Usage()
+		fmt.Println()
+		migrateDbCmd.Usage()
+		fmt.Println()
+		secretKeyCmd.Usage()
 	}
 }
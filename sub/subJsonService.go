@@ -78,6 +78,8 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 	var clientTraffics []xray.ClientTraffic
 	var configArray []json_util.RawMessage
 
+	identityTraffic := s.SubService.applyIdentity(subId, inbounds)
+
 	// Prepare Inbounds
 	for _, inbound := range inbounds {
 		clients, err := s.inboundService.GetClients(inbound)
@@ -132,6 +134,10 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 		}
 	}
 
+	if identityTraffic != nil {
+		traffic = *identityTraffic
+	}
+
 	// Combile outbounds
 	var finalJson []byte
 	if len(configArray) == 1 {
@@ -53,6 +53,7 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, string, error
 	if err != nil {
 		s.datepicker = "gregorian"
 	}
+	identityTraffic := s.applyIdentity(subId, inbounds)
 	for _, inbound := range inbounds {
 		clients, err := s.inboundService.GetClients(inbound)
 		if err != nil {
@@ -100,21 +101,62 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, string, error
 			}
 		}
 	}
+	if identityTraffic != nil {
+		traffic = *identityTraffic
+	}
 	header = fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
 	return result, header, nil
 }
 
+// applyIdentity shows the shared traffic and limits of the client identity with subscription
+// subId on its clients in inbounds. It returns them for the whole subscription, nil when
+// the subscription is not the one of an identity.
+func (s *SubService) applyIdentity(subId string, inbounds []*model.Inbound) *xray.ClientTraffic {
+	identity, err := s.inboundService.GetIdentityBySubId(subId)
+	if err != nil {
+		logger.Warning("SubService - GetIdentityBySubId:", err)
+		return nil
+	}
+	if identity == nil {
+		return nil
+	}
+	traffic := &xray.ClientTraffic{
+		Enable:     identity.Enable,
+		Up:         identity.Up,
+		Down:       identity.Down,
+		Total:      identity.Total,
+		ExpiryTime: identity.ExpiryTime,
+		IdentityId: identity.Id,
+	}
+	for _, inbound := range inbounds {
+		for i := range inbound.ClientStats {
+			stats := &inbound.ClientStats[i]
+			if stats.IdentityId == identity.Id {
+				stats.Up = traffic.Up
+				stats.Down = traffic.Down
+				stats.Total = traffic.Total
+				stats.ExpiryTime = traffic.ExpiryTime
+			}
+		}
+	}
+	// A duration that has not started yet has no expiry date
+	traffic.ExpiryTime = max(traffic.ExpiryTime, 0)
+	return traffic
+}
+
+// getInboundsBySubId reads from a replica when one is available, subscriptions
+// are polled often and a few seconds of delay do not matter to them.
 func (s *SubService) getInboundsBySubId(subId string) ([]*model.Inbound, error) {
-	db := database.GetDB()
+	db := database.GetReadDB()
 	var inbounds []*model.Inbound
-	err := db.Model(model.Inbound{}).Preload("ClientStats").Where(`id in (
-		SELECT DISTINCT inbounds.id
-		FROM inbounds,
-			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client 
-		WHERE
-			protocol in ('vmess','vless','trojan','shadowsocks')
-			AND JSON_EXTRACT(client.value, '$.subId') = ? AND enable = ?
-	)`, subId, true).Find(&inbounds).Error
+	err := db.Model(model.Inbound{}).Preload("ClientStats").
+		Where("id IN (?)", db.Model(model.Client{}).Select("inbound_id").Where("sub_id = ?", subId)).
+		Where("protocol IN ? AND enable = ?", []string{"vmess", "vless", "trojan", "shadowsocks"}, true).
+		Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.inboundService.LoadClients(db, inbounds...)
 	if err != nil {
 		return nil, err
 	}
@@ -131,11 +173,10 @@ func (s *SubService) getClientTraffics(traffics []xray.ClientTraffic, email stri
 }
 
 func (s *SubService) getFallbackMaster(dest string, streamSettings string) (string, int, string, error) {
-	db := database.GetDB()
+	db := database.GetReadDB()
 	var inbound *model.Inbound
 	err := db.Model(model.Inbound{}).
-		Where("JSON_TYPE(settings, '$.fallbacks') = 'array'").
-		Where("EXISTS (SELECT * FROM json_each(settings, '$.fallbacks') WHERE json_extract(value, '$.dest') = ?)", dest).
+		Where("id IN (?)", database.InboundIdsByFallbackDest(db, dest)).
 		Find(&inbound).Error
 	if err != nil {
 		return "", 0, "", err
@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sealed values have the form enc:v1:<key id>:<wrapped data key>:<ciphertext>.
+// Every value is encrypted with its own random data key, which is in turn
+// encrypted with the master key, so only the master key has to be kept outside the database.
+const sealedPrefix = "enc:v1:"
+
+// KeySize is the size in bytes of master and data keys (AES-256).
+const KeySize = 32
+
+var ErrWrongKey = errors.New("value was encrypted with a different key")
+
+// GenerateKey returns a new random master key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// KeyID returns a short fingerprint of key, stored along with sealed values.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// IsSealed reports whether value was produced by Seal.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// SealedKeyID returns the id of the master key value was sealed with.
+func SealedKeyID(value string) (string, bool) {
+	if !IsSealed(value) {
+		return "", false
+	}
+	id, _, ok := strings.Cut(strings.TrimPrefix(value, sealedPrefix), ":")
+	return id, ok
+}
+
+// Seal encrypts plaintext with a new data key and wraps the data key with key.
+func Seal(key []byte, plaintext string) (string, error) {
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := gcmSeal(key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := gcmSeal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + KeyID(key) + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Open decrypts a value produced by Seal with the same key.
+func Open(key []byte, sealed string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(sealed, sealedPrefix), ":")
+	if !IsSealed(sealed) || len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	if parts[0] != KeyID(key) {
+		return "", fmt.Errorf("%w (key id %s)", ErrWrongKey, parts[0])
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := gcmOpen(key, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcmOpen(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmSeal encrypts data with key, prefixing the result with a random nonce.
+func gcmSeal(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func gcmOpen(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,174 @@
+package json_util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+)
+
+// Change is a value added, removed or replaced between two JSON documents. Path names
+// the value with object keys separated by dots and array elements in brackets, either by
+// index like rules[0] or by key like inbounds[tag=api].
+type Change struct {
+	Path string `json:"path"`
+	Op   string `json:"op"`
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+// elementKeys are the fields identifying the elements of an array of objects, so that
+// inserting an inbound or a client does not show up as a change of every one after it.
+var elementKeys = []string{"tag", "email"}
+
+// Diff compares two JSON documents structurally, ignoring formatting and key order.
+func Diff(before, after []byte) ([]Change, error) {
+	oldValue, err := decode(before)
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := decode(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]Change, 0)
+	diffValues(&changes, "", oldValue, newValue)
+	return changes, nil
+}
+
+// decode keeps numbers as written, large integers would lose precision as float64.
+func decode(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func diffValues(changes *[]Change, path string, before, after any) {
+	switch oldValue := before.(type) {
+	case map[string]any:
+		if newValue, ok := after.(map[string]any); ok {
+			diffObjects(changes, path, oldValue, newValue)
+			return
+		}
+	case []any:
+		if newValue, ok := after.([]any); ok {
+			diffArrays(changes, path, oldValue, newValue)
+			return
+		}
+	}
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, Change{Path: path, Op: OpReplace, Old: before, New: after})
+	}
+}
+
+func diffObjects(changes *[]Change, path string, before, after map[string]any) {
+	keys := make([]string, 0, len(before)+len(after))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		oldValue, inOld := before[key]
+		newValue, inNew := after[key]
+		switch {
+		case !inNew:
+			*changes = append(*changes, Change{Path: keyPath, Op: OpRemove, Old: oldValue})
+		case !inOld:
+			*changes = append(*changes, Change{Path: keyPath, Op: OpAdd, New: newValue})
+		default:
+			diffValues(changes, keyPath, oldValue, newValue)
+		}
+	}
+}
+
+func diffArrays(changes *[]Change, path string, before, after []any) {
+	key := elementKey(before, after)
+	if key == "" {
+		for i := 0; i < max(len(before), len(after)); i++ {
+			elementPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(after):
+				*changes = append(*changes, Change{Path: elementPath, Op: OpRemove, Old: before[i]})
+			case i >= len(before):
+				*changes = append(*changes, Change{Path: elementPath, Op: OpAdd, New: after[i]})
+			default:
+				diffValues(changes, elementPath, before[i], after[i])
+			}
+		}
+		return
+	}
+
+	newElements := make(map[string]any, len(after))
+	for _, element := range after {
+		newElements[element.(map[string]any)[key].(string)] = element
+	}
+	oldElements := make(map[string]bool, len(before))
+	for _, element := range before {
+		id := element.(map[string]any)[key].(string)
+		oldElements[id] = true
+		elementPath := fmt.Sprintf("%s[%s=%s]", path, key, id)
+		if newElement, ok := newElements[id]; ok {
+			diffValues(changes, elementPath, element, newElement)
+		} else {
+			*changes = append(*changes, Change{Path: elementPath, Op: OpRemove, Old: element})
+		}
+	}
+	for _, element := range after {
+		id := element.(map[string]any)[key].(string)
+		if !oldElements[id] {
+			elementPath := fmt.Sprintf("%s[%s=%s]", path, key, id)
+			*changes = append(*changes, Change{Path: elementPath, Op: OpAdd, New: element})
+		}
+	}
+}
+
+// elementKey returns the field of elementKeys that every element of both arrays has, as a
+// string unique within its array. It returns an empty string when there is none.
+func elementKey(arrays ...[]any) string {
+	for _, key := range elementKeys {
+		if hasUniqueKey(key, arrays...) {
+			return key
+		}
+	}
+	return ""
+}
+
+func hasUniqueKey(key string, arrays ...[]any) bool {
+	empty := true
+	for _, array := range arrays {
+		seen := make(map[string]bool, len(array))
+		for _, element := range array {
+			object, ok := element.(map[string]any)
+			if !ok {
+				return false
+			}
+			id, ok := object[key].(string)
+			if !ok || id == "" || seen[id] {
+				return false
+			}
+			seen[id] = true
+			empty = false
+		}
+	}
+	return !empty
+}
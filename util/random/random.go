@@ -41,6 +41,15 @@ func Seq(n int) string {
 	return string(runes)
 }
 
+// NumLower returns n random digits and lowercase letters.
+func NumLower(n int) string {
+	runes := make([]rune, n)
+	for i := 0; i < n; i++ {
+		runes[i] = numLowerSeq[rand.Intn(len(numLowerSeq))]
+	}
+	return string(runes)
+}
+
 func Num(n int) int {
 	return rand.Intn(n)
 }
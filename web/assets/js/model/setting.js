@@ -9,6 +9,8 @@ class AllSetting {
         this.webBasePath = "/";
         this.sessionMaxAge = 60;
         this.pageSize = 50;
+        this.recycleBinDays = 30;
+        this.xrayReloadGrace = 30;
         this.expireDiff = 0;
         this.trafficDiff = 0;
         this.remarkModel = "-ieo";
@@ -54,6 +56,8 @@ class AllSetting {
         this.dbPassword = "";        
         this.dbSSLMode = "disable";        
         this.dbTimeZone = "UTC";        
+        this.dbCharset = "utf8mb4";
+        this.dbTLS = "false";
         this.timeLocation = "Local";
 
         if (data == null) {
@@ -8,8 +8,11 @@ import (
 
 type APIController struct {
 	BaseController
-	inboundController *InboundController
-	Tgbot             service.Tgbot
+	inboundController  *InboundController
+	planController     *PlanController
+	identityController *IdentityController
+	scheduleController *ScheduleController
+	Tgbot              service.Tgbot
 }
 
 func NewAPIController(g *gin.RouterGroup) *APIController {
@@ -23,6 +26,9 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 	g.Use(a.checkLogin)
 
 	a.inboundController = NewInboundController(g)
+	a.planController = NewPlanController(g)
+	a.identityController = NewIdentityController(g)
+	a.scheduleController = NewScheduleController(g)
 
 	inboundRoutes := []struct {
 		Method  string
@@ -39,14 +45,50 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 		{"POST", "/update/:id", a.inboundController.updateInbound},
 		{"POST", "/clientIps/:email", a.inboundController.getClientIps},
 		{"POST", "/clearClientIps/:email", a.inboundController.clearClientIps},
+		{"GET", "/accessHistory", a.inboundController.getAccessHistory},
 		{"POST", "/addClient", a.inboundController.addInboundClient},
 		{"POST", "/:id/delClient/:clientId", a.inboundController.delInboundClient},
 		{"POST", "/updateClient/:clientId", a.inboundController.updateInboundClient},
+		{"POST", "/bulk/:action", a.inboundController.bulkClients},
 		{"POST", "/:id/resetClientTraffic/:email", a.inboundController.resetClientTraffic},
 		{"POST", "/resetAllTraffics", a.inboundController.resetAllTraffics},
 		{"POST", "/resetAllClientTraffics/:id", a.inboundController.resetAllClientTraffics},
 		{"POST", "/delDepletedClients/:id", a.inboundController.delDepletedClients},
 		{"POST", "/onlines", a.inboundController.onlines},
+		{"GET", "/recycleBin", a.inboundController.getRecycleBin},
+		{"POST", "/recycleBin/restore/:id", a.inboundController.restoreDeletedItem},
+		{"POST", "/recycleBin/purge/:id", a.inboundController.purgeDeletedItem},
+		{"POST", "/recycleBin/purge", a.inboundController.purgeRecycleBin},
+		{"POST", "/clone/:id", a.inboundController.cloneInbound},
+		{"GET", "/templates", a.inboundController.getTemplates},
+		{"POST", "/templates/add", a.inboundController.addTemplate},
+		{"POST", "/templates/update/:id", a.inboundController.updateTemplate},
+		{"POST", "/templates/del/:id", a.inboundController.delTemplate},
+		{"POST", "/templates/fromInbound/:id", a.inboundController.saveInboundAsTemplate},
+		{"POST", "/templates/:id/instantiate", a.inboundController.instantiateTemplate},
+		{"GET", "/plans", a.planController.getPlans},
+		{"POST", "/plans/add", a.planController.addPlan},
+		{"POST", "/plans/update/:id", a.planController.updatePlan},
+		{"POST", "/plans/del/:id", a.planController.delPlan},
+		{"GET", "/groups", a.planController.getGroups},
+		{"POST", "/groups/add", a.planController.addGroup},
+		{"POST", "/groups/update/:id", a.planController.updateGroup},
+		{"POST", "/groups/del/:id", a.planController.delGroup},
+		{"GET", "/groups/:id/members", a.planController.getGroupMembers},
+		{"POST", "/groups/:id/addMembers", a.planController.addGroupMembers},
+		{"POST", "/groups/:id/removeMembers", a.planController.removeGroupMembers},
+		{"GET", "/identities", a.identityController.getIdentities},
+		{"POST", "/identities/add", a.identityController.addIdentity},
+		{"POST", "/identities/update/:id", a.identityController.updateIdentity},
+		{"POST", "/identities/del/:id", a.identityController.delIdentity},
+		{"POST", "/identities/:id/addClients", a.identityController.addIdentityClients},
+		{"POST", "/identities/:id/removeClients", a.identityController.removeIdentityClients},
+		{"POST", "/identities/:id/resetTraffic", a.identityController.resetIdentityTraffic},
+		{"GET", "/schedules", a.scheduleController.getActions},
+		{"GET", "/schedules/client/:email", a.scheduleController.getActions},
+		{"POST", "/schedules/add", a.scheduleController.addAction},
+		{"POST", "/schedules/update/:id", a.scheduleController.updateAction},
+		{"POST", "/schedules/del/:id", a.scheduleController.delAction},
 	}
 
 	for _, route := range inboundRoutes {
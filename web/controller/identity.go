@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type IdentityController struct {
+	identityService service.IdentityService
+	xrayService     service.XrayService
+}
+
+func NewIdentityController(g *gin.RouterGroup) *IdentityController {
+	a := &IdentityController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *IdentityController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/identity")
+
+	g.POST("/list", a.getIdentities)
+	g.POST("/add", a.addIdentity)
+	g.POST("/update/:id", a.updateIdentity)
+	g.POST("/del/:id", a.delIdentity)
+	g.POST("/:id/addClients", a.addIdentityClients)
+	g.POST("/:id/removeClients", a.removeIdentityClients)
+	g.POST("/:id/resetTraffic", a.resetIdentityTraffic)
+}
+
+func (a *IdentityController) getIdentities(c *gin.Context) {
+	identities, err := a.identityService.GetIdentities()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, identities, nil)
+}
+
+func (a *IdentityController) addIdentity(c *gin.Context) {
+	identity := &model.ClientIdentity{}
+	err := c.ShouldBindJSON(identity)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.identityService.AddIdentity(identity)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), identity, err)
+}
+
+// updateIdentity changes an identity, which changes the limits of its clients.
+func (a *IdentityController) updateIdentity(c *gin.Context) {
+	identity := &model.ClientIdentity{}
+	err := c.ShouldBindJSON(identity)
+	if err == nil {
+		identity.Id, err = strconv.Atoi(c.Param("id"))
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	changed, err := a.identityService.UpdateIdentity(identity)
+	if changed {
+		a.xrayService.ReconcileXray()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), identity, err)
+}
+
+func (a *IdentityController) delIdentity(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err == nil {
+		err = a.identityService.DelIdentity(id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+// addIdentityClients links clients to an identity and creates new ones for it in other inbounds.
+func (a *IdentityController) addIdentityClients(c *gin.Context) {
+	req := &service.IdentityClientsRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	results, changed, err := a.identityService.AddIdentityClients(id, req)
+	if changed {
+		a.xrayService.ReconcileXray()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), results, err)
+}
+
+// removeIdentityClients takes clients out of an identity, each keeps its quota on its own.
+func (a *IdentityController) removeIdentityClients(c *gin.Context) {
+	req := &service.IdentityClientsRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	results, err := a.identityService.RemoveIdentityClients(id, req.Emails)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), results, err)
+}
+
+func (a *IdentityController) resetIdentityTraffic(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.resetInboundClientTrafficSuccess"), err)
+		return
+	}
+	changed, err := a.identityService.ResetIdentityTraffic(id)
+	if changed {
+		a.xrayService.ReconcileXray()
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.resetInboundClientTrafficSuccess"), err)
+}
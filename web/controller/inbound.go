@@ -3,18 +3,21 @@ package controller
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"strconv"
 
 	"x-ui/database/model"
 	"x-ui/web/service"
 	"x-ui/web/session"
+	"x-ui/xray"
 
 	"github.com/gin-gonic/gin"
 )
 
 type InboundController struct {
-	inboundService service.InboundService
-	xrayService    service.XrayService
+	inboundService  service.InboundService
+	templateService service.InboundTemplateService
+	xrayService     service.XrayService
 }
 
 func NewInboundController(g *gin.RouterGroup) *InboundController {
@@ -32,15 +35,28 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/update/:id", a.updateInbound)
 	g.POST("/clientIps/:email", a.getClientIps)
 	g.POST("/clearClientIps/:email", a.clearClientIps)
+	g.POST("/accessHistory", a.getAccessHistory)
 	g.POST("/addClient", a.addInboundClient)
 	g.POST("/:id/delClient/:clientId", a.delInboundClient)
 	g.POST("/updateClient/:clientId", a.updateInboundClient)
+	g.POST("/bulk/:action", a.bulkClients)
 	g.POST("/:id/resetClientTraffic/:email", a.resetClientTraffic)
 	g.POST("/resetAllTraffics", a.resetAllTraffics)
 	g.POST("/resetAllClientTraffics/:id", a.resetAllClientTraffics)
 	g.POST("/delDepletedClients/:id", a.delDepletedClients)
 	g.POST("/import", a.importInbound)
 	g.POST("/onlines", a.onlines)
+	g.POST("/recycleBin", a.getRecycleBin)
+	g.POST("/recycleBin/restore/:id", a.restoreDeletedItem)
+	g.POST("/recycleBin/purge/:id", a.purgeDeletedItem)
+	g.POST("/recycleBin/purge", a.purgeRecycleBin)
+	g.POST("/clone/:id", a.cloneInbound)
+	g.POST("/templates", a.getTemplates)
+	g.POST("/templates/add", a.addTemplate)
+	g.POST("/templates/update/:id", a.updateTemplate)
+	g.POST("/templates/del/:id", a.delTemplate)
+	g.POST("/templates/fromInbound/:id", a.saveInboundAsTemplate)
+	g.POST("/templates/:id/instantiate", a.instantiateTemplate)
 }
 
 func (a *InboundController) getInbounds(c *gin.Context) {
@@ -181,6 +197,22 @@ func (a *InboundController) clearClientIps(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.logCleanSuccess"), nil)
 }
 
+// getAccessHistory returns the connections logged by Xray, filtered by client, inbound,
+// destination domain, status and time range.
+func (a *InboundController) getAccessHistory(c *gin.Context) {
+	query := &xray.AccessQuery{}
+	if err := c.ShouldBind(query); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	records, err := a.inboundService.GetAccessHistory(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, records, nil)
+}
+
 func (a *InboundController) addInboundClient(c *gin.Context) {
 	data := &model.Inbound{}
 	err := c.ShouldBind(data)
@@ -246,6 +278,27 @@ func (a *InboundController) updateInboundClient(c *gin.Context) {
 	}
 }
 
+// bulkClients adds, updates, extends, tops up, enables, disables or deletes many clients
+// at once and applies the result to Xray in one go.
+func (a *InboundController) bulkClients(c *gin.Context) {
+	req := &service.ClientBulkRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		return
+	}
+
+	results, changed, err := a.inboundService.BulkClients(c.Param("action"), req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	if changed {
+		a.xrayService.ReconcileXray()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), results, nil)
+}
+
 func (a *InboundController) resetClientTraffic(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -339,3 +392,155 @@ func (a *InboundController) delDepletedClients(c *gin.Context) {
 func (a *InboundController) onlines(c *gin.Context) {
 	jsonObj(c, a.inboundService.GetOnlineClients(), nil)
 }
+
+func (a *InboundController) getRecycleBin(c *gin.Context) {
+	items, err := a.inboundService.GetRecycleBin()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, items, nil)
+}
+
+func (a *InboundController) restoreDeletedItem(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.restoreSuccess"), err)
+		return
+	}
+	needRestart, err := a.inboundService.RestoreDeletedItem(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.restoreSuccess"), nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) purgeDeletedItem(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.purgeSuccess"), err)
+		return
+	}
+	err = a.inboundService.PurgeDeletedItem(id)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.purgeSuccess"), err)
+}
+
+func (a *InboundController) purgeRecycleBin(c *gin.Context) {
+	err := a.inboundService.PurgeRecycleBin()
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.purgeSuccess"), err)
+}
+
+// cloneInbound copies an inbound, with or without its clients, on a free port with fresh keys.
+func (a *InboundController) cloneInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), err)
+		return
+	}
+	// Every field of the request is optional, so is the request itself
+	req := &service.CloneInboundRequest{}
+	if err := c.ShouldBindJSON(req); err != nil && err != io.EOF {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	inbound, needRestart, err := a.inboundService.CloneInbound(user.Id, id, req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) getTemplates(c *gin.Context) {
+	templates, err := a.templateService.GetTemplates()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, templates, nil)
+}
+
+func (a *InboundController) addTemplate(c *gin.Context) {
+	template := &model.InboundTemplate{}
+	err := c.ShouldBindJSON(template)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.templateService.AddTemplate(template)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), template, err)
+}
+
+func (a *InboundController) updateTemplate(c *gin.Context) {
+	template := &model.InboundTemplate{}
+	err := c.ShouldBindJSON(template)
+	if err == nil {
+		template.Id, err = strconv.Atoi(c.Param("id"))
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.templateService.UpdateTemplate(template)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), template, err)
+}
+
+func (a *InboundController) delTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err == nil {
+		err = a.templateService.DelTemplate(id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+// saveInboundAsTemplate keeps an inbound, without its clients, as a template with the given name.
+func (a *InboundController) saveInboundAsTemplate(c *gin.Context) {
+	req := &struct {
+		Name string `json:"name"`
+	}{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	template, err := a.templateService.SaveInboundAsTemplate(id, req.Name)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), template, err)
+}
+
+// instantiateTemplate creates an inbound from a template and the values of its parameters.
+func (a *InboundController) instantiateTemplate(c *gin.Context) {
+	req := &service.InstantiateTemplateRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), err)
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	inbound, needRestart, err := a.templateService.InstantiateTemplate(user.Id, id, req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PlanController struct {
+	planService service.PlanService
+	xrayService service.XrayService
+}
+
+func NewPlanController(g *gin.RouterGroup) *PlanController {
+	a := &PlanController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *PlanController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/plan")
+
+	g.POST("/list", a.getPlans)
+	g.POST("/add", a.addPlan)
+	g.POST("/update/:id", a.updatePlan)
+	g.POST("/del/:id", a.delPlan)
+	g.POST("/groups", a.getGroups)
+	g.POST("/groups/add", a.addGroup)
+	g.POST("/groups/update/:id", a.updateGroup)
+	g.POST("/groups/del/:id", a.delGroup)
+	g.POST("/groups/:id/members", a.getGroupMembers)
+	g.POST("/groups/:id/addMembers", a.addGroupMembers)
+	g.POST("/groups/:id/removeMembers", a.removeGroupMembers)
+}
+
+func (a *PlanController) getPlans(c *gin.Context) {
+	plans, err := a.planService.GetPlans()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, plans, nil)
+}
+
+func (a *PlanController) addPlan(c *gin.Context) {
+	plan := &model.Plan{}
+	err := c.ShouldBindJSON(plan)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.planService.AddPlan(plan)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), plan, err)
+}
+
+// updatePlan changes a plan, which changes the limits of the clients on it.
+func (a *PlanController) updatePlan(c *gin.Context) {
+	plan := &model.Plan{}
+	err := c.ShouldBindJSON(plan)
+	if err == nil {
+		plan.Id, err = strconv.Atoi(c.Param("id"))
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	changed, err := a.planService.UpdatePlan(plan)
+	if changed {
+		a.xrayService.ReconcileXray()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), plan, err)
+}
+
+func (a *PlanController) delPlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err == nil {
+		err = a.planService.DelPlan(id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *PlanController) getGroups(c *gin.Context) {
+	groups, err := a.planService.GetGroups()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, groups, nil)
+}
+
+func (a *PlanController) addGroup(c *gin.Context) {
+	group := &model.ClientGroup{}
+	err := c.ShouldBindJSON(group)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.planService.AddGroup(group)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), group, err)
+}
+
+// updateGroup changes a group, putting it on another plan changes the limits of its members.
+func (a *PlanController) updateGroup(c *gin.Context) {
+	group := &model.ClientGroup{}
+	err := c.ShouldBindJSON(group)
+	if err == nil {
+		group.Id, err = strconv.Atoi(c.Param("id"))
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	changed, err := a.planService.UpdateGroup(group)
+	if changed {
+		a.xrayService.ReconcileXray()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), group, err)
+}
+
+func (a *PlanController) delGroup(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err == nil {
+		err = a.planService.DelGroup(id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *PlanController) getGroupMembers(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	members, err := a.planService.GetGroupMembers(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, members, nil)
+}
+
+// addGroupMembers puts clients in a group, giving them the limits of its plan.
+func (a *PlanController) addGroupMembers(c *gin.Context) {
+	req := &service.GroupMembersRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	results, changed, err := a.planService.AddGroupMembers(id, req)
+	if changed {
+		a.xrayService.ReconcileXray()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), results, err)
+}
+
+// removeGroupMembers takes clients out of a group, they keep the limits they have.
+func (a *PlanController) removeGroupMembers(c *gin.Context) {
+	req := &service.GroupMembersRequest{}
+	err := c.ShouldBindJSON(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	results, err := a.planService.RemoveGroupMembers(id, req.Emails)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), results, err)
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ScheduleController struct {
+	scheduleService service.ScheduleService
+}
+
+func NewScheduleController(g *gin.RouterGroup) *ScheduleController {
+	a := &ScheduleController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ScheduleController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/schedule")
+
+	g.POST("/list", a.getActions)
+	g.POST("/client/:email", a.getActions)
+	g.POST("/add", a.addAction)
+	g.POST("/update/:id", a.updateAction)
+	g.POST("/del/:id", a.delAction)
+}
+
+// getActions lists the scheduled actions, of a single client when an email is given.
+func (a *ScheduleController) getActions(c *gin.Context) {
+	actions, err := a.scheduleService.GetActions(c.Param("email"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, actions, nil)
+}
+
+func (a *ScheduleController) addAction(c *gin.Context) {
+	action := &model.ScheduledAction{}
+	err := c.ShouldBindJSON(action)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.scheduleService.AddAction(action)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), action, err)
+}
+
+// updateAction changes a scheduled action, which runs again even if it already ran.
+func (a *ScheduleController) updateAction(c *gin.Context) {
+	action := &model.ScheduledAction{}
+	err := c.ShouldBindJSON(action)
+	if err == nil {
+		action.Id, err = strconv.Atoi(c.Param("id"))
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.scheduleService.UpdateAction(action)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), action, err)
+}
+
+func (a *ScheduleController) delAction(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err == nil {
+		err = a.scheduleService.DelAction(id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
@@ -44,8 +44,12 @@ func (a *ServerController) initRouter(g *gin.RouterGroup) {
 	g.POST("/stopXrayService", a.stopXrayService)
 	g.POST("/restartXrayService", a.restartXrayService)
 	g.POST("/installXray/:version", a.installXray)
+	g.GET("/installedXrayVersions", a.getInstalledXrayVersions)
+	g.POST("/rollbackXray", a.rollbackXray)
 	g.POST("/updateGeofile/:fileName", a.updateGeofile)
 	g.POST("/logs/:count", a.getLogs)
+	g.GET("/crashReports", a.getCrashReports)
+	g.GET("/crashReports/:name", a.getCrashReport)
 	g.POST("/getConfigJson", a.getConfigJson)
 	g.GET("/getDb", a.getDb)
 	g.POST("/importDB", a.importDB)
@@ -99,6 +103,16 @@ func (a *ServerController) installXray(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
 }
 
+func (a *ServerController) getInstalledXrayVersions(c *gin.Context) {
+	versions, err := a.serverService.GetInstalledXrayVersions()
+	jsonObj(c, versions, err)
+}
+
+func (a *ServerController) rollbackXray(c *gin.Context) {
+	version, err := a.serverService.RollbackXray()
+	jsonMsgObj(c, I18nWeb(c, "pages.index.xrayRollbackPopover"), version, err)
+}
+
 func (a *ServerController) updateGeofile(c *gin.Context) {
 	fileName := c.Param("fileName")
 	err := a.serverService.UpdateGeofile(fileName)
@@ -132,6 +146,16 @@ func (a *ServerController) getLogs(c *gin.Context) {
 	jsonObj(c, logs, nil)
 }
 
+func (a *ServerController) getCrashReports(c *gin.Context) {
+	reports, err := a.serverService.GetCrashReports()
+	jsonObj(c, reports, err)
+}
+
+func (a *ServerController) getCrashReport(c *gin.Context) {
+	report, err := a.serverService.GetCrashReport(c.Param("name"))
+	jsonObj(c, report, err)
+}
+
 func (a *ServerController) getConfigJson(c *gin.Context) {
 	configJson, err := a.serverService.GetConfigJson()
 	if err != nil {
@@ -142,14 +166,21 @@ func (a *ServerController) getConfigJson(c *gin.Context) {
 }
 
 func (a *ServerController) getDb(c *gin.Context) {
-	db, err := a.serverService.GetDb()
+	var db []byte
+	var filename string
+	var err error
+	// A portable dump can be requested explicitly, otherwise the backend decides
+	if c.Query("format") == "json" {
+		db, err = a.serverService.GetDbDump()
+		filename = "x-ui.json"
+	} else {
+		db, filename, err = a.serverService.GetDbBackup()
+	}
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.index.getDatabaseError"), err)
 		return
 	}
 
-	filename := "x-ui.db"
-
 	if !isValidFilename(filename) {
 		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid filename"))
 		return
@@ -1,18 +1,23 @@
 package controller
 
 import (
+	"strconv"
+
 	"x-ui/web/service"
+	"x-ui/web/session"
+	"x-ui/xray"
 
 	"github.com/gin-gonic/gin"
 )
 
 type XraySettingController struct {
-	XraySettingService service.XraySettingService
-	SettingService     service.SettingService
-	InboundService     service.InboundService
-	OutboundService    service.OutboundService
-	XrayService        service.XrayService
-	WarpService        service.WarpService
+	XraySettingService  service.XraySettingService
+	SettingService      service.SettingService
+	InboundService      service.InboundService
+	OutboundService     service.OutboundService
+	XrayService         service.XrayService
+	WarpService         service.WarpService
+	XrayRevisionService service.XrayRevisionService
 }
 
 func NewXraySettingController(g *gin.RouterGroup) *XraySettingController {
@@ -31,6 +36,14 @@ func (a *XraySettingController) initRouter(g *gin.RouterGroup) {
 	g.POST("/warp/:action", a.warp)
 	g.GET("/getOutboundsTraffic", a.getOutboundsTraffic)
 	g.POST("/resetOutboundsTraffic", a.resetOutboundsTraffic)
+	g.GET("/getOutboundsHealth", a.getOutboundsHealth)
+	g.POST("/routing/test", a.testRoute)
+	g.POST("/routing/addRules", a.addRoutingRules)
+	g.POST("/routing/removeRule", a.removeRoutingRule)
+	g.POST("/revisions", a.getRevisions)
+	g.POST("/revisions/:id", a.getRevision)
+	g.POST("/revisions/:id/diff", a.diffRevisions)
+	g.POST("/revisions/:id/restore", a.restoreRevision)
 }
 
 func (a *XraySettingController) getXraySetting(c *gin.Context) {
@@ -50,7 +63,7 @@ func (a *XraySettingController) getXraySetting(c *gin.Context) {
 
 func (a *XraySettingController) updateSetting(c *gin.Context) {
 	xraySetting := c.PostForm("xraySetting")
-	err := a.XraySettingService.SaveXraySetting(xraySetting)
+	err := a.XraySettingService.SaveXraySetting(xraySetting, session.GetLoginUser(c).Username)
 	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 }
 
@@ -108,3 +121,96 @@ func (a *XraySettingController) resetOutboundsTraffic(c *gin.Context) {
 	}
 	jsonObj(c, "", nil)
 }
+
+func (a *XraySettingController) getOutboundsHealth(c *gin.Context) {
+	health, err := a.XrayService.GetOutboundsHealth()
+	jsonObj(c, health, err)
+}
+
+func (a *XraySettingController) testRoute(c *gin.Context) {
+	test := &xray.RouteTest{}
+	err := c.ShouldBind(test)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.testRoute"), err)
+		return
+	}
+	result, err := a.XrayService.TestRoute(test)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.testRoute"), err)
+		return
+	}
+	jsonObj(c, result, nil)
+}
+
+func (a *XraySettingController) addRoutingRules(c *gin.Context) {
+	routing := c.PostForm("routing")
+	shouldAppend := c.PostForm("append") != "false"
+	err := a.XrayService.AddRoutingRules(routing, shouldAppend)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifyRoutingRules"), err)
+}
+
+func (a *XraySettingController) removeRoutingRule(c *gin.Context) {
+	ruleTag := c.PostForm("ruleTag")
+	err := a.XrayService.RemoveRoutingRule(ruleTag)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifyRoutingRules"), err)
+}
+
+func (a *XraySettingController) getRevisions(c *gin.Context) {
+	revisions, err := a.XrayRevisionService.GetRevisions(c.PostForm("kind"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.getSettings"), err)
+		return
+	}
+	jsonObj(c, revisions, nil)
+}
+
+func (a *XraySettingController) getRevision(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.getSettings"), err)
+		return
+	}
+	revision, err := a.XrayRevisionService.GetRevision(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.getSettings"), err)
+		return
+	}
+	jsonObj(c, revision, nil)
+}
+
+// diffRevisions compares the revision with id to the one given as against, by default
+// the latest one of the same kind, which shows what restoring it would change.
+func (a *XraySettingController) diffRevisions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.getSettings"), err)
+		return
+	}
+	against := 0
+	if value := c.PostForm("against"); value != "" {
+		against, err = strconv.Atoi(value)
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "pages.settings.toasts.getSettings"), err)
+			return
+		}
+	}
+	changes, err := a.XrayRevisionService.DiffRevisions(id, against)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.getSettings"), err)
+		return
+	}
+	jsonObj(c, changes, nil)
+}
+
+func (a *XraySettingController) restoreRevision(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	err = a.XraySettingService.RestoreXrayRevision(id, session.GetLoginUser(c).Username)
+	if err == nil {
+		a.XrayService.SetToNeedRestart()
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+}
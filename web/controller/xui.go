@@ -10,6 +10,9 @@ type XUIController struct {
 	inboundController     *InboundController
 	settingController     *SettingController
 	xraySettingController *XraySettingController
+	planController        *PlanController
+	identityController    *IdentityController
+	scheduleController    *ScheduleController
 }
 
 func NewXUIController(g *gin.RouterGroup) *XUIController {
@@ -30,6 +33,9 @@ func (a *XUIController) initRouter(g *gin.RouterGroup) {
 	a.inboundController = NewInboundController(g)
 	a.settingController = NewSettingController(g)
 	a.xraySettingController = NewXraySettingController(g)
+	a.planController = NewPlanController(g)
+	a.identityController = NewIdentityController(g)
+	a.scheduleController = NewScheduleController(g)
 }
 
 func (a *XUIController) index(c *gin.Context) {
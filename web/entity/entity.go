@@ -24,6 +24,8 @@ type AllSetting struct {
 	WebBasePath                 string `json:"webBasePath" form:"webBasePath"`
 	SessionMaxAge               int    `json:"sessionMaxAge" form:"sessionMaxAge"`
 	PageSize                    int    `json:"pageSize" form:"pageSize"`
+	RecycleBinDays              int    `json:"recycleBinDays" form:"recycleBinDays"`
+	XrayReloadGrace             int    `json:"xrayReloadGrace" form:"xrayReloadGrace"`
 	ExpireDiff                  int    `json:"expireDiff" form:"expireDiff"`
 	TrafficDiff                 int    `json:"trafficDiff" form:"trafficDiff"`
 	RemarkModel                 string `json:"remarkModel" form:"remarkModel"`
@@ -69,6 +71,8 @@ type AllSetting struct {
 	DbPassword                  string `json:"dbPassword" form:"dbPassword"`
 	DbSSLMode                   string `json:"dbSSLMode" form:"dbSSLMode"`
 	DbTimeZone                  string `json:"dbTimeZone" form:"dbTimeZone"`
+	DbCharset                   string `json:"dbCharset" form:"dbCharset"`
+	DbTLS                       string `json:"dbTLS" form:"dbTLS"`
 }
 
 func (s *AllSetting) CheckValid() error {
@@ -112,6 +116,14 @@ func (s *AllSetting) CheckValid() error {
 		}
 	}
 
+	if s.RecycleBinDays < 0 {
+		return common.NewError("recycle bin retention cannot be negative:", s.RecycleBinDays)
+	}
+
+	if s.XrayReloadGrace < 0 {
+		return common.NewError("xray reload grace period cannot be negative:", s.XrayReloadGrace)
+	}
+
 	if !strings.HasPrefix(s.WebBasePath, "/") {
 		s.WebBasePath = "/" + s.WebBasePath
 	}
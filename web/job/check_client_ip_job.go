@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
 	"sort"
 	"time"
 
@@ -19,8 +18,9 @@ import (
 )
 
 type CheckClientIpJob struct {
-	lastClear     int64
-	disAllowedIps []string
+	lastClear       int64
+	accessLogOffset int64 // how much of the access log is in the access history
+	disAllowedIps   []string
 }
 
 var job *CheckClientIpJob
@@ -40,6 +40,10 @@ func (j *CheckClientIpJob) Run() {
 	f2bInstalled := j.checkFail2BanInstalled()
 	isAccessLogAvailable := j.checkAccessLogAvailable(iplimitActive)
 
+	if isAccessLogAvailable {
+		j.recordAccessHistory()
+	}
+
 	if iplimitActive {
 		if f2bInstalled && isAccessLogAvailable {
 			shouldClearAccessLog = j.processLogFile()
@@ -56,60 +60,76 @@ func (j *CheckClientIpJob) Run() {
 }
 
 func (j *CheckClientIpJob) clearAccessLog() {
-	logAccessP, err := os.OpenFile(xray.GetAccessPersistentLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
-	j.checkError(err)
-
 	accessLogPath, err := xray.GetAccessLogPath()
 	j.checkError(err)
 
-	file, err := os.Open(accessLogPath)
-	j.checkError(err)
-
-	_, err = io.Copy(logAccessP, file)
-	j.checkError(err)
-
-	logAccessP.Close()
-	file.Close()
+	// Keep what was logged since the last run
+	j.recordAccessHistory()
 
 	err = os.Truncate(accessLogPath, 0)
 	j.checkError(err)
+	j.accessLogOffset = 0
 	j.lastClear = time.Now().Unix()
 }
 
-func (j *CheckClientIpJob) hasLimitIp() bool {
-	db := database.GetDB()
-	var inbounds []*model.Inbound
+// recordAccessHistory adds the lines logged since the last call to the access history.
+func (j *CheckClientIpJob) recordAccessHistory() {
+	accessLogPath, err := xray.GetAccessLogPath()
+	if err != nil {
+		return
+	}
+	file, err := os.Open(accessLogPath)
+	if err != nil {
+		j.checkError(err)
+		return
+	}
+	defer file.Close()
 
-	err := db.Model(model.Inbound{}).Find(&inbounds).Error
+	info, err := file.Stat()
 	if err != nil {
-		return false
+		j.checkError(err)
+		return
+	}
+	if info.Size() < j.accessLogOffset {
+		// Truncated by someone else
+		j.accessLogOffset = 0
+	}
+	if _, err := file.Seek(j.accessLogOffset, io.SeekStart); err != nil {
+		j.checkError(err)
+		return
 	}
 
-	for _, inbound := range inbounds {
-		if inbound.Settings == "" {
+	records := make([]*xray.AccessRecord, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A line without its newline is still being written, it is read next time
+			break
+		}
+		j.accessLogOffset += int64(len(line))
+		record, ok := xray.ParseAccessLine(line)
+		if !ok || record.Inbound == "api" {
 			continue
 		}
+		records = append(records, record)
+	}
+	j.checkError(xray.AddAccessRecords(records))
+}
 
-		settings := map[string][]model.Client{}
-		json.Unmarshal([]byte(inbound.Settings), &settings)
-		clients := settings["clients"]
+func (j *CheckClientIpJob) hasLimitIp() bool {
+	db := database.GetDB()
+	var count int64
 
-		for _, client := range clients {
-			limitIp := client.LimitIP
-			if limitIp > 0 {
-				return true
-			}
-		}
+	err := db.Model(model.Client{}).Where("limit_ip > 0").Count(&count).Error
+	if err != nil {
+		return false
 	}
 
-	return false
+	return count > 0
 }
 
 func (j *CheckClientIpJob) processLogFile() bool {
-
-	ipRegex := regexp.MustCompile(`from (?:tcp:|udp:)?\[?([0-9a-fA-F\.:]+)\]?:\d+ accepted`)
-	emailRegex := regexp.MustCompile(`email: (.+)$`)
-
 	accessLogPath, _ := xray.GetAccessLogPath()
 	file, _ := os.Open(accessLogPath)
 	defer file.Close()
@@ -118,24 +138,18 @@ func (j *CheckClientIpJob) processLogFile() bool {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-
-		ipMatches := ipRegex.FindStringSubmatch(line)
-		if len(ipMatches) < 2 {
+		record, ok := xray.ParseAccessLine(scanner.Text())
+		if !ok || record.Status != xray.AccessAccepted || record.Email == "" {
 			continue
 		}
 
-		ip := ipMatches[1]
+		ip := record.Source
 
 		if ip == "127.0.0.1" || ip == "::1" {
 			continue
 		}
 
-		emailMatches := emailRegex.FindStringSubmatch(line)
-		if len(emailMatches) < 2 {
-			continue
-		}
-		email := emailMatches[1]
+		email := record.Email
 
 		if _, exists := inboundClientIps[email]; !exists {
 			inboundClientIps[email] = make(map[string]struct{})
@@ -243,20 +257,12 @@ func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.Inboun
 	inboundClientIps.ClientEmail = clientEmail
 	inboundClientIps.Ips = string(jsonIps)
 
-	inbound, err := j.getInboundByEmail(clientEmail)
+	client, inbound, err := j.getClientByEmail(clientEmail)
 	if err != nil {
-		logger.Errorf("failed to fetch inbound settings for email %s: %s", clientEmail, err)
-		return false
-	}
-
-	if inbound.Settings == "" {
-		logger.Debug("wrong data:", inbound)
+		logger.Errorf("failed to fetch client for email %s: %s", clientEmail, err)
 		return false
 	}
 
-	settings := map[string][]model.Client{}
-	json.Unmarshal([]byte(inbound.Settings), &settings)
-	clients := settings["clients"]
 	shouldCleanLog := false
 	j.disAllowedIps = []string{}
 
@@ -269,19 +275,15 @@ func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.Inboun
 	log.SetOutput(logIpFile)
 	log.SetFlags(log.LstdFlags)
 
-	for _, client := range clients {
-		if client.Email == clientEmail {
-			limitIp := client.LimitIP
+	limitIp := client.LimitIP
 
-			if limitIp > 0 && inbound.Enable {
-				shouldCleanLog = true
+	if limitIp > 0 && inbound.Enable {
+		shouldCleanLog = true
 
-				if limitIp < len(ips) {
-					j.disAllowedIps = append(j.disAllowedIps, ips[limitIp:]...)
-					for i := limitIp; i < len(ips); i++ {
-						log.Printf("[LIMIT_IP] Email = %s || SRC = %s", clientEmail, ips[i])
-					}
-				}
+		if limitIp < len(ips) {
+			j.disAllowedIps = append(j.disAllowedIps, ips[limitIp:]...)
+			for i := limitIp; i < len(ips); i++ {
+				log.Printf("[LIMIT_IP] Email = %s || SRC = %s", clientEmail, ips[i])
 			}
 		}
 	}
@@ -302,14 +304,20 @@ func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.Inboun
 	return shouldCleanLog
 }
 
-func (j *CheckClientIpJob) getInboundByEmail(clientEmail string) (*model.Inbound, error) {
+func (j *CheckClientIpJob) getClientByEmail(clientEmail string) (*model.Client, *model.Inbound, error) {
 	db := database.GetDB()
-	inbound := &model.Inbound{}
+	client := &model.Client{}
 
-	err := db.Model(&model.Inbound{}).Where("settings LIKE ?", "%"+clientEmail+"%").First(inbound).Error
+	err := db.Model(&model.Client{}).Where("email = ?", clientEmail).First(client).Error
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	inbound := &model.Inbound{}
+	err = db.Model(&model.Inbound{}).First(inbound, client.InboundId).Error
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return inbound, nil
+	return client, inbound, nil
 }
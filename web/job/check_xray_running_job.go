@@ -16,7 +16,8 @@ func NewCheckXrayRunningJob() *CheckXrayRunningJob {
 }
 
 func (j *CheckXrayRunningJob) Run() {
-	if j.xrayService.IsXrayRunning() {
+	// A crashed process is restarted by its supervisor with a backoff
+	if j.xrayService.IsXrayRunning() || j.xrayService.IsXraySupervised() {
 		j.checkTime = 0
 	} else {
 		j.checkTime++
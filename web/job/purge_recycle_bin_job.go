@@ -0,0 +1,26 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PurgeRecycleBinJob struct {
+	inboundService service.InboundService
+}
+
+func NewPurgeRecycleBinJob() *PurgeRecycleBinJob {
+	return new(PurgeRecycleBinJob)
+}
+
+// Run permanently removes deleted inbounds and clients whose retention period is over
+func (j *PurgeRecycleBinJob) Run() {
+	count, err := j.inboundService.PurgeExpiredDeletedItems()
+	if err != nil {
+		logger.Warning("purge recycle bin failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("Purged %d expired items from the recycle bin", count)
+	}
+}
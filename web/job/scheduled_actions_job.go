@@ -0,0 +1,46 @@
+package job
+
+import (
+	"time"
+
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type ScheduledActionsJob struct {
+	scheduleService service.ScheduleService
+	xrayService     service.XrayService
+	tgbotService    service.Tgbot
+}
+
+func NewScheduledActionsJob() *ScheduledActionsJob {
+	return new(ScheduledActionsJob)
+}
+
+// Run executes the scheduled client actions that are due and reports them to the Telegram bot admins
+func (j *ScheduledActionsJob) Run() {
+	actions, changed, err := j.scheduleService.RunDueActions(time.Now())
+	if err != nil {
+		logger.Warning("run scheduled actions failed:", err)
+	}
+	if changed {
+		j.xrayService.ReconcileXray()
+	}
+	if len(actions) == 0 || !j.tgbotService.IsRunning() {
+		return
+	}
+	msg := ""
+	for _, action := range actions {
+		if action.Result == "" {
+			msg += j.tgbotService.I18nBot("tgbot.messages.scheduledActionDone",
+				"Action=="+action.Action,
+				"Email=="+action.Email)
+		} else {
+			msg += j.tgbotService.I18nBot("tgbot.messages.scheduledActionFailed",
+				"Action=="+action.Action,
+				"Email=="+action.Email,
+				"Error=="+action.Result)
+		}
+	}
+	j.tgbotService.SendMsgToTgbotAdmins(msg)
+}
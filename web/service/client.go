@@ -0,0 +1,332 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"gorm.io/gorm"
+)
+
+// Clients live in the clients table. The settings column of an inbound is stored
+// without its "clients" array, which is merged back in when an inbound is loaded,
+// so callers keep seeing the same settings JSON as the panel and the API send.
+
+// hasClients reports whether settings of protocol carry a "clients" array.
+func hasClients(protocol model.Protocol) bool {
+	switch protocol {
+	case model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks:
+		return true
+	}
+	return false
+}
+
+// clientKeyColumn returns the column identifying a client of protocol in the API.
+func clientKeyColumn(protocol model.Protocol) string {
+	switch protocol {
+	case model.Trojan:
+		return "password"
+	case model.Shadowsocks:
+		return "email"
+	default:
+		return "uuid"
+	}
+}
+
+// clientKey returns the value identifying client of protocol in the API.
+func clientKey(protocol model.Protocol, client *model.Client) string {
+	switch protocol {
+	case model.Trojan:
+		return client.Password
+	case model.Shadowsocks:
+		return client.Email
+	default:
+		return client.ID
+	}
+}
+
+// getClientsByInbound returns the clients of the given inbounds keyed by inbound id, in insertion order.
+func (s *InboundService) getClientsByInbound(tx *gorm.DB, inboundIds []int) (map[int][]model.Client, error) {
+	clientsByInbound := make(map[int][]model.Client, len(inboundIds))
+	if len(inboundIds) == 0 {
+		return clientsByInbound, nil
+	}
+	var clients []model.Client
+	err := tx.Model(model.Client{}).Where("inbound_id IN ?", inboundIds).Order("id").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, client := range clients {
+		clientsByInbound[client.InboundId] = append(clientsByInbound[client.InboundId], client)
+	}
+	return clientsByInbound, nil
+}
+
+// LoadClients merges the clients of every inbound into its settings.
+func (s *InboundService) LoadClients(tx *gorm.DB, inbounds ...*model.Inbound) error {
+	inboundIds := make([]int, 0, len(inbounds))
+	for _, inbound := range inbounds {
+		inboundIds = append(inboundIds, inbound.Id)
+	}
+	clientsByInbound, err := s.getClientsByInbound(tx, inboundIds)
+	if err != nil {
+		return err
+	}
+	for _, inbound := range inbounds {
+		clients, ok := clientsByInbound[inbound.Id]
+		if !ok && !hasClients(inbound.Protocol) {
+			continue
+		}
+		settings := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+			continue
+		}
+		if clients == nil {
+			clients = []model.Client{}
+		}
+		settings["clients"], err = json.Marshal(clients)
+		if err != nil {
+			return err
+		}
+		newSettings, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return err
+		}
+		inbound.Settings = string(newSettings)
+	}
+	return nil
+}
+
+// splitSettings removes the "clients" array from settings. ok is false when
+// settings have no such array, in which case they are returned unchanged.
+func splitSettings(settings string) (string, []model.Client, bool, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(settings), &fields); err != nil {
+		return settings, nil, false, nil
+	}
+	rawClients, ok := fields["clients"]
+	if !ok {
+		return settings, nil, false, nil
+	}
+	var clients []model.Client
+	// Fields with an unexpected type, like an empty string tgId, are left zero
+	json.Unmarshal(rawClients, &clients)
+
+	delete(fields, "clients")
+	newSettings, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return "", nil, false, err
+	}
+	return string(newSettings), clients, true, nil
+}
+
+// saveInbound stores inbound, moving the clients found in its settings to the clients table.
+// The settings of inbound itself are left as they are. An inbound of a protocol without
+// clients is left without any.
+func (s *InboundService) saveInbound(tx *gorm.DB, inbound *model.Inbound) error {
+	settings, clients, ok, err := splitSettings(inbound.Settings)
+	if err != nil {
+		return err
+	}
+	stored := *inbound
+	stored.Settings = settings
+	if err := tx.Save(&stored).Error; err != nil {
+		return err
+	}
+	inbound.Id = stored.Id
+	if !ok {
+		if hasClients(inbound.Protocol) {
+			return nil
+		}
+		// The clients of an inbound changed to such a protocol would come back with LoadClients
+		clients = nil
+	}
+	return s.syncClients(tx, inbound.Id, clients)
+}
+
+// syncClients makes the stored clients of an inbound match clients.
+// Rows of clients whose email did not change are updated in place, so they keep their position.
+func (s *InboundService) syncClients(tx *gorm.DB, inboundId int, clients []model.Client) error {
+	var oldClients []model.Client
+	err := tx.Model(model.Client{}).Where("inbound_id = ?", inboundId).Find(&oldClients).Error
+	if err != nil {
+		return err
+	}
+	oldIds := make(map[string]int, len(oldClients))
+	for _, oldClient := range oldClients {
+		oldIds[oldClient.Email] = oldClient.RowId
+	}
+
+	emails := make([]string, 0, len(clients))
+	for i := range clients {
+		client := &clients[i]
+		if client.Email == "" {
+			return common.NewError("empty client email")
+		}
+		if s.contains(emails, client.Email) {
+			return common.NewError("Duplicate email:", client.Email)
+		}
+		emails = append(emails, client.Email)
+
+		client.RowId = oldIds[client.Email]
+		client.InboundId = inboundId
+		if err := tx.Save(client).Error; err != nil {
+			return err
+		}
+	}
+
+	removed := tx.Where("inbound_id = ?", inboundId)
+	if len(emails) > 0 {
+		removed = removed.Where("email NOT IN ?", emails)
+	}
+	return removed.Delete(model.Client{}).Error
+}
+
+// getInboundClient returns the client of an inbound with the given email.
+func (s *InboundService) getInboundClient(tx *gorm.DB, inboundId int, email string) (*model.Client, error) {
+	client := &model.Client{}
+	err := tx.Model(model.Client{}).Where("inbound_id = ? AND email = ?", inboundId, email).First(client).Error
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// xrayUser returns client in the form expected by XrayAPI.AddUser.
+func (s *InboundService) xrayUser(inbound *model.Inbound, client *model.Client) map[string]any {
+	cipher := ""
+	if inbound.Protocol == model.Shadowsocks {
+		var settings map[string]any
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		cipher, _ = settings["method"].(string)
+	}
+	return map[string]any{
+		"email":    client.Email,
+		"id":       client.ID,
+		"security": client.Security,
+		"flow":     client.Flow,
+		"password": client.Password,
+		"cipher":   cipher,
+	}
+}
+
+// getClientByKey returns the client of inbound identified by key, see clientKey.
+func (s *InboundService) getClientByKey(tx *gorm.DB, inbound *model.Inbound, key string) (*model.Client, error) {
+	client := &model.Client{}
+	err := tx.Model(model.Client{}).
+		Where("inbound_id = ?", inbound.Id).
+		Where(clientKeyColumn(inbound.Protocol)+" = ?", key).
+		First(client).Error
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// updateClient replaces oldClient of inbound with newClient, along with its traffic
+// and IP records, and applies the change to the running Xray.
+func (s *InboundService) updateClient(inbound *model.Inbound, oldClient *model.Client, newClient *model.Client) (bool, error) {
+	var err error
+	if newClient.Email == "" {
+		return false, common.NewError("empty client email")
+	}
+	if newClient.Email != oldClient.Email {
+		existEmail, err := s.checkEmailsExistForClients([]model.Client{*newClient})
+		if err != nil {
+			return false, err
+		}
+		if existEmail != "" {
+			return false, common.NewError("Duplicate email:", existEmail)
+		}
+	}
+
+	db := database.GetDB()
+	tx := db.Begin()
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+
+	newClient.RowId = oldClient.RowId
+	newClient.InboundId = oldClient.InboundId
+	err = tx.Save(newClient).Error
+	if err != nil {
+		return false, err
+	}
+	err = s.UpdateClientStat(tx, oldClient.Email, newClient)
+	if err != nil {
+		return false, err
+	}
+	err = s.UpdateClientIPs(tx, oldClient.Email, newClient.Email)
+	if err != nil {
+		return false, err
+	}
+	err = s.updateGroupMember(tx, oldClient, newClient)
+	if err != nil {
+		return false, err
+	}
+	err = s.updateIdentityClient(tx, newClient)
+	if err != nil {
+		return false, err
+	}
+	err = s.renameScheduledActions(tx, oldClient.Email, newClient.Email)
+	if err != nil {
+		return false, err
+	}
+
+	needRestart := false
+	if oldClient.Enable {
+		err1 := xrayAPI().RemoveUser(inbound.Tag, oldClient.Email)
+		if err1 == nil {
+			logger.Debug("Old client deleted by api:", oldClient.Email)
+		} else {
+			if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", oldClient.Email)) {
+				logger.Debug("User is already deleted. Nothing to do more...")
+			} else {
+				logger.Debug("Error in deleting client by api:", err1)
+				needRestart = true
+			}
+		}
+	}
+	if newClient.Enable {
+		err1 := xrayAPI().AddUser(string(inbound.Protocol), inbound.Tag, s.xrayUser(inbound, newClient))
+		if err1 == nil {
+			logger.Debug("Client edited by api:", newClient.Email)
+		} else {
+			logger.Debug("Error in adding client by api:", err1)
+			needRestart = true
+		}
+	}
+
+	return needRestart, nil
+}
+
+// updateClientByEmail applies update to the client with the given email.
+func (s *InboundService) updateClientByEmail(email string, update func(client *model.Client)) (bool, error) {
+	db := database.GetDB()
+	oldClient := &model.Client{}
+	err := db.Model(model.Client{}).Where("email = ?", email).First(oldClient).Error
+	if err != nil {
+		if database.IsNotFound(err) {
+			return false, common.NewError("Client Not Found For Email:", email)
+		}
+		return false, err
+	}
+	inbound, err := s.getInbound(db, oldClient.InboundId)
+	if err != nil {
+		return false, err
+	}
+
+	newClient := *oldClient
+	update(&newClient)
+	return s.updateClient(inbound, oldClient, &newClient)
+}
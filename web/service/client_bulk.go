@@ -0,0 +1,413 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/random"
+	"x-ui/xray"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Bulk operations change many clients in one transaction. Clients that cannot be changed
+// are reported in the results and left out, unless the request is atomic, in which case
+// nothing is changed at all. The running Xray is brought in line once afterwards instead
+// of once per client.
+
+const (
+	BulkAddClients     = "add"
+	BulkUpdateClients  = "update"
+	BulkExtendClients  = "extend"
+	BulkAddTraffic     = "addTraffic"
+	BulkEnableClients  = "enable"
+	BulkDisableClients = "disable"
+	BulkDelClients     = "del"
+)
+
+var errBulkRolledBack = errors.New("rolled back as another client failed")
+
+// ClientFilter selects clients by their fields, empty fields match every client.
+type ClientFilter struct {
+	InboundId      int    `json:"inboundId"`
+	Search         string `json:"search"` // part of the email or the comment
+	Enable         *bool  `json:"enable"`
+	Depleted       *bool  `json:"depleted"`       // out of traffic or expired
+	ExpiringBefore int64  `json:"expiringBefore"` // in ms
+}
+
+// ClientUpdate holds the fields set by a bulk update, nil fields are left as they are.
+type ClientUpdate struct {
+	LimitIP    *int    `json:"limitIp"`
+	TotalGB    *int64  `json:"totalGB"` // in bytes, as in the client
+	ExpiryTime *int64  `json:"expiryTime"`
+	Enable     *bool   `json:"enable"`
+	TgID       *int64  `json:"tgId"`
+	Flow       *string `json:"flow"`
+	Comment    *string `json:"comment"`
+	Reset      *int    `json:"reset"`
+}
+
+// ClientBulkRequest describes a bulk operation. Adding creates Clients in the inbound
+// with InboundId, the other operations change the clients selected by Emails or Filter.
+type ClientBulkRequest struct {
+	Emails    []string       `json:"emails"`
+	Filter    *ClientFilter  `json:"filter"`
+	Atomic    bool           `json:"atomic"`
+	InboundId int            `json:"inboundId"`
+	Clients   []model.Client `json:"clients"`
+	Update    *ClientUpdate  `json:"update"`
+	Days      int            `json:"days"`
+	TrafficGB int64          `json:"trafficGB"`
+}
+
+// ClientBulkResult tells whether a bulk operation succeeded for a client.
+type ClientBulkResult struct {
+	Email   string `json:"email"`
+	Success bool   `json:"success"`
+	Msg     string `json:"msg,omitempty"`
+}
+
+// BulkClients runs action on the clients of req and reports whether any client changed.
+func (s *InboundService) BulkClients(action string, req *ClientBulkRequest) ([]ClientBulkResult, bool, error) {
+	var results []ClientBulkResult
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if action == BulkAddClients {
+			results, err = s.bulkAddClients(tx, req)
+		} else {
+			results, err = s.bulkChangeClients(tx, action, req)
+		}
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if req.Atomic && !result.Success {
+				return errBulkRolledBack
+			}
+		}
+		return nil
+	})
+	if err == errBulkRolledBack {
+		for i := range results {
+			if results[i].Success {
+				results[i].Success = false
+				results[i].Msg = err.Error()
+			}
+		}
+		return results, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := 0
+	for _, result := range results {
+		if result.Success {
+			changed++
+		}
+	}
+	logger.Infof("Bulk %s: %d of %d clients changed", action, changed, len(results))
+	return results, changed > 0, nil
+}
+
+func (s *InboundService) bulkAddClients(tx *gorm.DB, req *ClientBulkRequest) ([]ClientBulkResult, error) {
+	inbound, err := s.getInbound(tx, req.InboundId)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return nil, common.NewError("Inbound Not Found:", req.InboundId)
+		}
+		return nil, err
+	}
+	if !hasClients(inbound.Protocol) {
+		return nil, common.NewError("inbound has no clients:", inbound.Protocol)
+	}
+	settings, err := decodeObject(inbound.Settings)
+	if err != nil {
+		return nil, common.NewError("invalid inbound settings:", err)
+	}
+	method, _ := settings["method"].(string)
+	var emails []string
+	if err := tx.Model(model.Client{}).Pluck("email", &emails).Error; err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(emails)+len(req.Clients))
+	for _, email := range emails {
+		existing[strings.ToLower(email)] = true
+	}
+
+	results := make([]ClientBulkResult, 0, len(req.Clients))
+	for i := range req.Clients {
+		client := &req.Clients[i]
+		result := ClientBulkResult{Email: client.Email}
+		switch {
+		case client.Email == "":
+			result.Msg = "empty client email"
+		case existing[strings.ToLower(client.Email)]:
+			result.Msg = "Duplicate email: " + client.Email
+		default:
+			fillClientKeys(inbound.Protocol, method, client)
+			client.RowId = 0
+			client.InboundId = inbound.Id
+			if err := tx.Create(client).Error; err != nil {
+				return nil, err
+			}
+			if err := s.AddClientStat(tx, inbound.Id, client); err != nil {
+				return nil, err
+			}
+			existing[strings.ToLower(client.Email)] = true
+			result.Success = true
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// fillClientKeys generates the keys left empty in a new client of an inbound using method.
+func fillClientKeys(protocol model.Protocol, method string, client *model.Client) {
+	switch protocol {
+	case model.VMESS, model.VLESS:
+		if client.ID == "" {
+			client.ID = uuid.New().String()
+		}
+	case model.Trojan:
+		if client.Password == "" {
+			client.Password = random.Seq(10)
+		}
+	case model.Shadowsocks:
+		if client.Password == "" {
+			client.Password = newShadowsocksPassword(method)
+		}
+	}
+	if client.SubID == "" {
+		client.SubID = random.Seq(16)
+	}
+}
+
+// bulkChange returns the change made to each client by action. It returns a message when
+// the change does not apply to the client.
+func bulkChange(action string, req *ClientBulkRequest) (func(client *model.Client) string, error) {
+	switch action {
+	case BulkUpdateClients:
+		update := req.Update
+		if update == nil {
+			return nil, common.NewError("nothing to update")
+		}
+		return func(client *model.Client) string {
+			update.apply(client)
+			return ""
+		}, nil
+	case BulkExtendClients:
+		if req.Days <= 0 {
+			return nil, common.NewError("days must be > 0")
+		}
+		extension := int64(req.Days) * int64(24*time.Hour/time.Millisecond)
+		now := time.Now().UnixMilli()
+		return func(client *model.Client) string {
+			switch {
+			case client.ExpiryTime == 0:
+				return "client does not expire"
+			case client.ExpiryTime < 0:
+				// The period starts on first use and is stored negated
+				client.ExpiryTime -= extension
+			default:
+				client.ExpiryTime = max(client.ExpiryTime, now) + extension
+			}
+			return ""
+		}, nil
+	case BulkAddTraffic:
+		if req.TrafficGB <= 0 {
+			return nil, common.NewError("trafficGB must be > 0")
+		}
+		return func(client *model.Client) string {
+			if client.TotalGB == 0 {
+				return "client has unlimited traffic"
+			}
+			client.TotalGB += req.TrafficGB * 1024 * 1024 * 1024
+			return ""
+		}, nil
+	case BulkEnableClients, BulkDisableClients:
+		return func(client *model.Client) string {
+			client.Enable = action == BulkEnableClients
+			return ""
+		}, nil
+	case BulkDelClients:
+		return nil, nil
+	default:
+		return nil, common.NewError("unknown bulk action:", action)
+	}
+}
+
+func (u *ClientUpdate) apply(client *model.Client) {
+	if u.LimitIP != nil {
+		client.LimitIP = *u.LimitIP
+	}
+	if u.TotalGB != nil {
+		client.TotalGB = *u.TotalGB
+	}
+	if u.ExpiryTime != nil {
+		client.ExpiryTime = *u.ExpiryTime
+	}
+	if u.Enable != nil {
+		client.Enable = *u.Enable
+	}
+	if u.TgID != nil {
+		client.TgID = *u.TgID
+	}
+	if u.Flow != nil {
+		client.Flow = *u.Flow
+	}
+	if u.Comment != nil {
+		client.Comment = *u.Comment
+	}
+	if u.Reset != nil {
+		client.Reset = *u.Reset
+	}
+}
+
+func (s *InboundService) bulkChangeClients(tx *gorm.DB, action string, req *ClientBulkRequest) ([]ClientBulkResult, error) {
+	change, err := bulkChange(action, req)
+	if err != nil {
+		return nil, err
+	}
+	clients, results, err := s.selectClients(tx, req)
+	if err != nil {
+		return nil, err
+	}
+	if action == BulkDelClients {
+		return s.bulkDelClients(tx, clients, results)
+	}
+
+	for i := range clients {
+		client := &clients[i]
+		before := *client
+		if msg := change(client); msg != "" {
+			results = append(results, ClientBulkResult{Email: client.Email, Msg: msg})
+			continue
+		}
+		if err := tx.Save(client).Error; err != nil {
+			return nil, err
+		}
+		// As when a single client is edited, its traffic is enabled again and limits and
+		// expiry are checked anew by the traffic job, whatever the action
+		if err := s.UpdateClientStat(tx, client.Email, client); err != nil {
+			return nil, err
+		}
+		if err := s.updateGroupMember(tx, &before, client); err != nil {
+			return nil, err
+		}
+		if err := s.updateIdentityClient(tx, client); err != nil {
+			return nil, err
+		}
+		results = append(results, ClientBulkResult{Email: client.Email, Success: true})
+	}
+	return results, nil
+}
+
+// bulkDelClients moves clients to the recycle bin. Like a single client, the last client
+// of an inbound is not deleted.
+func (s *InboundService) bulkDelClients(tx *gorm.DB, clients []model.Client, results []ClientBulkResult) ([]ClientBulkResult, error) {
+	remaining := make(map[int]int64)
+	for _, client := range clients {
+		if _, ok := remaining[client.InboundId]; ok {
+			continue
+		}
+		var count int64
+		err := tx.Model(model.Client{}).Where("inbound_id = ?", client.InboundId).Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		remaining[client.InboundId] = count
+	}
+
+	for i := range clients {
+		client := &clients[i]
+		if remaining[client.InboundId] <= 1 {
+			results = append(results, ClientBulkResult{Email: client.Email, Msg: "no client remained in Inbound"})
+			continue
+		}
+		if err := s.recycleClients(tx, *client); err != nil {
+			return nil, err
+		}
+		if err := s.DelClientIPs(tx, client.Email); err != nil {
+			return nil, err
+		}
+		if err := s.DelClientStat(tx, client.Email); err != nil {
+			return nil, err
+		}
+		if err := s.delGroupMembers(tx, client.Email); err != nil {
+			return nil, err
+		}
+		if err := s.delScheduledActions(tx, client.Email); err != nil {
+			return nil, err
+		}
+		if err := tx.Delete(client).Error; err != nil {
+			return nil, err
+		}
+		remaining[client.InboundId]--
+		results = append(results, ClientBulkResult{Email: client.Email, Success: true})
+	}
+	return results, nil
+}
+
+// selectClients returns the clients selected by req, along with failed results for the
+// emails that were not found.
+func (s *InboundService) selectClients(tx *gorm.DB, req *ClientBulkRequest) ([]model.Client, []ClientBulkResult, error) {
+	query := tx.Model(model.Client{})
+	switch {
+	case len(req.Emails) > 0:
+		query = query.Where("email IN ?", req.Emails)
+	case req.Filter != nil:
+		query = req.Filter.apply(tx, query)
+	default:
+		return nil, nil, common.NewError("no clients selected, give emails or a filter")
+	}
+	var clients []model.Client
+	if err := query.Order("id").Find(&clients).Error; err != nil {
+		return nil, nil, err
+	}
+
+	results := make([]ClientBulkResult, 0, len(clients))
+	found := make(map[string]bool, len(clients))
+	for _, client := range clients {
+		found[client.Email] = true
+	}
+	for _, email := range req.Emails {
+		if !found[email] {
+			results = append(results, ClientBulkResult{Email: email, Msg: "Client Not Found For Email: " + email})
+		}
+	}
+	return clients, results, nil
+}
+
+func (f *ClientFilter) apply(tx *gorm.DB, query *gorm.DB) *gorm.DB {
+	if f.InboundId > 0 {
+		query = query.Where("inbound_id = ?", f.InboundId)
+	}
+	if f.Search != "" {
+		pattern := "%" + f.Search + "%"
+		query = query.Where(database.ILike("email")+" OR "+database.ILike("comment"), pattern, pattern)
+	}
+	if f.Enable != nil {
+		query = query.Where("enable = ?", *f.Enable)
+	}
+	if f.Depleted != nil {
+		depleted := tx.Model(xray.ClientTraffic{}).Select("email").Where("enable = ?", false)
+		if *f.Depleted {
+			query = query.Where("email IN (?)", depleted)
+		} else {
+			query = query.Where("email NOT IN (?)", depleted)
+		}
+	}
+	if f.ExpiringBefore > 0 {
+		query = query.Where("expiry_time > 0 AND expiry_time <= ?", f.ExpiringBefore)
+	}
+	return query
+}
@@ -0,0 +1,512 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/random"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// A client identity is a user with clients on several inbounds, each with its own email and
+// credentials, linked to the identity by their traffic records. The traffic of all of them
+// counts against the quota of the identity, and once it runs out or expires every one of
+// them is disabled. Their expiry, renewal period and subscription id are the identity's
+// and are written to each of them, so a single subscription serves all of them.
+
+type IdentityService struct {
+	inboundService InboundService
+}
+
+// ClientIdentityInfo is an identity as listed by the API, with the traffic records of its clients.
+type ClientIdentityInfo struct {
+	model.ClientIdentity
+	Clients []xray.ClientTraffic `json:"clients"`
+}
+
+// IdentityClientsRequest links the clients with Emails to an identity, and creates a client
+// of the identity in each inbound of InboundIds.
+type IdentityClientsRequest struct {
+	Emails     []string `json:"emails"`
+	InboundIds []int    `json:"inboundIds"`
+}
+
+// identityDepleted reports whether identity is out of traffic or expired at now.
+func identityDepleted(identity *model.ClientIdentity, now int64) bool {
+	return (identity.Total > 0 && identity.Up+identity.Down >= identity.Total) ||
+		(identity.ExpiryTime > 0 && identity.ExpiryTime <= now)
+}
+
+// identityDepletedCond is the condition identityDepleted checks, as SQL taking now.
+const identityDepletedCond = "((total > 0 AND up + down >= total) OR (expiry_time > 0 AND expiry_time <= ?))"
+
+// depletedIdentities selects the ids of the identities out of traffic or expired at now.
+func depletedIdentities(tx *gorm.DB, now int64) *gorm.DB {
+	return tx.Model(model.ClientIdentity{}).Select("id").Where(identityDepletedCond, now)
+}
+
+// applyIdentity sets the limits client has as a client of identity. The quota is checked
+// against the traffic of the identity, the client is left without one of its own.
+func applyIdentity(identity *model.ClientIdentity, client *model.Client) {
+	client.TotalGB = 0
+	client.ExpiryTime = identity.ExpiryTime
+	client.Reset = identity.Reset
+	client.SubID = identity.SubId
+}
+
+// saveIdentityClient links client to identity and stores the limits it gets from it on the
+// client and its traffic record.
+func (s *InboundService) saveIdentityClient(tx *gorm.DB, identity *model.ClientIdentity, client *model.Client) error {
+	applyIdentity(identity, client)
+	err := tx.Model(client).Select("TotalGB", "ExpiryTime", "Reset", "SubID").Updates(client).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(xray.ClientTraffic{}).
+		Where("email = ?", client.Email).
+		Updates(map[string]any{
+			"identity_id": identity.Id,
+			"total":       client.TotalGB,
+			"expiry_time": client.ExpiryTime,
+			"reset":       client.Reset,
+		}).Error
+}
+
+// getClientIdentity returns the identity of the client with email, nil when it has none.
+func (s *InboundService) getClientIdentity(tx *gorm.DB, email string) (*model.ClientIdentity, error) {
+	var identities []model.ClientIdentity
+	err := tx.Model(model.ClientIdentity{}).
+		Where("id IN (?)", tx.Model(xray.ClientTraffic{}).Select("identity_id").Where("email = ?", email)).
+		Find(&identities).Error
+	if err != nil || len(identities) == 0 {
+		return nil, err
+	}
+	return &identities[0], nil
+}
+
+// updateIdentityClient follows a change of a client made outside its identity, which keeps
+// giving the client its limits and subscription.
+func (s *InboundService) updateIdentityClient(tx *gorm.DB, client *model.Client) error {
+	identity, err := s.getClientIdentity(tx, client.Email)
+	if err != nil || identity == nil {
+		return err
+	}
+	return s.saveIdentityClient(tx, identity, client)
+}
+
+// startIdentities starts the duration of the identities with the given ids that start with
+// the first use, along with the expiry of their clients. It returns the expiry time of
+// every identity found, keyed by id.
+func (s *InboundService) startIdentities(tx *gorm.DB, ids []int, now int64) (map[int]int64, error) {
+	expiryTimes := make(map[int]int64, len(ids))
+	var identities []model.ClientIdentity
+	if err := tx.Model(model.ClientIdentity{}).Where("id IN ?", ids).Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		if identity.ExpiryTime < 0 {
+			identity.ExpiryTime = now - identity.ExpiryTime
+			err := tx.Model(&identity).Update("expiry_time", identity.ExpiryTime).Error
+			if err != nil {
+				return nil, err
+			}
+			err = tx.Model(model.Client{}).
+				Where("email IN (?)", tx.Model(xray.ClientTraffic{}).Select("email").Where("identity_id = ?", identity.Id)).
+				Update("expiry_time", identity.ExpiryTime).Error
+			if err != nil {
+				return nil, err
+			}
+			err = tx.Model(xray.ClientTraffic{}).Where("identity_id = ?", identity.Id).
+				Update("expiry_time", identity.ExpiryTime).Error
+			if err != nil {
+				return nil, err
+			}
+		}
+		expiryTimes[identity.Id] = identity.ExpiryTime
+	}
+	return expiryTimes, nil
+}
+
+// addIdentityTraffics adds the traffic of clients to their identities.
+func (s *InboundService) addIdentityTraffics(tx *gorm.DB, traffics map[int]*xray.ClientTraffic) error {
+	for id, traffic := range traffics {
+		err := tx.Model(model.ClientIdentity{}).Where("id = ?", id).
+			Updates(map[string]any{
+				"up":   gorm.Expr("up + ?", traffic.Up),
+				"down": gorm.Expr("down + ?", traffic.Down),
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewIdentities starts a new period for the expired identities with a renewal period,
+// their clients renew by themselves as they have the same expiry and period.
+func (s *InboundService) renewIdentities(tx *gorm.DB, now int64) error {
+	var identities []model.ClientIdentity
+	err := tx.Model(model.ClientIdentity{}).Where("reset > 0 AND expiry_time > 0 AND expiry_time <= ?", now).
+		Find(&identities).Error
+	if err != nil || len(identities) == 0 {
+		return err
+	}
+	for i := range identities {
+		identity := &identities[i]
+		for identity.ExpiryTime < now {
+			identity.ExpiryTime += int64(identity.Reset) * planDay
+		}
+		identity.Up = 0
+		identity.Down = 0
+		identity.Enable = true
+	}
+	return tx.Save(identities).Error
+}
+
+// GetIdentityBySubId returns the identity with subscription subId, nil when there is none.
+// Like the subscription itself it may be read from a replica.
+func (s *InboundService) GetIdentityBySubId(subId string) (*model.ClientIdentity, error) {
+	var identities []model.ClientIdentity
+	err := database.GetReadDB().Model(model.ClientIdentity{}).Where("sub_id = ?", subId).Find(&identities).Error
+	if err != nil || len(identities) == 0 {
+		return nil, err
+	}
+	return &identities[0], nil
+}
+
+func (s *IdentityService) getIdentity(tx *gorm.DB, id int) (*model.ClientIdentity, error) {
+	identity := &model.ClientIdentity{}
+	err := tx.Model(model.ClientIdentity{}).First(identity, id).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("Identity not found:", id)
+	}
+	return identity, err
+}
+
+// getClients returns the clients of the identity with the given id.
+func (s *IdentityService) getClients(tx *gorm.DB, id int) ([]model.Client, error) {
+	var clients []model.Client
+	err := tx.Model(model.Client{}).
+		Where("email IN (?)", tx.Model(xray.ClientTraffic{}).Select("email").Where("identity_id = ?", id)).
+		Order("id").Find(&clients).Error
+	return clients, err
+}
+
+// setClientsEnable brings the traffic records of the clients of identity in line with it
+// having run out or not.
+func (s *IdentityService) setClientsEnable(tx *gorm.DB, identity *model.ClientIdentity) error {
+	return tx.Model(xray.ClientTraffic{}).Where("identity_id = ?", identity.Id).Update("enable", identity.Enable).Error
+}
+
+func (s *IdentityService) checkIdentity(tx *gorm.DB, identity *model.ClientIdentity) error {
+	identity.Name = strings.TrimSpace(identity.Name)
+	if identity.Name == "" {
+		return common.NewError("empty identity name")
+	}
+	if identity.Total < 0 || identity.Reset < 0 {
+		return common.NewError("identity limits must be >= 0")
+	}
+	var count int64
+	err := tx.Model(model.ClientIdentity{}).Where("name = ? AND id <> ?", identity.Name, identity.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("Identity already exists:", identity.Name)
+	}
+
+	identity.SubId = strings.TrimSpace(identity.SubId)
+	if identity.SubId == "" {
+		identity.SubId = random.Seq(16)
+	}
+	err = tx.Model(model.ClientIdentity{}).Where("sub_id = ? AND id <> ?", identity.SubId, identity.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		// A subscription shared with other clients would serve them as well
+		clients := tx.Model(model.Client{}).Where("sub_id = ?", identity.SubId)
+		if identity.Id > 0 {
+			clients = clients.Where("email NOT IN (?)",
+				tx.Model(xray.ClientTraffic{}).Select("email").Where("identity_id = ?", identity.Id))
+		}
+		if err := clients.Count(&count).Error; err != nil {
+			return err
+		}
+	}
+	if count > 0 {
+		return common.NewError("Subscription is already in use:", identity.SubId)
+	}
+	return nil
+}
+
+// GetIdentities lists the identities with their clients.
+func (s *IdentityService) GetIdentities() ([]ClientIdentityInfo, error) {
+	db := database.GetDB()
+	var identities []model.ClientIdentity
+	if err := db.Model(model.ClientIdentity{}).Order("id").Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	var traffics []xray.ClientTraffic
+	if err := db.Model(xray.ClientTraffic{}).Where("identity_id > 0").Order("id").Find(&traffics).Error; err != nil {
+		return nil, err
+	}
+	clients := make(map[int][]xray.ClientTraffic, len(identities))
+	for _, traffic := range traffics {
+		clients[traffic.IdentityId] = append(clients[traffic.IdentityId], traffic)
+	}
+	infos := make([]ClientIdentityInfo, 0, len(identities))
+	for _, identity := range identities {
+		info := ClientIdentityInfo{ClientIdentity: identity, Clients: clients[identity.Id]}
+		if info.Clients == nil {
+			info.Clients = []xray.ClientTraffic{}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// AddIdentity creates an identity, with a new subscription id unless it is given one.
+func (s *IdentityService) AddIdentity(identity *model.ClientIdentity) error {
+	db := database.GetDB()
+	identity.Id = 0
+	identity.Up = 0
+	identity.Down = 0
+	if err := s.checkIdentity(db, identity); err != nil {
+		return err
+	}
+	identity.Enable = !identityDepleted(identity, time.Now().UnixMilli())
+	return db.Create(identity).Error
+}
+
+// UpdateIdentity changes the limits and the subscription of an identity and passes them
+// on to its clients. The traffic counters are only changed by a reset. It reports whether
+// a client changed.
+func (s *IdentityService) UpdateIdentity(identity *model.ClientIdentity) (bool, error) {
+	changed := false
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		before, err := s.getIdentity(tx, identity.Id)
+		if err != nil {
+			return err
+		}
+		if err := s.checkIdentity(tx, identity); err != nil {
+			return err
+		}
+		identity.Up = before.Up
+		identity.Down = before.Down
+		identity.Enable = !identityDepleted(identity, time.Now().UnixMilli())
+		if err := tx.Save(identity).Error; err != nil {
+			return err
+		}
+
+		clients, err := s.getClients(tx, identity.Id)
+		if err != nil {
+			return err
+		}
+		for i := range clients {
+			if err := s.inboundService.saveIdentityClient(tx, identity, &clients[i]); err != nil {
+				return err
+			}
+		}
+		if err := s.setClientsEnable(tx, identity); err != nil {
+			return err
+		}
+		changed = len(clients) > 0
+		logger.Infof("Identity %s changed for %d clients", identity.Name, len(clients))
+		return nil
+	})
+	return changed, err
+}
+
+// DelIdentity deletes an identity. Its clients keep its quota each on their own, as well as
+// its expiry and subscription.
+func (s *IdentityService) DelIdentity(id int) error {
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		identity, err := s.getIdentity(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := s.unlinkClients(tx, identity, nil); err != nil {
+			return err
+		}
+		return tx.Delete(identity).Error
+	})
+}
+
+// unlinkClients takes the clients with emails out of identity, all of them when emails is
+// nil. They get the quota of the identity as their own.
+func (s *IdentityService) unlinkClients(tx *gorm.DB, identity *model.ClientIdentity, emails []string) error {
+	clients := tx.Model(model.Client{}).
+		Where("email IN (?)", tx.Model(xray.ClientTraffic{}).Select("email").Where("identity_id = ?", identity.Id))
+	traffics := tx.Model(xray.ClientTraffic{}).Where("identity_id = ?", identity.Id)
+	if emails != nil {
+		clients = clients.Where("email IN ?", emails)
+		traffics = traffics.Where("email IN ?", emails)
+	}
+	if err := clients.Update("total_gb", identity.Total).Error; err != nil {
+		return err
+	}
+	return traffics.Updates(map[string]any{"identity_id": 0, "total": identity.Total}).Error
+}
+
+// AddIdentityClients links clients to an identity, moving them out of the identity they
+// were in, then creates new ones for it in the inbounds it has no client in yet. An
+// identity has at most one client per inbound. It reports whether a client changed.
+func (s *IdentityService) AddIdentityClients(id int, req *IdentityClientsRequest) ([]ClientBulkResult, bool, error) {
+	results := make([]ClientBulkResult, 0, len(req.Emails)+len(req.InboundIds))
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		identity, err := s.getIdentity(tx, id)
+		if err != nil {
+			return err
+		}
+		clients, err := s.getClients(tx, identity.Id)
+		if err != nil {
+			return err
+		}
+		inboundClients := make(map[int]string, len(clients))
+		for _, client := range clients {
+			inboundClients[client.InboundId] = client.Email
+		}
+
+		link := func(email string) (string, error) {
+			client := &model.Client{}
+			err := tx.Model(model.Client{}).Where("email = ?", email).First(client).Error
+			if database.IsNotFound(err) {
+				return "Client Not Found For Email: " + email, nil
+			} else if err != nil {
+				return "", err
+			}
+			if other, ok := inboundClients[client.InboundId]; ok && other != email {
+				return fmt.Sprint("identity already has a client in inbound ", client.InboundId), nil
+			}
+			var count int64
+			if err := tx.Model(model.GroupMember{}).Where("email = ?", email).Count(&count).Error; err != nil {
+				return "", err
+			}
+			if count > 0 {
+				return "client is in a group, which gives it its limits", nil
+			}
+			if err := s.inboundService.saveIdentityClient(tx, identity, client); err != nil {
+				return "", err
+			}
+			inboundClients[client.InboundId] = email
+			return "", nil
+		}
+
+		for _, email := range req.Emails {
+			msg, err := link(email)
+			if err != nil {
+				return err
+			}
+			results = append(results, ClientBulkResult{Email: email, Success: msg == "", Msg: msg})
+		}
+
+		for _, inboundId := range req.InboundIds {
+			email := fmt.Sprintf("%s-%d", identity.Name, inboundId)
+			if _, ok := inboundClients[inboundId]; ok {
+				results = append(results, ClientBulkResult{Email: email, Msg: fmt.Sprint("identity already has a client in inbound ", inboundId)})
+				continue
+			}
+			inbound, err := s.inboundService.getInbound(tx, inboundId)
+			if database.IsNotFound(err) {
+				results = append(results, ClientBulkResult{Email: email, Msg: fmt.Sprint("Inbound Not Found: ", inboundId)})
+				continue
+			} else if err != nil {
+				return err
+			}
+			if !hasClients(inbound.Protocol) {
+				results = append(results, ClientBulkResult{Email: email, Msg: "inbound has no clients: " + string(inbound.Protocol)})
+				continue
+			}
+			added, err := s.inboundService.bulkAddClients(tx, &ClientBulkRequest{
+				InboundId: inboundId,
+				Clients:   []model.Client{{Email: email, Enable: true}},
+			})
+			if err != nil {
+				return err
+			}
+			if !added[0].Success {
+				results = append(results, added[0])
+				continue
+			}
+			msg, err := link(email)
+			if err != nil {
+				return err
+			}
+			results = append(results, ClientBulkResult{Email: email, Success: msg == "", Msg: msg})
+		}
+		return s.setClientsEnable(tx, identity)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return results, slices.ContainsFunc(results, func(result ClientBulkResult) bool { return result.Success }), nil
+}
+
+// RemoveIdentityClients takes clients out of an identity. They get its quota as their own
+// and keep its expiry and subscription.
+func (s *IdentityService) RemoveIdentityClients(id int, emails []string) ([]ClientBulkResult, error) {
+	results := make([]ClientBulkResult, 0, len(emails))
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		identity, err := s.getIdentity(tx, id)
+		if err != nil {
+			return err
+		}
+		var linked []string
+		err = tx.Model(xray.ClientTraffic{}).Where("identity_id = ? AND email IN ?", id, emails).Pluck("email", &linked).Error
+		if err != nil {
+			return err
+		}
+		for _, email := range emails {
+			if slices.Contains(linked, email) {
+				results = append(results, ClientBulkResult{Email: email, Success: true})
+			} else {
+				results = append(results, ClientBulkResult{Email: email, Msg: "Client is not in the identity: " + email})
+			}
+		}
+		if len(linked) == 0 {
+			return nil
+		}
+		return s.unlinkClients(tx, identity, linked)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ResetIdentityTraffic clears the traffic of an identity and of its clients. It reports
+// whether a client changed.
+func (s *IdentityService) ResetIdentityTraffic(id int) (bool, error) {
+	changed := false
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		identity, err := s.getIdentity(tx, id)
+		if err != nil {
+			return err
+		}
+		identity.Up = 0
+		identity.Down = 0
+		identity.Enable = !identityDepleted(identity, time.Now().UnixMilli())
+		if err := tx.Save(identity).Error; err != nil {
+			return err
+		}
+		result := tx.Model(xray.ClientTraffic{}).Where("identity_id = ?", id).
+			Updates(map[string]any{"up": 0, "down": 0, "enable": identity.Enable})
+		changed = result.RowsAffected > 0
+		return result.Error
+	})
+	return changed, err
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
@@ -17,17 +16,20 @@ import (
 	"gorm.io/gorm"
 )
 
-type InboundService struct {
-	xrayApi xray.XrayAPI
-}
+type InboundService struct{}
 
+// GetInbounds lists the inbounds of a user. The list may come from a read replica.
 func (s *InboundService) GetInbounds(userId int) ([]*model.Inbound, error) {
-	db := database.GetDB()
+	db := database.GetReadDB()
 	var inbounds []*model.Inbound
 	err := db.Model(model.Inbound{}).Preload("ClientStats").Where("user_id = ?", userId).Find(&inbounds).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
 		return nil, err
 	}
+	err = s.LoadClients(db, inbounds...)
+	if err != nil {
+		return nil, err
+	}
 	return inbounds, nil
 }
 
@@ -38,6 +40,10 @@ func (s *InboundService) GetAllInbounds() ([]*model.Inbound, error) {
 	if err != nil && err != gorm.ErrRecordNotFound {
 		return nil, err
 	}
+	err = s.LoadClients(db, inbounds...)
+	if err != nil {
+		return nil, err
+	}
 	return inbounds, nil
 }
 
@@ -48,17 +54,7 @@ func (s *InboundService) checkPortExist(listen string, port int, ignoreId int) (
 	} else {
 		db = db.Model(model.Inbound{}).
 			Where("port = ?", port).
-			Where(
-				db.Model(model.Inbound{}).Where(
-					"listen = ?", listen,
-				).Or(
-					"listen = \"\"",
-				).Or(
-					"listen = \"0.0.0.0\"",
-				).Or(
-					"listen = \"::\"",
-				).Or(
-					"listen = \"::0\""))
+			Where("listen IN ?", []string{listen, "", "0.0.0.0", "::", "::0"})
 	}
 	if ignoreId > 0 {
 		db = db.Where("id != ?", ignoreId)
@@ -88,11 +84,7 @@ func (s *InboundService) GetClients(inbound *model.Inbound) ([]model.Client, err
 func (s *InboundService) getAllEmails() ([]string, error) {
 	db := database.GetDB()
 	var emails []string
-	err := db.Raw(`
-		SELECT JSON_EXTRACT(client.value, '$.email')
-		FROM inbounds,
-			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
-		`).Scan(&emails).Error
+	err := db.Model(model.Client{}).Pluck("email", &emails).Error
 	if err != nil {
 		return nil, err
 	}
@@ -202,7 +194,7 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 		}
 	}()
 
-	err = tx.Save(inbound).Error
+	err = s.saveInbound(tx, inbound)
 	if err == nil {
 		if len(inbound.ClientStats) == 0 {
 			for _, client := range clients {
@@ -215,20 +207,18 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 
 	needRestart := false
 	if inbound.Enable {
-		s.xrayApi.Init(p.GetAPIPort())
 		inboundJson, err1 := json.MarshalIndent(inbound.GenXrayInboundConfig(), "", "  ")
 		if err1 != nil {
 			logger.Debug("Unable to marshal inbound config:", err1)
 		}
 
-		err1 = s.xrayApi.AddInbound(inboundJson)
+		err1 = xrayAPI().AddInbound(inboundJson)
 		if err1 == nil {
 			logger.Debug("New inbound added by api:", inbound.Tag)
 		} else {
 			logger.Debug("Unable to add inbound by api:", err1)
 			needRestart = true
 		}
-		s.xrayApi.Close()
 	}
 
 	return inbound, needRestart, err
@@ -241,46 +231,73 @@ func (s *InboundService) DelInbound(id int) (bool, error) {
 	needRestart := false
 	result := db.Model(model.Inbound{}).Select("tag").Where("id = ? and enable = ?", id, true).First(&tag)
 	if result.Error == nil {
-		s.xrayApi.Init(p.GetAPIPort())
-		err1 := s.xrayApi.DelInbound(tag)
+		err1 := xrayAPI().DelInbound(tag)
 		if err1 == nil {
 			logger.Debug("Inbound deleted by api:", tag)
 		} else {
 			logger.Debug("Unable to delete inbound by api:", err1)
 			needRestart = true
 		}
-		s.xrayApi.Close()
 	} else {
 		logger.Debug("No enabled inbound founded to removing by api", tag)
 	}
 
-	// Delete client traffics of inbounds
-	err := db.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error
-	if err != nil {
-		return false, err
-	}
-	inbound, err := s.GetInbound(id)
-	if err != nil {
-		return false, err
-	}
-	clients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
-	}
-	for _, client := range clients {
-		err := s.DelClientIPs(db, client.Email)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := s.recycleInbound(tx, id)
 		if err != nil {
-			return false, err
+			return err
 		}
-	}
 
-	return needRestart, db.Delete(model.Inbound{}, id).Error
+		// Delete client traffics of inbounds
+		err = tx.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error
+		if err != nil {
+			return err
+		}
+		var emails []string
+		err = tx.Model(model.Client{}).Where("inbound_id = ?", id).Pluck("email", &emails).Error
+		if err != nil {
+			return err
+		}
+		for _, email := range emails {
+			err := s.DelClientIPs(tx, email)
+			if err != nil {
+				return err
+			}
+		}
+		err = s.delGroupMembers(tx, emails...)
+		if err != nil {
+			return err
+		}
+		err = s.delScheduledActions(tx, emails...)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("inbound_id = ?", id).Delete(model.Client{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(model.Inbound{}, id).Error
+	})
+	return needRestart, err
 }
 
 func (s *InboundService) GetInbound(id int) (*model.Inbound, error) {
 	db := database.GetDB()
+	inbound, err := s.getInbound(db, id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.LoadClients(db, inbound)
+	if err != nil {
+		return nil, err
+	}
+	return inbound, nil
+}
+
+// getInbound returns an inbound without merging its clients into the settings.
+func (s *InboundService) getInbound(tx *gorm.DB, id int) (*model.Inbound, error) {
 	inbound := &model.Inbound{}
-	err := db.Model(model.Inbound{}).First(inbound, id).Error
+	err := tx.Model(model.Inbound{}).First(inbound, id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -339,8 +356,7 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	}
 
 	needRestart := false
-	s.xrayApi.Init(p.GetAPIPort())
-	if s.xrayApi.DelInbound(tag) == nil {
+	if xrayAPI().DelInbound(tag) == nil {
 		logger.Debug("Old inbound deleted by api:", tag)
 	}
 	if inbound.Enable {
@@ -349,7 +365,7 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 			logger.Debug("Unable to marshal updated inbound config:", err2)
 			needRestart = true
 		} else {
-			err2 = s.xrayApi.AddInbound(inboundJson)
+			err2 = xrayAPI().AddInbound(inboundJson)
 			if err2 == nil {
 				logger.Debug("Updated inbound added by api:", oldInbound.Tag)
 			} else {
@@ -358,9 +374,9 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 			}
 		}
 	}
-	s.xrayApi.Close()
 
-	return inbound, needRestart, tx.Save(oldInbound).Error
+	err = s.saveInbound(tx, oldInbound)
+	return inbound, needRestart, err
 }
 
 func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inbound, newInbound *model.Inbound) error {
@@ -388,6 +404,18 @@ func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inb
 			if err != nil {
 				return err
 			}
+			err = s.delGroupMembers(tx, oldClient.Email)
+			if err != nil {
+				return err
+			}
+			err = s.delScheduledActions(tx, oldClient.Email)
+			if err != nil {
+				return err
+			}
+			err = s.DelClientIPs(tx, oldClient.Email)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	for _, newClient := range newClients {
@@ -414,13 +442,6 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 		return false, err
 	}
 
-	var settings map[string]any
-	err = json.Unmarshal([]byte(data.Settings), &settings)
-	if err != nil {
-		return false, err
-	}
-
-	interfaceClients := settings["clients"].([]any)
 	existEmail, err := s.checkEmailsExistForClients(clients)
 	if err != nil {
 		return false, err
@@ -429,46 +450,21 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 		return false, common.NewError("Duplicate email:", existEmail)
 	}
 
-	oldInbound, err := s.GetInbound(data.Id)
+	oldInbound, err := s.getInbound(database.GetDB(), data.Id)
 	if err != nil {
 		return false, err
 	}
 
 	// Secure client ID
 	for _, client := range clients {
-		if oldInbound.Protocol == "trojan" {
-			if client.Password == "" {
-				return false, common.NewError("empty client ID")
-			}
-		} else if oldInbound.Protocol == "shadowsocks" {
-			if client.Email == "" {
-				return false, common.NewError("empty client ID")
-			}
-		} else {
-			if client.ID == "" {
-				return false, common.NewError("empty client ID")
-			}
+		if clientKey(oldInbound.Protocol, &client) == "" {
+			return false, common.NewError("empty client ID")
+		}
+		if client.Email == "" {
+			return false, common.NewError("empty client email")
 		}
 	}
 
-	var oldSettings map[string]any
-	err = json.Unmarshal([]byte(oldInbound.Settings), &oldSettings)
-	if err != nil {
-		return false, err
-	}
-
-	oldClients := oldSettings["clients"].([]any)
-	oldClients = append(oldClients, interfaceClients...)
-
-	oldSettings["clients"] = oldClients
-
-	newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-
-	oldInbound.Settings = string(newSettings)
-
 	db := database.GetDB()
 	tx := db.Begin()
 
@@ -480,126 +476,111 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 		}
 	}()
 
+	for i := range clients {
+		clients[i].InboundId = oldInbound.Id
+		err = tx.Create(&clients[i]).Error
+		if err != nil {
+			return false, err
+		}
+		s.AddClientStat(tx, data.Id, &clients[i])
+	}
+
 	needRestart := false
-	s.xrayApi.Init(p.GetAPIPort())
 	for _, client := range clients {
-		if len(client.Email) > 0 {
-			s.AddClientStat(tx, data.Id, &client)
-			if client.Enable {
-				cipher := ""
-				if oldInbound.Protocol == "shadowsocks" {
-					cipher = oldSettings["method"].(string)
-				}
-				err1 := s.xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, map[string]any{
-					"email":    client.Email,
-					"id":       client.ID,
-					"security": client.Security,
-					"flow":     client.Flow,
-					"password": client.Password,
-					"cipher":   cipher,
-				})
-				if err1 == nil {
-					logger.Debug("Client added by api:", client.Email)
-				} else {
-					logger.Debug("Error in adding client by api:", err1)
-					needRestart = true
-				}
+		if client.Enable {
+			err1 := xrayAPI().AddUser(string(oldInbound.Protocol), oldInbound.Tag, s.xrayUser(oldInbound, &client))
+			if err1 == nil {
+				logger.Debug("Client added by api:", client.Email)
+			} else {
+				logger.Debug("Error in adding client by api:", err1)
+				needRestart = true
 			}
-		} else {
-			needRestart = true
 		}
 	}
-	s.xrayApi.Close()
 
-	return needRestart, tx.Save(oldInbound).Error
+	return needRestart, nil
 }
 
 func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool, error) {
-	oldInbound, err := s.GetInbound(inboundId)
+	db := database.GetDB()
+	oldInbound, err := s.getInbound(db, inboundId)
 	if err != nil {
 		logger.Error("Load Old Data Error")
 		return false, err
 	}
-	var settings map[string]any
-	err = json.Unmarshal([]byte(oldInbound.Settings), &settings)
-	if err != nil {
-		return false, err
-	}
-
-	email := ""
-	client_key := "id"
-	if oldInbound.Protocol == "trojan" {
-		client_key = "password"
-	}
-	if oldInbound.Protocol == "shadowsocks" {
-		client_key = "email"
-	}
-
-	interfaceClients := settings["clients"].([]any)
-	var newClients []any
-	needApiDel := false
-	for _, client := range interfaceClients {
-		c := client.(map[string]any)
-		c_id := c[client_key].(string)
-		if c_id == clientId {
-			email, _ = c["email"].(string)
-			needApiDel, _ = c["enable"].(bool)
-		} else {
-			newClients = append(newClients, client)
-		}
-	}
-
-	if len(newClients) == 0 {
-		return false, common.NewError("no client remained in Inbound")
-	}
 
-	settings["clients"] = newClients
-	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	client, err := s.getClientByKey(db, oldInbound, clientId)
 	if err != nil {
+		if database.IsNotFound(err) {
+			return false, common.NewError("Client Not Found:", clientId)
+		}
 		return false, err
 	}
 
-	oldInbound.Settings = string(newSettings)
-
-	db := database.GetDB()
-
-	err = s.DelClientIPs(db, email)
+	var count int64
+	err = db.Model(model.Client{}).Where("inbound_id = ?", inboundId).Count(&count).Error
 	if err != nil {
-		logger.Error("Error in delete client IPs")
 		return false, err
 	}
-	needRestart := false
+	if count <= 1 {
+		return false, common.NewError("no client remained in Inbound")
+	}
 
-	if len(email) > 0 {
-		notDepleted := true
-		err = db.Model(xray.ClientTraffic{}).Select("enable").Where("email = ?", email).First(&notDepleted).Error
+	email := client.Email
+	needApiDel := client.Enable
+
+	// The client goes to the recycle bin and its records away together, or not at all
+	notDepleted := true
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := s.recycleClients(tx, *client)
+		if err != nil {
+			return err
+		}
+		err = s.DelClientIPs(tx, email)
+		if err != nil {
+			logger.Error("Error in delete client IPs")
+			return err
+		}
+		err = tx.Model(xray.ClientTraffic{}).Select("enable").Where("email = ?", email).First(&notDepleted).Error
 		if err != nil {
 			logger.Error("Get stats error")
-			return false, err
+			return err
 		}
-		err = s.DelClientStat(db, email)
+		err = s.DelClientStat(tx, email)
 		if err != nil {
 			logger.Error("Delete stats Data Error")
-			return false, err
+			return err
 		}
-		if needApiDel && notDepleted {
-			s.xrayApi.Init(p.GetAPIPort())
-			err1 := s.xrayApi.RemoveUser(oldInbound.Tag, email)
-			if err1 == nil {
-				logger.Debug("Client deleted by api:", email)
-				needRestart = false
+		err = s.delGroupMembers(tx, email)
+		if err != nil {
+			return err
+		}
+		err = s.delScheduledActions(tx, email)
+		if err != nil {
+			return err
+		}
+		return tx.Delete(client).Error
+	})
+	if err != nil {
+		return false, err
+	}
+
+	needRestart := false
+	if needApiDel && notDepleted {
+		err1 := xrayAPI().RemoveUser(oldInbound.Tag, email)
+		if err1 == nil {
+			logger.Debug("Client deleted by api:", email)
+			needRestart = false
+		} else {
+			if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", email)) {
+				logger.Debug("User is already deleted. Nothing to do more...")
 			} else {
-				if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", email)) {
-					logger.Debug("User is already deleted. Nothing to do more...")
-				} else {
-					logger.Debug("Error in deleting client by api:", err1)
-					needRestart = true
-				}
+				logger.Debug("Error in deleting client by api:", err1)
+				needRestart = true
 			}
-			s.xrayApi.Close()
 		}
 	}
-	return needRestart, db.Save(oldInbound).Error
+	return needRestart, nil
 }
 
 func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId string) (bool, error) {
@@ -607,153 +588,27 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 	if err != nil {
 		return false, err
 	}
-
-	var settings map[string]any
-	err = json.Unmarshal([]byte(data.Settings), &settings)
-	if err != nil {
-		return false, err
+	if len(clients) == 0 {
+		return false, common.NewError("empty client ID")
 	}
 
-	interfaceClients := settings["clients"].([]any)
-
-	oldInbound, err := s.GetInbound(data.Id)
+	db := database.GetDB()
+	oldInbound, err := s.getInbound(db, data.Id)
 	if err != nil {
 		return false, err
 	}
 
-	oldClients, err := s.GetClients(oldInbound)
-	if err != nil {
+	oldClient, err := s.getClientByKey(db, oldInbound, clientId)
+	if err != nil && !database.IsNotFound(err) {
 		return false, err
 	}
 
-	oldEmail := ""
-	newClientId := ""
-	clientIndex := -1
-	for index, oldClient := range oldClients {
-		oldClientId := ""
-		if oldInbound.Protocol == "trojan" {
-			oldClientId = oldClient.Password
-			newClientId = clients[0].Password
-		} else if oldInbound.Protocol == "shadowsocks" {
-			oldClientId = oldClient.Email
-			newClientId = clients[0].Email
-		} else {
-			oldClientId = oldClient.ID
-			newClientId = clients[0].ID
-		}
-		if clientId == oldClientId {
-			oldEmail = oldClient.Email
-			clientIndex = index
-			break
-		}
-	}
-
 	// Validate new client ID
-	if newClientId == "" || clientIndex == -1 {
+	if oldClient == nil || clientKey(oldInbound.Protocol, &clients[0]) == "" {
 		return false, common.NewError("empty client ID")
 	}
 
-	if len(clients[0].Email) > 0 && clients[0].Email != oldEmail {
-		existEmail, err := s.checkEmailsExistForClients(clients)
-		if err != nil {
-			return false, err
-		}
-		if existEmail != "" {
-			return false, common.NewError("Duplicate email:", existEmail)
-		}
-	}
-
-	var oldSettings map[string]any
-	err = json.Unmarshal([]byte(oldInbound.Settings), &oldSettings)
-	if err != nil {
-		return false, err
-	}
-	settingsClients := oldSettings["clients"].([]any)
-	settingsClients[clientIndex] = interfaceClients[0]
-	oldSettings["clients"] = settingsClients
-
-	newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-
-	oldInbound.Settings = string(newSettings)
-	db := database.GetDB()
-	tx := db.Begin()
-
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
-
-	if len(clients[0].Email) > 0 {
-		if len(oldEmail) > 0 {
-			err = s.UpdateClientStat(tx, oldEmail, &clients[0])
-			if err != nil {
-				return false, err
-			}
-			err = s.UpdateClientIPs(tx, oldEmail, clients[0].Email)
-			if err != nil {
-				return false, err
-			}
-		} else {
-			s.AddClientStat(tx, data.Id, &clients[0])
-		}
-	} else {
-		err = s.DelClientStat(tx, oldEmail)
-		if err != nil {
-			return false, err
-		}
-		err = s.DelClientIPs(tx, oldEmail)
-		if err != nil {
-			return false, err
-		}
-	}
-	needRestart := false
-	if len(oldEmail) > 0 {
-		s.xrayApi.Init(p.GetAPIPort())
-		if oldClients[clientIndex].Enable {
-			err1 := s.xrayApi.RemoveUser(oldInbound.Tag, oldEmail)
-			if err1 == nil {
-				logger.Debug("Old client deleted by api:", oldEmail)
-			} else {
-				if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", oldEmail)) {
-					logger.Debug("User is already deleted. Nothing to do more...")
-				} else {
-					logger.Debug("Error in deleting client by api:", err1)
-					needRestart = true
-				}
-			}
-		}
-		if clients[0].Enable {
-			cipher := ""
-			if oldInbound.Protocol == "shadowsocks" {
-				cipher = oldSettings["method"].(string)
-			}
-			err1 := s.xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, map[string]any{
-				"email":    clients[0].Email,
-				"id":       clients[0].ID,
-				"security": clients[0].Security,
-				"flow":     clients[0].Flow,
-				"password": clients[0].Password,
-				"cipher":   cipher,
-			})
-			if err1 == nil {
-				logger.Debug("Client edited by api:", clients[0].Email)
-			} else {
-				logger.Debug("Error in adding client by api:", err1)
-				needRestart = true
-			}
-		}
-		s.xrayApi.Close()
-	} else {
-		logger.Debug("Client old email not found")
-		needRestart = true
-	}
-	return needRestart, tx.Save(oldInbound).Error
+	return s.updateClient(oldInbound, oldClient, &clients[0])
 }
 
 func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) (error, bool) {
@@ -853,12 +708,22 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 		return err
 	}
 
+	identityTraffics := make(map[int]*xray.ClientTraffic)
 	for dbTraffic_index := range dbClientTraffics {
 		for traffic_index := range traffics {
 			if dbClientTraffics[dbTraffic_index].Email == traffics[traffic_index].Email {
 				dbClientTraffics[dbTraffic_index].Up += traffics[traffic_index].Up
 				dbClientTraffics[dbTraffic_index].Down += traffics[traffic_index].Down
 
+				// Clients of an identity count against its traffic as well
+				if identityId := dbClientTraffics[dbTraffic_index].IdentityId; identityId > 0 {
+					if identityTraffics[identityId] == nil {
+						identityTraffics[identityId] = &xray.ClientTraffic{}
+					}
+					identityTraffics[identityId].Up += traffics[traffic_index].Up
+					identityTraffics[identityId].Down += traffics[traffic_index].Down
+				}
+
 				// Add user in onlineUsers array on traffic
 				if traffics[traffic_index].Up+traffics[traffic_index].Down > 0 {
 					onlineClients = append(onlineClients, traffics[traffic_index].Email)
@@ -876,55 +741,48 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 		logger.Warning("AddClientTraffic update data ", err)
 	}
 
+	err = s.addIdentityTraffics(tx, identityTraffics)
+	if err != nil {
+		logger.Warning("AddClientTraffic update identity data ", err)
+	}
+
 	return nil
 }
 
 func (s *InboundService) adjustTraffics(tx *gorm.DB, dbClientTraffics []*xray.ClientTraffic) ([]*xray.ClientTraffic, error) {
-	inboundIds := make([]int, 0, len(dbClientTraffics))
+	now := time.Now().Unix() * 1000
+
+	// The duration of an identity starts with the first traffic of any of its clients
+	var identityIds []int
 	for _, dbClientTraffic := range dbClientTraffics {
-		if dbClientTraffic.ExpiryTime < 0 {
-			inboundIds = append(inboundIds, dbClientTraffic.InboundId)
+		if dbClientTraffic.ExpiryTime < 0 && dbClientTraffic.IdentityId > 0 {
+			identityIds = append(identityIds, dbClientTraffic.IdentityId)
 		}
 	}
-
-	if len(inboundIds) > 0 {
-		var inbounds []*model.Inbound
-		err := tx.Model(model.Inbound{}).Where("id IN (?)", inboundIds).Find(&inbounds).Error
+	identityExpiryTimes := map[int]int64{}
+	if len(identityIds) > 0 {
+		var err error
+		identityExpiryTimes, err = s.startIdentities(tx, identityIds, now)
 		if err != nil {
 			return nil, err
 		}
-		for inbound_index := range inbounds {
-			settings := map[string]any{}
-			json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-			clients, ok := settings["clients"].([]any)
-			if ok {
-				var newClients []any
-				for client_index := range clients {
-					c := clients[client_index].(map[string]any)
-					for traffic_index := range dbClientTraffics {
-						if dbClientTraffics[traffic_index].ExpiryTime < 0 && c["email"] == dbClientTraffics[traffic_index].Email {
-							oldExpiryTime := c["expiryTime"].(float64)
-							newExpiryTime := (time.Now().Unix() * 1000) - int64(oldExpiryTime)
-							c["expiryTime"] = newExpiryTime
-							dbClientTraffics[traffic_index].ExpiryTime = newExpiryTime
-							break
-						}
-					}
-					newClients = append(newClients, any(c))
-				}
-				settings["clients"] = newClients
-				modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-				if err != nil {
-					return nil, err
-				}
+	}
 
-				inbounds[inbound_index].Settings = string(modifiedSettings)
-			}
+	for _, dbClientTraffic := range dbClientTraffics {
+		if expiryTime, ok := identityExpiryTimes[dbClientTraffic.IdentityId]; ok {
+			dbClientTraffic.ExpiryTime = expiryTime
+			continue
 		}
-		err = tx.Save(inbounds).Error
-		if err != nil {
-			logger.Warning("AddClientTraffic update inbounds ", err)
-			logger.Error(inbounds)
+		// A negative expiry time is a duration that starts with the first traffic of the client
+		if dbClientTraffic.ExpiryTime < 0 {
+			newExpiryTime := now - dbClientTraffic.ExpiryTime
+			err := tx.Model(model.Client{}).
+				Where("inbound_id = ? AND email = ?", dbClientTraffic.InboundId, dbClientTraffic.Email).
+				Update("expiry_time", newExpiryTime).Error
+			if err != nil {
+				return nil, err
+			}
+			dbClientTraffic.ExpiryTime = newExpiryTime
 		}
 	}
 
@@ -937,6 +795,11 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 	now := time.Now().Unix() * 1000
 	var err, err1 error
 
+	err = s.renewIdentities(tx, now)
+	if err != nil {
+		return false, 0, err
+	}
+
 	err = tx.Model(xray.ClientTraffic{}).Where("reset > 0 and expiry_time > 0 and expiry_time <= ?", now).Find(&traffics).Error
 	if err != nil {
 		return false, 0, err
@@ -946,8 +809,16 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 		return false, 0, nil
 	}
 
-	var inbound_ids []int
-	var inbounds []*model.Inbound
+	emails := make([]string, 0, len(traffics))
+	for _, traffic := range traffics {
+		emails = append(emails, traffic.Email)
+	}
+	memberPlans, err := s.getMemberPlans(tx, emails)
+	if err != nil {
+		return false, 0, err
+	}
+
+	inbounds := make(map[int]*model.Inbound)
 	needRestart := false
 	var clientsToAdd []struct {
 		protocol string
@@ -956,73 +827,74 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 	}
 
 	for _, traffic := range traffics {
-		inbound_ids = append(inbound_ids, traffic.InboundId)
-	}
-	err = tx.Model(model.Inbound{}).Where("id IN ?", inbound_ids).Find(&inbounds).Error
-	if err != nil {
-		return false, 0, err
-	}
-	for inbound_index := range inbounds {
-		settings := map[string]any{}
-		json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-		clients := settings["clients"].([]any)
-		for client_index := range clients {
-			c := clients[client_index].(map[string]any)
-			for traffic_index, traffic := range traffics {
-				if traffic.Email == c["email"].(string) {
-					newExpiryTime := traffic.ExpiryTime
-					for newExpiryTime < now {
-						newExpiryTime += (int64(traffic.Reset) * 86400000)
-					}
-					c["expiryTime"] = newExpiryTime
-					traffics[traffic_index].ExpiryTime = newExpiryTime
-					traffics[traffic_index].Down = 0
-					traffics[traffic_index].Up = 0
-					if !traffic.Enable {
-						traffics[traffic_index].Enable = true
-						clientsToAdd = append(clientsToAdd,
-							struct {
-								protocol string
-								tag      string
-								client   map[string]any
-							}{
-								protocol: string(inbounds[inbound_index].Protocol),
-								tag:      inbounds[inbound_index].Tag,
-								client:   c,
-							})
-					}
-					clients[client_index] = any(c)
-					break
-				}
+		// Clients in a group renew with the period and the quota of its plan
+		updates := map[string]any{}
+		if memberPlan, ok := memberPlans[traffic.Email]; ok {
+			if !memberPlan.member.OwnReset && memberPlan.plan.Reset > 0 {
+				traffic.Reset = memberPlan.plan.Reset
+				updates["reset"] = traffic.Reset
+			}
+			if !memberPlan.member.OwnTotal {
+				traffic.Total = memberPlan.plan.TotalGB
+				updates["total_gb"] = traffic.Total
 			}
 		}
-		settings["clients"] = clients
-		newSettings, err := json.MarshalIndent(settings, "", "  ")
+		newExpiryTime := traffic.ExpiryTime
+		for newExpiryTime < now {
+			newExpiryTime += (int64(traffic.Reset) * 86400000)
+		}
+		updates["expiry_time"] = newExpiryTime
+		err = tx.Model(model.Client{}).
+			Where("inbound_id = ? AND email = ?", traffic.InboundId, traffic.Email).
+			Updates(updates).Error
 		if err != nil {
 			return false, 0, err
 		}
-		inbounds[inbound_index].Settings = string(newSettings)
-	}
-	err = tx.Save(inbounds).Error
-	if err != nil {
-		return false, 0, err
+		traffic.ExpiryTime = newExpiryTime
+		traffic.Down = 0
+		traffic.Up = 0
+		if traffic.Enable {
+			continue
+		}
+		traffic.Enable = true
+
+		inbound, ok := inbounds[traffic.InboundId]
+		if !ok {
+			inbound, err = s.getInbound(tx, traffic.InboundId)
+			if err != nil {
+				return false, 0, err
+			}
+			inbounds[traffic.InboundId] = inbound
+		}
+		client, err := s.getInboundClient(tx, traffic.InboundId, traffic.Email)
+		if err != nil {
+			if database.IsNotFound(err) {
+				continue
+			}
+			return false, 0, err
+		}
+		clientsToAdd = append(clientsToAdd,
+			struct {
+				protocol string
+				tag      string
+				client   map[string]any
+			}{
+				protocol: string(inbound.Protocol),
+				tag:      inbound.Tag,
+				client:   s.xrayUser(inbound, client),
+			})
 	}
 	err = tx.Save(traffics).Error
 	if err != nil {
 		return false, 0, err
 	}
 	if p != nil {
-		err1 = s.xrayApi.Init(p.GetAPIPort())
-		if err1 != nil {
-			return true, int64(len(traffics)), nil
-		}
 		for _, clientToAdd := range clientsToAdd {
-			err1 = s.xrayApi.AddUser(clientToAdd.protocol, clientToAdd.tag, clientToAdd.client)
+			err1 = xrayAPI().AddUser(clientToAdd.protocol, clientToAdd.tag, clientToAdd.client)
 			if err1 != nil {
 				needRestart = true
 			}
 		}
-		s.xrayApi.Close()
 	}
 	return needRestart, int64(len(traffics)), nil
 }
@@ -1040,9 +912,8 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 		if err != nil {
 			return false, 0, err
 		}
-		s.xrayApi.Init(p.GetAPIPort())
 		for _, tag := range tags {
-			err1 := s.xrayApi.DelInbound(tag)
+			err1 := xrayAPI().DelInbound(tag)
 			if err1 == nil {
 				logger.Debug("Inbound disabled by api:", tag)
 			} else {
@@ -1050,7 +921,6 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 				needRestart = true
 			}
 		}
-		s.xrayApi.Close()
 	}
 
 	result := tx.Model(model.Inbound{}).
@@ -1074,14 +944,13 @@ func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error)
 		err := tx.Table("inbounds").
 			Select("inbounds.tag, client_traffics.email").
 			Joins("JOIN client_traffics ON inbounds.id = client_traffics.inbound_id").
-			Where("((client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total) OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)) AND client_traffics.enable = ?", now, true).
+			Where("((client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total) OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?) OR client_traffics.identity_id IN (?)) AND client_traffics.enable = ?", now, depletedIdentities(tx, now), true).
 			Scan(&results).Error
 		if err != nil {
 			return false, 0, err
 		}
-		s.xrayApi.Init(p.GetAPIPort())
 		for _, result := range results {
-			err1 := s.xrayApi.RemoveUser(result.Tag, result.Email)
+			err1 := xrayAPI().RemoveUser(result.Tag, result.Email)
 			if err1 == nil {
 				logger.Debug("Client disabled by api:", result.Email)
 			} else {
@@ -1097,12 +966,19 @@ func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error)
 				}
 			}
 		}
-		s.xrayApi.Close()
+	}
+	// Clients of an identity are disabled together once the identity runs out. The
+	// condition is not a subquery on client_identities, which MySQL refuses in its UPDATE.
+	err := tx.Model(model.ClientIdentity{}).
+		Where(identityDepletedCond+" and enable = ?", now, true).
+		Update("enable", false).Error
+	if err != nil {
+		return false, 0, err
 	}
 	result := tx.Model(xray.ClientTraffic{}).
-		Where("((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", now, true).
+		Where("((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?) or identity_id IN (?)) and enable = ?", now, depletedIdentities(tx, now), true).
 		Update("enable", false)
-	err := result.Error
+	err = result.Error
 	count := result.RowsAffected
 	return needRestart, count, err
 }
@@ -1118,18 +994,6 @@ func (s *InboundService) GetInboundTags() (string, error) {
 	return string(tags), nil
 }
 
-func (s *InboundService) MigrationRemoveOrphanedTraffics() {
-	db := database.GetDB()
-	db.Exec(`
-		DELETE FROM client_traffics
-		WHERE email NOT IN (
-			SELECT JSON_EXTRACT(client.value, '$.email')
-			FROM inbounds,
-				JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
-		)
-	`)
-}
-
 func (s *InboundService) AddClientStat(tx *gorm.DB, inboundId int, client *model.Client) error {
 	clientTraffic := xray.ClientTraffic{}
 	clientTraffic.InboundId = inboundId
@@ -1202,349 +1066,87 @@ func (s *InboundService) GetClientInboundByEmail(email string) (traffic *xray.Cl
 }
 
 func (s *InboundService) GetClientByEmail(clientEmail string) (*xray.ClientTraffic, *model.Client, error) {
-	traffic, inbound, err := s.GetClientInboundByEmail(clientEmail)
+	traffic, err := s.GetClientTrafficByEmail(clientEmail)
 	if err != nil {
 		return nil, nil, err
 	}
-	if inbound == nil {
+	if traffic == nil {
 		return nil, nil, common.NewError("Inbound Not Found For Email:", clientEmail)
 	}
 
-	clients, err := s.GetClients(inbound)
+	client, err := s.getInboundClient(database.GetDB(), traffic.InboundId, clientEmail)
 	if err != nil {
-		return nil, nil, err
-	}
-
-	for _, client := range clients {
-		if client.Email == clientEmail {
-			return traffic, &client, nil
+		if database.IsNotFound(err) {
+			return nil, nil, common.NewError("Client Not Found In Inbound For Email:", clientEmail)
 		}
+		return nil, nil, err
 	}
 
-	return nil, nil, common.NewError("Client Not Found In Inbound For Email:", clientEmail)
+	return traffic, client, nil
 }
 
 func (s *InboundService) SetClientTelegramUserID(trafficId int, tgId int64) (bool, error) {
-	traffic, inbound, err := s.GetClientInboundByTrafficID(trafficId)
+	db := database.GetDB()
+	var traffics []*xray.ClientTraffic
+	err := db.Model(xray.ClientTraffic{}).Where("id = ?", trafficId).Find(&traffics).Error
 	if err != nil {
 		return false, err
 	}
-	if inbound == nil {
+	if len(traffics) == 0 {
 		return false, common.NewError("Inbound Not Found For Traffic ID:", trafficId)
 	}
 
-	clientEmail := traffic.Email
-
-	oldClients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
-	}
-
-	clientId := ""
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
-		}
-	}
-
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
-
-	var settings map[string]any
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
-	if err != nil {
-		return false, err
-	}
-	clients := settings["clients"].([]any)
-	var newClients []any
-	for client_index := range clients {
-		c := clients[client_index].(map[string]any)
-		if c["email"] == clientEmail {
-			c["tgId"] = tgId
-			newClients = append(newClients, any(c))
-		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	return s.updateClientByEmail(traffics[0].Email, func(client *model.Client) {
+		client.TgID = tgId
+	})
 }
 
 func (s *InboundService) checkIsEnabledByEmail(clientEmail string) (bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
+	db := database.GetDB()
+	var clients []model.Client
+	err := db.Model(model.Client{}).Where("email = ?", clientEmail).Find(&clients).Error
 	if err != nil {
 		return false, err
 	}
-	if inbound == nil {
+	if len(clients) == 0 {
 		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
 	}
 
-	clients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
-	}
-
-	isEnable := false
-
-	for _, client := range clients {
-		if client.Email == clientEmail {
-			isEnable = client.Enable
-			break
-		}
-	}
-
-	return isEnable, err
+	return clients[0].Enable, nil
 }
 
 func (s *InboundService) ToggleClientEnableByEmail(clientEmail string) (bool, bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
-	if err != nil {
-		return false, false, err
-	}
-	if inbound == nil {
-		return false, false, common.NewError("Inbound Not Found For Email:", clientEmail)
-	}
-
-	oldClients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, false, err
-	}
-
-	clientId := ""
-	clientOldEnabled := false
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			clientOldEnabled = oldClient.Enable
-			break
-		}
-	}
-
-	if len(clientId) == 0 {
-		return false, false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
-
-	var settings map[string]any
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
-	if err != nil {
-		return false, false, err
-	}
-	clients := settings["clients"].([]any)
-	var newClients []any
-	for client_index := range clients {
-		c := clients[client_index].(map[string]any)
-		if c["email"] == clientEmail {
-			c["enable"] = !clientOldEnabled
-			newClients = append(newClients, any(c))
-		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, false, err
-	}
-	inbound.Settings = string(modifiedSettings)
-
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
+	clientEnabled := false
+	needRestart, err := s.updateClientByEmail(clientEmail, func(client *model.Client) {
+		client.Enable = !client.Enable
+		clientEnabled = client.Enable
+	})
 	if err != nil {
 		return false, needRestart, err
 	}
 
-	return !clientOldEnabled, needRestart, nil
+	return clientEnabled, needRestart, nil
 }
 
 func (s *InboundService) ResetClientIpLimitByEmail(clientEmail string, count int) (bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
-	if err != nil {
-		return false, err
-	}
-	if inbound == nil {
-		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
-	}
-
-	oldClients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
-	}
-
-	clientId := ""
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
-		}
-	}
-
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
-
-	var settings map[string]any
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
-	if err != nil {
-		return false, err
-	}
-	clients := settings["clients"].([]any)
-	var newClients []any
-	for client_index := range clients {
-		c := clients[client_index].(map[string]any)
-		if c["email"] == clientEmail {
-			c["limitIp"] = count
-			newClients = append(newClients, any(c))
-		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	return s.updateClientByEmail(clientEmail, func(client *model.Client) {
+		client.LimitIP = count
+	})
 }
 
 func (s *InboundService) ResetClientExpiryTimeByEmail(clientEmail string, expiry_time int64) (bool, error) {
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
-	if err != nil {
-		return false, err
-	}
-	if inbound == nil {
-		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
-	}
-
-	oldClients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
-	}
-
-	clientId := ""
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
-		}
-	}
-
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
-
-	var settings map[string]any
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
-	if err != nil {
-		return false, err
-	}
-	clients := settings["clients"].([]any)
-	var newClients []any
-	for client_index := range clients {
-		c := clients[client_index].(map[string]any)
-		if c["email"] == clientEmail {
-			c["expiryTime"] = expiry_time
-			newClients = append(newClients, any(c))
-		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	return s.updateClientByEmail(clientEmail, func(client *model.Client) {
+		client.ExpiryTime = expiry_time
+	})
 }
 
 func (s *InboundService) ResetClientTrafficLimitByEmail(clientEmail string, totalGB int) (bool, error) {
 	if totalGB < 0 {
 		return false, common.NewError("totalGB must be >= 0")
 	}
-	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
-	if err != nil {
-		return false, err
-	}
-	if inbound == nil {
-		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
-	}
-
-	oldClients, err := s.GetClients(inbound)
-	if err != nil {
-		return false, err
-	}
-
-	clientId := ""
-
-	for _, oldClient := range oldClients {
-		if oldClient.Email == clientEmail {
-			if inbound.Protocol == "trojan" {
-				clientId = oldClient.Password
-			} else if inbound.Protocol == "shadowsocks" {
-				clientId = oldClient.Email
-			} else {
-				clientId = oldClient.ID
-			}
-			break
-		}
-	}
-
-	if len(clientId) == 0 {
-		return false, common.NewError("Client Not Found For Email:", clientEmail)
-	}
-
-	var settings map[string]any
-	err = json.Unmarshal([]byte(inbound.Settings), &settings)
-	if err != nil {
-		return false, err
-	}
-	clients := settings["clients"].([]any)
-	var newClients []any
-	for client_index := range clients {
-		c := clients[client_index].(map[string]any)
-		if c["email"] == clientEmail {
-			c["totalGB"] = totalGB * 1024 * 1024 * 1024
-			newClients = append(newClients, any(c))
-		}
-	}
-	settings["clients"] = newClients
-	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-	if err != nil {
-		return false, err
-	}
-	inbound.Settings = string(modifiedSettings)
-	needRestart, err := s.UpdateInboundClient(inbound, clientId)
-	return needRestart, err
+	return s.updateClientByEmail(clientEmail, func(client *model.Client) {
+		client.TotalGB = int64(totalGB) * 1024 * 1024 * 1024
+	})
 }
 
 func (s *InboundService) ResetClientTrafficByEmail(clientEmail string) error {
@@ -1569,43 +1171,23 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 		return false, err
 	}
 
+	db := database.GetDB()
 	if !traffic.Enable {
-		inbound, err := s.GetInbound(id)
+		inbound, err := s.getInbound(db, id)
 		if err != nil {
 			return false, err
 		}
-		clients, err := s.GetClients(inbound)
-		if err != nil {
+		client, err := s.getInboundClient(db, id, clientEmail)
+		if err != nil && !database.IsNotFound(err) {
 			return false, err
 		}
-		for _, client := range clients {
-			if client.Email == clientEmail && client.Enable {
-				s.xrayApi.Init(p.GetAPIPort())
-				cipher := ""
-				if string(inbound.Protocol) == "shadowsocks" {
-					var oldSettings map[string]any
-					err = json.Unmarshal([]byte(inbound.Settings), &oldSettings)
-					if err != nil {
-						return false, err
-					}
-					cipher = oldSettings["method"].(string)
-				}
-				err1 := s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]any{
-					"email":    client.Email,
-					"id":       client.ID,
-					"security": client.Security,
-					"flow":     client.Flow,
-					"password": client.Password,
-					"cipher":   cipher,
-				})
-				if err1 == nil {
-					logger.Debug("Client enabled due to reset traffic:", clientEmail)
-				} else {
-					logger.Debug("Error in enabling client by api:", err1)
-					needRestart = true
-				}
-				s.xrayApi.Close()
-				break
+		if client != nil && client.Enable {
+			err1 := xrayAPI().AddUser(string(inbound.Protocol), inbound.Tag, s.xrayUser(inbound, client))
+			if err1 == nil {
+				logger.Debug("Client enabled due to reset traffic:", clientEmail)
+			} else {
+				logger.Debug("Error in enabling client by api:", err1)
+				needRestart = true
 			}
 		}
 	}
@@ -1614,7 +1196,6 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 	traffic.Down = 0
 	traffic.Enable = true
 
-	db := database.GetDB()
 	err = db.Save(traffic).Error
 	if err != nil {
 		return false, err
@@ -1654,14 +1235,6 @@ func (s *InboundService) ResetAllTraffics() error {
 
 func (s *InboundService) DelDepletedClients(id int) (err error) {
 	db := database.GetDB()
-	tx := db.Begin()
-	defer func() {
-		if err == nil {
-			tx.Commit()
-		} else {
-			tx.Rollback()
-		}
-	}()
 
 	whereText := "reset = 0 and inbound_id "
 	if id < 0 {
@@ -1671,88 +1244,71 @@ func (s *InboundService) DelDepletedClients(id int) (err error) {
 	}
 
 	depletedClients := []xray.ClientTraffic{}
-	err = db.Model(xray.ClientTraffic{}).Where(whereText+" and enable = ?", id, false).Select("inbound_id, GROUP_CONCAT(email) as email").Group("inbound_id").Find(&depletedClients).Error
+	err = db.Model(xray.ClientTraffic{}).Where(whereText+" and enable = ?", id, false).Select("inbound_id, email").Find(&depletedClients).Error
 	if err != nil {
 		return err
 	}
-
+	depletedEmails := make(map[int][]string)
 	for _, depletedClient := range depletedClients {
-		emails := strings.Split(depletedClient.Email, ",")
-		oldInbound, err := s.GetInbound(depletedClient.InboundId)
-		if err != nil {
-			return err
-		}
-		var oldSettings map[string]any
-		err = json.Unmarshal([]byte(oldInbound.Settings), &oldSettings)
-		if err != nil {
-			return err
-		}
+		depletedEmails[depletedClient.InboundId] = append(depletedEmails[depletedClient.InboundId], depletedClient.Email)
+	}
 
-		oldClients := oldSettings["clients"].([]any)
-		var newClients []any
-		for _, client := range oldClients {
-			deplete := false
-			c := client.(map[string]any)
-			for _, email := range emails {
-				if email == c["email"].(string) {
-					deplete = true
-					break
-				}
+	var emptyInboundIds []int
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for inboundId, emails := range depletedEmails {
+			var clients []model.Client
+			err := tx.Model(model.Client{}).Where("inbound_id = ? AND email IN ?", inboundId, emails).Find(&clients).Error
+			if err != nil {
+				return err
 			}
-			if !deplete {
-				newClients = append(newClients, client)
+			err = s.recycleClients(tx, clients...)
+			if err != nil {
+				return err
 			}
-		}
-		if len(newClients) > 0 {
-			oldSettings["clients"] = newClients
-
-			newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
+			err = tx.Where("inbound_id = ? AND email IN ?", inboundId, emails).Delete(model.Client{}).Error
 			if err != nil {
 				return err
 			}
-
-			oldInbound.Settings = string(newSettings)
-			err = tx.Save(oldInbound).Error
+			err = s.delGroupMembers(tx, emails...)
 			if err != nil {
 				return err
 			}
-		} else {
-			// Delete inbound if no client remains
-			s.DelInbound(depletedClient.InboundId)
+			err = s.delScheduledActions(tx, emails...)
+			if err != nil {
+				return err
+			}
+			var count int64
+			err = tx.Model(model.Client{}).Where("inbound_id = ?", inboundId).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				emptyInboundIds = append(emptyInboundIds, inboundId)
+			}
 		}
-	}
 
-	err = tx.Where(whereText+" and enable = ?", id, false).Delete(xray.ClientTraffic{}).Error
+		return tx.Where(whereText+" and enable = ?", id, false).Delete(xray.ClientTraffic{}).Error
+	})
 	if err != nil {
 		return err
 	}
 
+	// Delete inbounds if no client remains
+	for _, inboundId := range emptyInboundIds {
+		s.DelInbound(inboundId)
+	}
+
 	return nil
 }
 
 func (s *InboundService) GetClientTrafficTgBot(tgId int64) ([]*xray.ClientTraffic, error) {
 	db := database.GetDB()
-	var inbounds []*model.Inbound
-
-	// Retrieve inbounds where settings contain the given tgId
-	err := db.Model(model.Inbound{}).Where("settings LIKE ?", fmt.Sprintf(`%%"tgId": %d%%`, tgId)).Find(&inbounds).Error
-	if err != nil && err != gorm.ErrRecordNotFound {
-		logger.Errorf("Error retrieving inbounds with tgId %d: %v", tgId, err)
-		return nil, err
-	}
 
 	var emails []string
-	for _, inbound := range inbounds {
-		clients, err := s.GetClients(inbound)
-		if err != nil {
-			logger.Errorf("Error retrieving clients for inbound %d: %v", inbound.Id, err)
-			continue
-		}
-		for _, client := range clients {
-			if client.TgID == tgId {
-				emails = append(emails, client.Email)
-			}
-		}
+	err := db.Model(model.Client{}).Where("tg_id = ?", tgId).Pluck("email", &emails).Error
+	if err != nil {
+		logger.Errorf("Error retrieving clients with tgId %d: %v", tgId, err)
+		return nil, err
 	}
 
 	var traffics []*xray.ClientTraffic
@@ -1786,16 +1342,10 @@ func (s *InboundService) GetClientTrafficByEmail(email string) (traffic *xray.Cl
 }
 
 func (s *InboundService) GetClientTrafficByID(id string) ([]xray.ClientTraffic, error) {
-	db := database.GetDB()
+	db := database.GetReadDB()
 	var traffics []xray.ClientTraffic
 
-	err := db.Model(xray.ClientTraffic{}).Where(`email IN(
-		SELECT JSON_EXTRACT(client.value, '$.email') as email
-		FROM inbounds,
-	  	JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
-		WHERE
-	  	JSON_EXTRACT(client.value, '$.id') in (?)
-		)`, id).Find(&traffics).Error
+	err := db.Model(xray.ClientTraffic{}).Where("email IN (?)", db.Model(model.Client{}).Select("email").Where("uuid = ?", id)).Find(&traffics).Error
 
 	if err != nil {
 		logger.Debug(err)
@@ -1806,50 +1356,30 @@ func (s *InboundService) GetClientTrafficByID(id string) ([]xray.ClientTraffic,
 
 func (s *InboundService) SearchClientTraffic(query string) (traffic *xray.ClientTraffic, err error) {
 	db := database.GetDB()
-	inbound := &model.Inbound{}
+	client := &model.Client{}
 	traffic = &xray.ClientTraffic{}
 
-	// Search for inbound settings that contain the query
-	err = db.Model(model.Inbound{}).Where("settings LIKE ?", "%\""+query+"\"%").First(inbound).Error
+	// Search for a client whose ID or password matches the query
+	err = db.Model(model.Client{}).
+		Where("(uuid = ? OR password = ?) AND email != ?", query, query, "").
+		First(client).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			logger.Warningf("Inbound settings containing query %s not found: %v", query, err)
+			logger.Warningf("No client found with query %s: %v", query, err)
 			return nil, err
 		}
-		logger.Errorf("Error searching for inbound settings with query %s: %v", query, err)
+		logger.Errorf("Error searching for client with query %s: %v", query, err)
 		return nil, err
 	}
 
-	traffic.InboundId = inbound.Id
-
-	// Unmarshal settings to get clients
-	settings := map[string][]model.Client{}
-	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
-		logger.Errorf("Error unmarshalling inbound settings for inbound ID %d: %v", inbound.Id, err)
-		return nil, err
-	}
-
-	clients := settings["clients"]
-	for _, client := range clients {
-		if (client.ID == query || client.Password == query) && client.Email != "" {
-			traffic.Email = client.Email
-			break
-		}
-	}
-
-	if traffic.Email == "" {
-		logger.Warningf("No client found with query %s in inbound ID %d", query, inbound.Id)
-		return nil, gorm.ErrRecordNotFound
-	}
-
 	// Retrieve ClientTraffic based on the found email
-	err = db.Model(xray.ClientTraffic{}).Where("email = ?", traffic.Email).First(traffic).Error
+	err = db.Model(xray.ClientTraffic{}).Where("email = ?", client.Email).First(traffic).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			logger.Warningf("ClientTraffic for email %s not found: %v", traffic.Email, err)
+			logger.Warningf("ClientTraffic for email %s not found: %v", client.Email, err)
 			return nil, err
 		}
-		logger.Errorf("Error retrieving ClientTraffic for email %s: %v", traffic.Email, err)
+		logger.Errorf("Error retrieving ClientTraffic for email %s: %v", client.Email, err)
 		return nil, err
 	}
 
@@ -1857,7 +1387,7 @@ func (s *InboundService) SearchClientTraffic(query string) (traffic *xray.Client
 }
 
 func (s *InboundService) GetInboundClientIps(clientEmail string) (string, error) {
-	db := database.GetDB()
+	db := database.GetReadDB()
 	InboundClientIps := &model.InboundClientIps{}
 	err := db.Model(model.InboundClientIps{}).Where("client_email = ?", clientEmail).First(InboundClientIps).Error
 	if err != nil {
@@ -1879,148 +1409,23 @@ func (s *InboundService) ClearClientIps(clientEmail string) error {
 	return nil
 }
 
-func (s *InboundService) SearchInbounds(query string) ([]*model.Inbound, error) {
-	db := database.GetDB()
-	var inbounds []*model.Inbound
-	err := db.Model(model.Inbound{}).Preload("ClientStats").Where("remark like ?", "%"+query+"%").Find(&inbounds).Error
-	if err != nil && err != gorm.ErrRecordNotFound {
-		return nil, err
-	}
-	return inbounds, nil
+// GetAccessHistory returns the connections from the access history matching query, newest first.
+func (s *InboundService) GetAccessHistory(query *xray.AccessQuery) ([]*xray.AccessRecord, error) {
+	return xray.QueryAccessHistory(query)
 }
 
-func (s *InboundService) MigrationRequirements() {
+func (s *InboundService) SearchInbounds(query string) ([]*model.Inbound, error) {
 	db := database.GetDB()
-	tx := db.Begin()
-	var err error
-	defer func() {
-		if err == nil {
-			tx.Commit()
-		} else {
-			tx.Rollback()
-		}
-	}()
-
-	// Fix inbounds based problems
 	var inbounds []*model.Inbound
-	err = tx.Model(model.Inbound{}).Where("protocol IN (?)", []string{"vmess", "vless", "trojan"}).Find(&inbounds).Error
+	err := db.Model(model.Inbound{}).Preload("ClientStats").Where(database.ILike("remark"), "%"+query+"%").Find(&inbounds).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
-		return
-	}
-	for inbound_index := range inbounds {
-		settings := map[string]any{}
-		json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-		clients, ok := settings["clients"].([]any)
-		if ok {
-			// Fix Client configuration problems
-			var newClients []any
-			for client_index := range clients {
-				c := clients[client_index].(map[string]any)
-
-				// Add email='' if it is not exists
-				if _, ok := c["email"]; !ok {
-					c["email"] = ""
-				}
-
-				// Convert string tgId to int64
-				if _, ok := c["tgId"]; ok {
-					var tgId any = c["tgId"]
-					if tgIdStr, ok2 := tgId.(string); ok2 {
-						tgIdInt64, err := strconv.ParseInt(strings.ReplaceAll(tgIdStr, " ", ""), 10, 64)
-						if err == nil {
-							c["tgId"] = tgIdInt64
-						}
-					}
-				}
-
-				// Remove "flow": "xtls-rprx-direct"
-				if _, ok := c["flow"]; ok {
-					if c["flow"] == "xtls-rprx-direct" {
-						c["flow"] = ""
-					}
-				}
-				newClients = append(newClients, any(c))
-			}
-			settings["clients"] = newClients
-			modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-			if err != nil {
-				return
-			}
-
-			inbounds[inbound_index].Settings = string(modifiedSettings)
-		}
-
-		// Add client traffic row for all clients which has email
-		modelClients, err := s.GetClients(inbounds[inbound_index])
-		if err != nil {
-			return
-		}
-		for _, modelClient := range modelClients {
-			if len(modelClient.Email) > 0 {
-				var count int64
-				tx.Model(xray.ClientTraffic{}).Where("email = ?", modelClient.Email).Count(&count)
-				if count == 0 {
-					s.AddClientStat(tx, inbounds[inbound_index].Id, &modelClient)
-				}
-			}
-		}
-	}
-	tx.Save(inbounds)
-
-	// Remove orphaned traffics
-	tx.Where("inbound_id = 0").Delete(xray.ClientTraffic{})
-
-	// Migrate old MultiDomain to External Proxy
-	var externalProxy []struct {
-		Id             int
-		Port           int
-		StreamSettings []byte
-	}
-	err = tx.Raw(`select id, port, stream_settings
-	from inbounds
-	WHERE protocol in ('vmess','vless','trojan')
-	  AND json_extract(stream_settings, '$.security') = 'tls'
-	  AND json_extract(stream_settings, '$.tlsSettings.settings.domains') IS NOT NULL`).Scan(&externalProxy).Error
-	if err != nil || len(externalProxy) == 0 {
-		return
-	}
-
-	for _, ep := range externalProxy {
-		var reverses any
-		var stream map[string]any
-		json.Unmarshal(ep.StreamSettings, &stream)
-		if tlsSettings, ok := stream["tlsSettings"].(map[string]any); ok {
-			if settings, ok := tlsSettings["settings"].(map[string]any); ok {
-				if domains, ok := settings["domains"].([]any); ok {
-					for _, domain := range domains {
-						if domainMap, ok := domain.(map[string]any); ok {
-							domainMap["forceTls"] = "same"
-							domainMap["port"] = ep.Port
-							domainMap["dest"] = domainMap["domain"].(string)
-							delete(domainMap, "domain")
-						}
-					}
-				}
-				reverses = settings["domains"]
-				delete(settings, "domains")
-			}
-		}
-		stream["externalProxy"] = reverses
-		newStream, _ := json.MarshalIndent(stream, " ", "  ")
-		tx.Model(model.Inbound{}).Where("id = ?", ep.Id).Update("stream_settings", newStream)
+		return nil, err
 	}
-
-	err = tx.Raw(`UPDATE inbounds
-	SET tag = REPLACE(tag, '0.0.0.0:', '')
-	WHERE INSTR(tag, '0.0.0.0:') > 0;`).Error
+	err = s.LoadClients(db, inbounds...)
 	if err != nil {
-		return
+		return nil, err
 	}
-}
-
-func (s *InboundService) MigrateDB() {
-	s.MigrationRequirements()
-	s.MigrationRemoveOrphanedTraffics()
+	return inbounds, nil
 }
 
 func (s *InboundService) GetOnlineClients() []string {
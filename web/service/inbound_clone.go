@@ -0,0 +1,280 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/util/random"
+
+	"github.com/google/uuid"
+)
+
+// A cloned inbound, like one created from a template, gets a free port and fresh
+// credentials: client UUIDs and passwords, Shadowsocks keys, account passwords, WireGuard
+// keys, Reality keys and short ids. Everything else is copied as it is.
+
+const (
+	clonePortMin      = 10000
+	clonePortMax      = 60000
+	clonePortAttempts = 100
+)
+
+// CloneInboundRequest tells how to clone an inbound. A free port is picked when Port is
+// 0, and the remark of the inbound is used with a suffix when Remark is empty.
+type CloneInboundRequest struct {
+	WithClients bool   `json:"withClients"`
+	Port        int    `json:"port"`
+	Remark      string `json:"remark"`
+}
+
+// genInboundTag returns the tag of an inbound listening on listen and port.
+func genInboundTag(listen string, port int) string {
+	if listen == "" || listen == "0.0.0.0" || listen == "::" || listen == "::0" {
+		return fmt.Sprintf("inbound-%v", port)
+	}
+	return fmt.Sprintf("inbound-%v:%v", listen, port)
+}
+
+// pickPort returns port when it is free on listen, or a free random port when it is 0.
+func (s *InboundService) pickPort(listen string, port int) (int, error) {
+	if port > 0 {
+		exist, err := s.checkPortExist(listen, port, 0)
+		if err != nil {
+			return 0, err
+		}
+		if exist {
+			return 0, common.NewError("Port already exists:", port)
+		}
+		return port, nil
+	}
+	for i := 0; i < clonePortAttempts; i++ {
+		port = clonePortMin + random.Num(clonePortMax-clonePortMin+1)
+		exist, err := s.checkPortExist(listen, port, 0)
+		if err != nil {
+			return 0, err
+		}
+		if !exist {
+			return port, nil
+		}
+	}
+	return 0, common.NewError("no free port found")
+}
+
+// decodeObject decodes a JSON object, keeping numbers as written.
+func decodeObject(data string) (map[string]any, error) {
+	object := map[string]any{}
+	if data == "" {
+		return object, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// randomHex returns n random hexadecimal digits.
+func randomHex(n int) string {
+	b := make([]byte, (n+1)/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)[:n]
+}
+
+// newShadowsocksPassword returns a password for method. The 2022 methods take a base64
+// key of the size of their cipher, the others any string.
+func newShadowsocksPassword(method string) string {
+	size := 32
+	if method == "2022-blake3-aes-128-gcm" {
+		size = 16
+	}
+	b := make([]byte, size)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// newWireguardKeyPair returns a base64 private and public key for WireGuard.
+func newWireguardKeyPair() (string, string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()),
+		base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// renewWireguardKeys gives the server and every peer in fields new keys. A pre-shared key
+// is replaced as well, the addresses of the peers are kept.
+func renewWireguardKeys(fields map[string]any) error {
+	secretKey, _, err := newWireguardKeyPair()
+	if err != nil {
+		return common.NewError("unable to generate WireGuard keys:", err)
+	}
+	fields["secretKey"] = secretKey
+	peers, _ := fields["peers"].([]any)
+	for _, peer := range peers {
+		peer, ok := peer.(map[string]any)
+		if !ok {
+			continue
+		}
+		privateKey, publicKey, err := newWireguardKeyPair()
+		if err != nil {
+			return common.NewError("unable to generate WireGuard keys:", err)
+		}
+		peer["privateKey"] = privateKey
+		peer["publicKey"] = publicKey
+		if psk, ok := peer["preSharedKey"].(string); ok && psk != "" {
+			b := make([]byte, 32)
+			rand.Read(b)
+			peer["preSharedKey"] = base64.StdEncoding.EncodeToString(b)
+		}
+	}
+	return nil
+}
+
+// renewClients gives clients new emails and credentials, keeping their limits.
+func renewClients(protocol model.Protocol, method string, clients []model.Client) {
+	for i := range clients {
+		client := &clients[i]
+		client.RowId = 0
+		client.Email = fmt.Sprintf("%s-%s", client.Email, random.NumLower(4))
+		client.SubID = random.Seq(16)
+		switch protocol {
+		case model.VMESS, model.VLESS:
+			client.ID = uuid.New().String()
+		case model.Trojan:
+			client.Password = random.Seq(10)
+		case model.Shadowsocks:
+			client.Password = newShadowsocksPassword(method)
+		}
+	}
+}
+
+// renewInboundKeys replaces the credentials in the settings and stream settings of
+// inbound with fresh ones. Clients are dropped unless withClients is set.
+func renewInboundKeys(inbound *model.Inbound, withClients bool) error {
+	settings, clients, ok, err := splitSettings(inbound.Settings)
+	if err != nil {
+		return err
+	}
+	fields, err := decodeObject(settings)
+	if err != nil {
+		return common.NewError("invalid inbound settings:", err)
+	}
+
+	method, _ := fields["method"].(string)
+	if password, ok := fields["password"].(string); ok && password != "" && inbound.Protocol == model.Shadowsocks {
+		fields["password"] = newShadowsocksPassword(method)
+	}
+	if accounts, ok := fields["accounts"].([]any); ok {
+		for _, account := range accounts {
+			if account, ok := account.(map[string]any); ok {
+				account["pass"] = random.Seq(10)
+			}
+		}
+	}
+	if inbound.Protocol == model.WireGuard {
+		if err := renewWireguardKeys(fields); err != nil {
+			return err
+		}
+	}
+	if ok || hasClients(inbound.Protocol) {
+		if !withClients {
+			clients = []model.Client{}
+		}
+		renewClients(inbound.Protocol, method, clients)
+		fields["clients"] = clients
+	}
+	newSettings, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	inbound.Settings = string(newSettings)
+
+	stream, err := decodeObject(inbound.StreamSettings)
+	if err != nil {
+		return common.NewError("invalid inbound stream settings:", err)
+	}
+	reality, ok := stream["realitySettings"].(map[string]any)
+	if !ok || stream["security"] != "reality" {
+		return nil
+	}
+	privateKey, publicKey, err := newX25519KeyPair()
+	if err != nil {
+		return common.NewError("unable to generate Reality keys:", err)
+	}
+	reality["privateKey"] = privateKey
+	if realitySettings, ok := reality["settings"].(map[string]any); ok {
+		realitySettings["publicKey"] = publicKey
+	} else {
+		reality["settings"] = map[string]any{"publicKey": publicKey}
+	}
+	if shortIds, ok := reality["shortIds"].([]any); ok {
+		for i, shortId := range shortIds {
+			if shortId, ok := shortId.(string); ok {
+				shortIds[i] = randomHex(len(shortId))
+			}
+		}
+	}
+	newStream, err := json.MarshalIndent(stream, "", "  ")
+	if err != nil {
+		return err
+	}
+	inbound.StreamSettings = string(newStream)
+	return nil
+}
+
+// addInboundLike adds inbound for userId on a free port, or on port when it is not 0,
+// with fresh credentials.
+func (s *InboundService) addInboundLike(userId int, inbound *model.Inbound, port int, withClients bool) (*model.Inbound, bool, error) {
+	if err := renewInboundKeys(inbound, withClients); err != nil {
+		return inbound, false, err
+	}
+	port, err := s.pickPort(inbound.Listen, port)
+	if err != nil {
+		return inbound, false, err
+	}
+	inbound.Id = 0
+	inbound.UserId = userId
+	inbound.Port = port
+	inbound.Tag = genInboundTag(inbound.Listen, port)
+	inbound.ClientStats = nil
+	return s.AddInbound(inbound)
+}
+
+// CloneInbound copies the inbound with the given id for userId, with or without its
+// clients, which get new emails as well as new credentials. Traffic starts from zero.
+func (s *InboundService) CloneInbound(userId int, id int, req *CloneInboundRequest) (*model.Inbound, bool, error) {
+	source, err := s.GetInbound(id)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return nil, false, common.NewError("Inbound Not Found:", id)
+		}
+		return nil, false, err
+	}
+	remark := req.Remark
+	if remark == "" {
+		remark = source.Remark + " - Cloned"
+	}
+	inbound := &model.Inbound{
+		Total:          source.Total,
+		Remark:         remark,
+		Enable:         source.Enable,
+		ExpiryTime:     source.ExpiryTime,
+		Listen:         source.Listen,
+		Protocol:       source.Protocol,
+		Settings:       source.Settings,
+		StreamSettings: source.StreamSettings,
+		Sniffing:       source.Sniffing,
+		Allocate:       source.Allocate,
+	}
+	return s.addInboundLike(userId, inbound, req.Port, req.WithClients)
+}
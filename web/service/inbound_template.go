@@ -0,0 +1,231 @@
+package service
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"gorm.io/gorm"
+)
+
+// Inbound templates hold everything of an inbound but its port and clients. Parameters
+// written as ${name} in their fields are replaced when a template is instantiated, then
+// the new inbound gets a port and fresh credentials like a cloned one.
+
+var templateParamRegex = regexp.MustCompile(`\$\{(\w+)\}`)
+
+type InboundTemplateService struct {
+	inboundService InboundService
+}
+
+// InboundTemplateInfo is a template as listed by the API, with the names of its parameters.
+type InboundTemplateInfo struct {
+	model.InboundTemplate
+	Params []string `json:"params"`
+}
+
+// InstantiateTemplateRequest gives the values of the parameters of a template. A free
+// port is picked when Port is 0.
+type InstantiateTemplateRequest struct {
+	Params map[string]string `json:"params"`
+	Port   int               `json:"port"`
+	Enable *bool             `json:"enable"`
+}
+
+// templateFields returns the fields of template that may hold parameters, and whether
+// each is JSON.
+func templateFields(template *model.InboundTemplate) map[*string]bool {
+	return map[*string]bool{
+		&template.Remark:         false,
+		&template.Listen:         false,
+		&template.Settings:       true,
+		&template.StreamSettings: true,
+		&template.Sniffing:       true,
+		&template.Allocate:       true,
+	}
+}
+
+// templateParams returns the names of the parameters of template in the order they appear.
+func templateParams(template *model.InboundTemplate) []string {
+	params := make([]string, 0)
+	for _, field := range []string{template.Remark, template.Listen, template.Settings,
+		template.StreamSettings, template.Sniffing, template.Allocate} {
+		for _, match := range templateParamRegex.FindAllStringSubmatch(field, -1) {
+			if !slices.Contains(params, match[1]) {
+				params = append(params, match[1])
+			}
+		}
+	}
+	return params
+}
+
+// fillTemplate replaces the parameters in the fields of template with values. Values put
+// in JSON fields are escaped, as parameters are expected inside JSON strings.
+func fillTemplate(template *model.InboundTemplate, values map[string]string) error {
+	for _, param := range templateParams(template) {
+		if _, ok := values[param]; !ok {
+			return common.NewError("missing template parameter:", param)
+		}
+	}
+	for field, isJson := range templateFields(template) {
+		*field = templateParamRegex.ReplaceAllStringFunc(*field, func(match string) string {
+			value := values[match[2:len(match)-1]]
+			if !isJson {
+				return value
+			}
+			escaped, _ := json.Marshal(value)
+			return string(escaped[1 : len(escaped)-1])
+		})
+		if isJson && *field != "" && !json.Valid([]byte(*field)) {
+			return common.NewError("template is not valid JSON once filled in")
+		}
+	}
+	return nil
+}
+
+func (s *InboundTemplateService) checkTemplate(tx *gorm.DB, template *model.InboundTemplate) error {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" {
+		return common.NewError("empty template name")
+	}
+	if template.Protocol == "" {
+		return common.NewError("empty template protocol")
+	}
+	var count int64
+	err := tx.Model(model.InboundTemplate{}).Where("name = ? AND id <> ?", template.Name, template.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("Template already exists:", template.Name)
+	}
+	return nil
+}
+
+func (s *InboundTemplateService) getTemplate(tx *gorm.DB, id int) (*model.InboundTemplate, error) {
+	template := &model.InboundTemplate{}
+	err := tx.Model(model.InboundTemplate{}).First(template, id).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("Template not found:", id)
+	}
+	return template, err
+}
+
+// GetTemplates lists the templates with their parameters.
+func (s *InboundTemplateService) GetTemplates() ([]InboundTemplateInfo, error) {
+	db := database.GetDB()
+	var templates []model.InboundTemplate
+	if err := db.Model(model.InboundTemplate{}).Order("id").Find(&templates).Error; err != nil {
+		return nil, err
+	}
+	infos := make([]InboundTemplateInfo, 0, len(templates))
+	for _, template := range templates {
+		infos = append(infos, InboundTemplateInfo{InboundTemplate: template, Params: templateParams(&template)})
+	}
+	return infos, nil
+}
+
+// AddTemplate creates a template.
+func (s *InboundTemplateService) AddTemplate(template *model.InboundTemplate) error {
+	db := database.GetDB()
+	template.Id = 0
+	if err := s.checkTemplate(db, template); err != nil {
+		return err
+	}
+	return db.Create(template).Error
+}
+
+// UpdateTemplate changes a template, the inbounds created from it stay as they are.
+func (s *InboundTemplateService) UpdateTemplate(template *model.InboundTemplate) error {
+	db := database.GetDB()
+	if _, err := s.getTemplate(db, template.Id); err != nil {
+		return err
+	}
+	if err := s.checkTemplate(db, template); err != nil {
+		return err
+	}
+	return db.Save(template).Error
+}
+
+// DelTemplate deletes a template.
+func (s *InboundTemplateService) DelTemplate(id int) error {
+	db := database.GetDB()
+	result := db.Delete(model.InboundTemplate{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("Template not found:", id)
+	}
+	return nil
+}
+
+// SaveInboundAsTemplate creates a template named name from the inbound with the given id,
+// leaving out its clients.
+func (s *InboundTemplateService) SaveInboundAsTemplate(id int, name string) (*model.InboundTemplate, error) {
+	inbound, err := s.inboundService.GetInbound(id)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return nil, common.NewError("Inbound Not Found:", id)
+		}
+		return nil, err
+	}
+	settings, _, ok, err := splitSettings(inbound.Settings)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		fields, err := decodeObject(settings)
+		if err != nil {
+			return nil, err
+		}
+		fields["clients"] = []model.Client{}
+		newSettings, err := json.MarshalIndent(fields, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		settings = string(newSettings)
+	}
+	template := &model.InboundTemplate{
+		Name:           name,
+		Remark:         inbound.Remark,
+		Listen:         inbound.Listen,
+		Protocol:       inbound.Protocol,
+		Settings:       settings,
+		StreamSettings: inbound.StreamSettings,
+		Sniffing:       inbound.Sniffing,
+		Allocate:       inbound.Allocate,
+	}
+	return template, s.AddTemplate(template)
+}
+
+// InstantiateTemplate creates an inbound for userId from the template with the given id.
+func (s *InboundTemplateService) InstantiateTemplate(userId int, id int, req *InstantiateTemplateRequest) (*model.Inbound, bool, error) {
+	template, err := s.getTemplate(database.GetDB(), id)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := fillTemplate(template, req.Params); err != nil {
+		return nil, false, err
+	}
+	inbound := &model.Inbound{
+		Remark:         template.Remark,
+		Enable:         req.Enable == nil || *req.Enable,
+		Listen:         template.Listen,
+		Protocol:       template.Protocol,
+		Settings:       template.Settings,
+		StreamSettings: template.StreamSettings,
+		Sniffing:       template.Sniffing,
+		Allocate:       template.Allocate,
+	}
+	if inbound.Remark == "" {
+		inbound.Remark = template.Name
+	}
+	// Clients written in the template are created with fresh credentials
+	return s.inboundService.addInboundLike(userId, inbound, req.Port, true)
+}
@@ -0,0 +1,599 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"gorm.io/gorm"
+)
+
+// Plans hold the limits of an offer and groups put clients on a plan. The limits a client
+// inherits are written to the client and its traffic record, which the Xray config, the
+// IP limit and the traffic checks work with, whenever the client joins a group, the group
+// gets another plan or the plan itself changes. Limits the client sets itself are kept.
+
+const planDay = int64(24 * time.Hour / time.Millisecond)
+
+type PlanService struct {
+	inboundService InboundService
+}
+
+// ClientGroupInfo is a group as listed by the API.
+type ClientGroupInfo struct {
+	model.ClientGroup
+	Members int64 `json:"members"`
+}
+
+// GroupMemberInfo is a member of a group along with the limits it currently has.
+type GroupMemberInfo struct {
+	model.GroupMember
+	InboundId  int   `json:"inboundId"`
+	Enable     bool  `json:"enable"`
+	TotalGB    int64 `json:"totalGB"`
+	ExpiryTime int64 `json:"expiryTime"`
+	LimitIP    int   `json:"limitIp"`
+	Reset      int   `json:"reset"`
+}
+
+// GroupMembersRequest adds or removes the clients with Emails. The Own fields mark the
+// limits the added clients keep instead of inheriting them from the plan. RestartExpiry
+// gives added clients whose expiry already runs a new period of the plan.
+type GroupMembersRequest struct {
+	Emails        []string `json:"emails"`
+	OwnTotal      bool     `json:"ownTotal"`
+	OwnExpiry     bool     `json:"ownExpiry"`
+	OwnLimitIP    bool     `json:"ownLimitIp"`
+	OwnReset      bool     `json:"ownReset"`
+	RestartExpiry bool     `json:"restartExpiry"`
+}
+
+// applyPlan sets the limits a member inherits from plan. The duration of the plan starts
+// with the first use of the client, like the delayed start of a single client. An expiry
+// that already runs is kept unless restart is set.
+func applyPlan(plan *model.Plan, member *model.GroupMember, client *model.Client, restart bool) {
+	if !member.OwnTotal {
+		client.TotalGB = plan.TotalGB
+	}
+	if !member.OwnExpiry && (restart || client.ExpiryTime <= 0) {
+		client.ExpiryTime = -int64(plan.Days) * planDay
+	}
+	if !member.OwnLimitIP {
+		client.LimitIP = plan.LimitIP
+	}
+	if !member.OwnReset {
+		client.Reset = plan.Reset
+	}
+}
+
+// changePlan brings the limits a member inherits from before to after. A period that
+// already started keeps its start and only moves by the change of the duration.
+func changePlan(before *model.Plan, after *model.Plan, member *model.GroupMember, client *model.Client) {
+	expiryTime := client.ExpiryTime
+	applyPlan(after, member, client, true)
+	if !member.OwnExpiry && expiryTime > 0 && after.Days > 0 {
+		client.ExpiryTime = expiryTime + int64(after.Days-before.Days)*planDay
+	}
+}
+
+// allowsInbound reports whether clients on plan may be in the inbound with the given id.
+func allowsInbound(plan *model.Plan, inboundId int) bool {
+	return len(plan.InboundIds) == 0 || slices.Contains(plan.InboundIds, inboundId)
+}
+
+// saveLimits stores the limits of client on it and on its traffic record.
+func (s *PlanService) saveLimits(tx *gorm.DB, client *model.Client) error {
+	err := tx.Model(client).Select("TotalGB", "ExpiryTime", "LimitIP", "Reset").Updates(client).Error
+	if err != nil {
+		return err
+	}
+	return s.inboundService.UpdateClientStat(tx, client.Email, client)
+}
+
+func (s *PlanService) checkPlan(tx *gorm.DB, plan *model.Plan) error {
+	plan.Name = strings.TrimSpace(plan.Name)
+	if plan.Name == "" {
+		return common.NewError("empty plan name")
+	}
+	if plan.TotalGB < 0 || plan.Days < 0 || plan.LimitIP < 0 || plan.Reset < 0 {
+		return common.NewError("plan limits must be >= 0")
+	}
+	var count int64
+	err := tx.Model(model.Plan{}).Where("name = ? AND id <> ?", plan.Name, plan.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("Plan already exists:", plan.Name)
+	}
+	if len(plan.InboundIds) > 0 {
+		err = tx.Model(model.Inbound{}).Where("id IN ?", plan.InboundIds).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if int(count) != len(plan.InboundIds) {
+			return common.NewError("unknown inbound in plan:", plan.InboundIds)
+		}
+	}
+	return nil
+}
+
+func (s *PlanService) getPlan(tx *gorm.DB, id int) (*model.Plan, error) {
+	plan := &model.Plan{}
+	err := tx.Model(model.Plan{}).First(plan, id).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("Plan not found:", id)
+	}
+	return plan, err
+}
+
+func (s *PlanService) getGroup(tx *gorm.DB, id int) (*model.ClientGroup, error) {
+	group := &model.ClientGroup{}
+	err := tx.Model(model.ClientGroup{}).First(group, id).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("Group not found:", id)
+	}
+	return group, err
+}
+
+// getGroupPlan returns the plan of a group, nil when it has none.
+func (s *PlanService) getGroupPlan(tx *gorm.DB, group *model.ClientGroup) (*model.Plan, error) {
+	if group.PlanId == 0 {
+		return nil, nil
+	}
+	return s.getPlan(tx, group.PlanId)
+}
+
+// getMembers returns the members of the groups with the given ids and their clients,
+// keyed by email. Members whose client is gone are left out.
+func (s *PlanService) getMembers(tx *gorm.DB, groupIds ...int) ([]model.GroupMember, map[string]*model.Client, error) {
+	var members []model.GroupMember
+	err := tx.Model(model.GroupMember{}).Where("group_id IN ?", groupIds).Order("id").Find(&members).Error
+	if err != nil || len(members) == 0 {
+		return nil, nil, err
+	}
+	emails := make([]string, 0, len(members))
+	for _, member := range members {
+		emails = append(emails, member.Email)
+	}
+	var clients []model.Client
+	if err := tx.Model(model.Client{}).Where("email IN ?", emails).Find(&clients).Error; err != nil {
+		return nil, nil, err
+	}
+	clientsByEmail := make(map[string]*model.Client, len(clients))
+	for i := range clients {
+		clientsByEmail[clients[i].Email] = &clients[i]
+	}
+	members = slices.DeleteFunc(members, func(member model.GroupMember) bool {
+		return clientsByEmail[member.Email] == nil
+	})
+	return members, clientsByEmail, nil
+}
+
+// checkMembersAllowed fails when a member of the given groups is in an inbound plan does not allow.
+func (s *PlanService) checkMembersAllowed(tx *gorm.DB, plan *model.Plan, groupIds ...int) error {
+	if plan == nil || len(plan.InboundIds) == 0 || len(groupIds) == 0 {
+		return nil
+	}
+	members, clients, err := s.getMembers(tx, groupIds...)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if !allowsInbound(plan, clients[member.Email].InboundId) {
+			return common.NewErrorf("Client %s is in inbound %d, which plan %s does not allow",
+				member.Email, clients[member.Email].InboundId, plan.Name)
+		}
+	}
+	return nil
+}
+
+// GetPlans lists the plans.
+func (s *PlanService) GetPlans() ([]model.Plan, error) {
+	db := database.GetDB()
+	plans := make([]model.Plan, 0)
+	err := db.Model(model.Plan{}).Order("id").Find(&plans).Error
+	return plans, err
+}
+
+// AddPlan creates a plan.
+func (s *PlanService) AddPlan(plan *model.Plan) error {
+	db := database.GetDB()
+	plan.Id = 0
+	if err := s.checkPlan(db, plan); err != nil {
+		return err
+	}
+	return db.Create(plan).Error
+}
+
+// UpdatePlan changes a plan and passes the change on to the members of its groups. It
+// reports whether a client changed.
+func (s *PlanService) UpdatePlan(plan *model.Plan) (bool, error) {
+	changed := false
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		before, err := s.getPlan(tx, plan.Id)
+		if err != nil {
+			return err
+		}
+		if err := s.checkPlan(tx, plan); err != nil {
+			return err
+		}
+		var groupIds []int
+		err = tx.Model(model.ClientGroup{}).Where("plan_id = ?", plan.Id).Pluck("id", &groupIds).Error
+		if err != nil {
+			return err
+		}
+		if err := s.checkMembersAllowed(tx, plan, groupIds...); err != nil {
+			return err
+		}
+		if err := tx.Save(plan).Error; err != nil {
+			return err
+		}
+		if len(groupIds) == 0 {
+			return nil
+		}
+
+		members, clients, err := s.getMembers(tx, groupIds...)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			client := clients[member.Email]
+			changePlan(before, plan, &member, client)
+			if err := s.saveLimits(tx, client); err != nil {
+				return err
+			}
+		}
+		changed = len(members) > 0
+		logger.Infof("Plan %s changed for %d clients", plan.Name, len(members))
+		return nil
+	})
+	return changed, err
+}
+
+// DelPlan deletes a plan no group is on.
+func (s *PlanService) DelPlan(id int) error {
+	db := database.GetDB()
+	var count int64
+	if err := db.Model(model.ClientGroup{}).Where("plan_id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("Plan is used by groups:", count)
+	}
+	result := db.Delete(model.Plan{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("Plan not found:", id)
+	}
+	return nil
+}
+
+// GetGroups lists the groups with their number of members.
+func (s *PlanService) GetGroups() ([]ClientGroupInfo, error) {
+	db := database.GetDB()
+	var groups []model.ClientGroup
+	if err := db.Model(model.ClientGroup{}).Order("id").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	var counts []struct {
+		GroupId int
+		Count   int64
+	}
+	err := db.Model(model.GroupMember{}).Select("group_id, count(*) AS count").Group("group_id").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[int]int64, len(counts))
+	for _, count := range counts {
+		members[count.GroupId] = count.Count
+	}
+	infos := make([]ClientGroupInfo, 0, len(groups))
+	for _, group := range groups {
+		infos = append(infos, ClientGroupInfo{ClientGroup: group, Members: members[group.Id]})
+	}
+	return infos, nil
+}
+
+func (s *PlanService) checkGroup(tx *gorm.DB, group *model.ClientGroup) error {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return common.NewError("empty group name")
+	}
+	var count int64
+	err := tx.Model(model.ClientGroup{}).Where("name = ? AND id <> ?", group.Name, group.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("Group already exists:", group.Name)
+	}
+	if group.PlanId != 0 {
+		if _, err := s.getPlan(tx, group.PlanId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddGroup creates a group.
+func (s *PlanService) AddGroup(group *model.ClientGroup) error {
+	db := database.GetDB()
+	group.Id = 0
+	if err := s.checkGroup(db, group); err != nil {
+		return err
+	}
+	return db.Create(group).Error
+}
+
+// UpdateGroup changes a group. Members of a group put on another plan get the limits of
+// that plan as if they had just joined. It reports whether a client changed.
+func (s *PlanService) UpdateGroup(group *model.ClientGroup) (bool, error) {
+	changed := false
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		before, err := s.getGroup(tx, group.Id)
+		if err != nil {
+			return err
+		}
+		if err := s.checkGroup(tx, group); err != nil {
+			return err
+		}
+		plan, err := s.getGroupPlan(tx, group)
+		if err != nil {
+			return err
+		}
+		if group.PlanId != before.PlanId {
+			if err := s.checkMembersAllowed(tx, plan, group.Id); err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(group).Error; err != nil {
+			return err
+		}
+		if group.PlanId == before.PlanId || plan == nil {
+			return nil
+		}
+
+		members, clients, err := s.getMembers(tx, group.Id)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			client := clients[member.Email]
+			applyPlan(plan, &member, client, false)
+			if err := s.saveLimits(tx, client); err != nil {
+				return err
+			}
+		}
+		changed = len(members) > 0
+		return nil
+	})
+	return changed, err
+}
+
+// DelGroup deletes a group. Its members keep the limits they have.
+func (s *PlanService) DelGroup(id int) error {
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.getGroup(tx, id); err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(model.GroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(model.ClientGroup{}, id).Error
+	})
+}
+
+// GetGroupMembers lists the members of a group.
+func (s *PlanService) GetGroupMembers(id int) ([]GroupMemberInfo, error) {
+	db := database.GetDB()
+	if _, err := s.getGroup(db, id); err != nil {
+		return nil, err
+	}
+	members, clients, err := s.getMembers(db, id)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]GroupMemberInfo, 0, len(members))
+	for _, member := range members {
+		client := clients[member.Email]
+		infos = append(infos, GroupMemberInfo{
+			GroupMember: member,
+			InboundId:   client.InboundId,
+			Enable:      client.Enable,
+			TotalGB:     client.TotalGB,
+			ExpiryTime:  client.ExpiryTime,
+			LimitIP:     client.LimitIP,
+			Reset:       client.Reset,
+		})
+	}
+	return infos, nil
+}
+
+// AddGroupMembers puts clients in a group, moving them out of the group they were in, and
+// gives them the limits of its plan. Adding a member again changes the limits it keeps. A
+// client whose expiry already runs keeps it unless req asks to restart it.
+func (s *PlanService) AddGroupMembers(id int, req *GroupMembersRequest) ([]ClientBulkResult, bool, error) {
+	results := make([]ClientBulkResult, 0, len(req.Emails))
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		group, err := s.getGroup(tx, id)
+		if err != nil {
+			return err
+		}
+		plan, err := s.getGroupPlan(tx, group)
+		if err != nil {
+			return err
+		}
+		for _, email := range req.Emails {
+			client := &model.Client{}
+			err := tx.Model(model.Client{}).Where("email = ?", email).First(client).Error
+			if database.IsNotFound(err) {
+				results = append(results, ClientBulkResult{Email: email, Msg: "Client Not Found For Email: " + email})
+				continue
+			} else if err != nil {
+				return err
+			}
+			identity, err := s.inboundService.getClientIdentity(tx, email)
+			if err != nil {
+				return err
+			}
+			if identity != nil {
+				results = append(results, ClientBulkResult{Email: email, Msg: "client has the limits of identity " + identity.Name})
+				continue
+			}
+			if plan != nil && !allowsInbound(plan, client.InboundId) {
+				results = append(results, ClientBulkResult{Email: email, Msg: "inbound not allowed by plan " + plan.Name})
+				continue
+			}
+
+			member := &model.GroupMember{}
+			err = tx.Model(model.GroupMember{}).Where("email = ?", email).First(member).Error
+			if err != nil && !database.IsNotFound(err) {
+				return err
+			}
+			member.GroupId = group.Id
+			member.Email = email
+			member.OwnTotal = req.OwnTotal
+			member.OwnExpiry = req.OwnExpiry
+			member.OwnLimitIP = req.OwnLimitIP
+			member.OwnReset = req.OwnReset
+			if err := tx.Save(member).Error; err != nil {
+				return err
+			}
+			if plan != nil {
+				applyPlan(plan, member, client, req.RestartExpiry)
+				if err := s.saveLimits(tx, client); err != nil {
+					return err
+				}
+			}
+			results = append(results, ClientBulkResult{Email: email, Success: true})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return results, slices.ContainsFunc(results, func(result ClientBulkResult) bool { return result.Success }), nil
+}
+
+// RemoveGroupMembers takes clients out of a group. They keep the limits they have.
+func (s *PlanService) RemoveGroupMembers(id int, emails []string) ([]ClientBulkResult, error) {
+	db := database.GetDB()
+	if _, err := s.getGroup(db, id); err != nil {
+		return nil, err
+	}
+	results := make([]ClientBulkResult, 0, len(emails))
+	for _, email := range emails {
+		result := db.Where("group_id = ? AND email = ?", id, email).Delete(model.GroupMember{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			results = append(results, ClientBulkResult{Email: email, Msg: "Client is not in the group: " + email})
+		} else {
+			results = append(results, ClientBulkResult{Email: email, Success: true})
+		}
+	}
+	return results, nil
+}
+
+// memberPlan is the membership of a client in a group on a plan.
+type memberPlan struct {
+	member *model.GroupMember
+	plan   *model.Plan
+}
+
+// getMemberPlans returns the membership of the clients with the given emails that are in
+// a group on a plan, keyed by email.
+func (s *InboundService) getMemberPlans(tx *gorm.DB, emails []string) (map[string]memberPlan, error) {
+	memberPlans := make(map[string]memberPlan)
+	var members []model.GroupMember
+	err := tx.Model(model.GroupMember{}).Where("email IN ?", emails).Find(&members).Error
+	if err != nil || len(members) == 0 {
+		return memberPlans, err
+	}
+	groupIds := make([]int, 0, len(members))
+	for _, member := range members {
+		groupIds = append(groupIds, member.GroupId)
+	}
+	var groups []model.ClientGroup
+	if err := tx.Model(model.ClientGroup{}).Where("id IN ? AND plan_id > 0", groupIds).Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	planIds := make([]int, 0, len(groups))
+	for _, group := range groups {
+		planIds = append(planIds, group.PlanId)
+	}
+	var plans []model.Plan
+	if err := tx.Model(model.Plan{}).Where("id IN ?", planIds).Find(&plans).Error; err != nil {
+		return nil, err
+	}
+	plansById := make(map[int]*model.Plan, len(plans))
+	for i := range plans {
+		plansById[plans[i].Id] = &plans[i]
+	}
+	groupPlans := make(map[int]*model.Plan, len(groups))
+	for _, group := range groups {
+		groupPlans[group.Id] = plansById[group.PlanId]
+	}
+	for i := range members {
+		if plan := groupPlans[members[i].GroupId]; plan != nil {
+			memberPlans[members[i].Email] = memberPlan{member: &members[i], plan: plan}
+		}
+	}
+	return memberPlans, nil
+}
+
+// updateGroupMember follows a change of a client made outside its group. A limit changed
+// to another value than the plan gives becomes the client's own, one changed back to the
+// value of the plan is inherited again.
+func (s *InboundService) updateGroupMember(tx *gorm.DB, before *model.Client, after *model.Client) error {
+	member := &model.GroupMember{}
+	err := tx.Model(model.GroupMember{}).Where("email = ?", before.Email).First(member).Error
+	if database.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	member.Email = after.Email
+	memberPlans, err := s.getMemberPlans(tx, []string{before.Email})
+	if err != nil {
+		return err
+	}
+	if memberPlan, ok := memberPlans[before.Email]; ok {
+		inherited := *after
+		applyPlan(memberPlan.plan, &model.GroupMember{}, &inherited, true)
+		if after.TotalGB != before.TotalGB {
+			member.OwnTotal = after.TotalGB != inherited.TotalGB
+		}
+		if after.ExpiryTime != before.ExpiryTime {
+			member.OwnExpiry = after.ExpiryTime != inherited.ExpiryTime
+		}
+		if after.LimitIP != before.LimitIP {
+			member.OwnLimitIP = after.LimitIP != inherited.LimitIP
+		}
+		if after.Reset != before.Reset {
+			member.OwnReset = after.Reset != inherited.Reset
+		}
+	}
+	return tx.Save(member).Error
+}
+
+// delGroupMembers takes deleted clients out of their groups.
+func (s *InboundService) delGroupMembers(tx *gorm.DB, emails ...string) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	return tx.Where("email IN ?", emails).Delete(model.GroupMember{}).Error
+}
@@ -0,0 +1,418 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// Deleted inbounds and clients are moved to the recycle bin together with their
+// traffic and IP records, and stay there for recycleBinDays before being purged.
+
+const (
+	DeletedInbound = "inbound"
+	DeletedClient  = "client"
+)
+
+// deletedInbound is the Data of a recycled inbound.
+type deletedInbound struct {
+	Inbound   model.Inbound            `json:"inbound"` // settings without clients
+	UserId    int                      `json:"userId"`
+	Clients   []model.Client           `json:"clients"`
+	Traffics  []xray.ClientTraffic     `json:"traffics"`
+	ClientIps []model.InboundClientIps `json:"clientIps"`
+
+	ScheduledActions []model.ScheduledAction `json:"scheduledActions"`
+}
+
+// deletedClient is the Data of a recycled client.
+type deletedClient struct {
+	Client    model.Client            `json:"client"`
+	Traffic   *xray.ClientTraffic     `json:"traffic"`
+	ClientIps *model.InboundClientIps `json:"clientIps"`
+
+	ScheduledActions []model.ScheduledAction `json:"scheduledActions"`
+}
+
+// RecycleBinItem is an entry of the recycle bin as listed by the API.
+type RecycleBinItem struct {
+	model.DeletedItem
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// recycleBinDays returns how long deleted items are kept, 0 when the recycle bin is off.
+func (s *InboundService) recycleBinDays() (int, error) {
+	settingService := SettingService{}
+	return settingService.GetRecycleBinDays()
+}
+
+func (s *InboundService) addDeletedItem(tx *gorm.DB, itemType string, inboundId int, name string, data any) error {
+	rawData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&model.DeletedItem{
+		Type:      itemType,
+		InboundId: inboundId,
+		Name:      name,
+		Data:      string(rawData),
+		DeletedAt: time.Now().Unix() * 1000,
+	}).Error
+}
+
+// recycleInbound copies the inbound with the given id, its clients and their records to the recycle bin.
+func (s *InboundService) recycleInbound(tx *gorm.DB, id int) error {
+	inbound, err := s.getInbound(tx, id)
+	if err != nil {
+		return err
+	}
+	days, err := s.recycleBinDays()
+	if err != nil || days == 0 {
+		return err
+	}
+	data := deletedInbound{Inbound: *inbound, UserId: inbound.UserId}
+	err = tx.Model(model.Client{}).Where("inbound_id = ?", id).Order("id").Find(&data.Clients).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(xray.ClientTraffic{}).Where("inbound_id = ?", id).Find(&data.Traffics).Error
+	if err != nil {
+		return err
+	}
+	emails := make([]string, 0, len(data.Clients))
+	for _, client := range data.Clients {
+		emails = append(emails, client.Email)
+	}
+	if len(emails) > 0 {
+		err = tx.Model(model.InboundClientIps{}).Where("client_email IN ?", emails).Find(&data.ClientIps).Error
+		if err != nil {
+			return err
+		}
+	}
+	data.ScheduledActions, err = s.getScheduledActions(tx, emails...)
+	if err != nil {
+		return err
+	}
+	return s.addDeletedItem(tx, DeletedInbound, id, inbound.Remark, data)
+}
+
+// recycleClients copies clients and their records to the recycle bin.
+func (s *InboundService) recycleClients(tx *gorm.DB, clients ...model.Client) error {
+	if len(clients) == 0 {
+		return nil
+	}
+	days, err := s.recycleBinDays()
+	if err != nil || days == 0 {
+		return err
+	}
+	for _, client := range clients {
+		data := deletedClient{Client: client}
+		var traffics []xray.ClientTraffic
+		err := tx.Model(xray.ClientTraffic{}).Where("email = ?", client.Email).Find(&traffics).Error
+		if err != nil {
+			return err
+		}
+		if len(traffics) > 0 {
+			data.Traffic = &traffics[0]
+		}
+		var clientIps []model.InboundClientIps
+		err = tx.Model(model.InboundClientIps{}).Where("client_email = ?", client.Email).Find(&clientIps).Error
+		if err != nil {
+			return err
+		}
+		if len(clientIps) > 0 {
+			data.ClientIps = &clientIps[0]
+		}
+		data.ScheduledActions, err = s.getScheduledActions(tx, client.Email)
+		if err != nil {
+			return err
+		}
+		err = s.addDeletedItem(tx, DeletedClient, client.InboundId, client.Email, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRecycleBin lists the deleted inbounds and clients, newest first.
+func (s *InboundService) GetRecycleBin() ([]RecycleBinItem, error) {
+	db := database.GetDB()
+	var deletedItems []model.DeletedItem
+	err := db.Model(model.DeletedItem{}).Omit("data").Order("deleted_at DESC").Find(&deletedItems).Error
+	if err != nil {
+		return nil, err
+	}
+	days, err := s.recycleBinDays()
+	if err != nil {
+		return nil, err
+	}
+	retention := int64(days) * int64(24*time.Hour/time.Millisecond)
+	items := make([]RecycleBinItem, 0, len(deletedItems))
+	for _, deletedItem := range deletedItems {
+		items = append(items, RecycleBinItem{
+			DeletedItem: deletedItem,
+			ExpiresAt:   deletedItem.DeletedAt + retention,
+		})
+	}
+	return items, nil
+}
+
+// RestoreDeletedItem puts a deleted inbound or client back and removes it from the recycle bin.
+func (s *InboundService) RestoreDeletedItem(id int) (bool, error) {
+	db := database.GetDB()
+	deletedItem := &model.DeletedItem{}
+	err := db.Model(model.DeletedItem{}).First(deletedItem, id).Error
+	if err != nil {
+		if database.IsNotFound(err) {
+			return false, common.NewError("Deleted item not found:", id)
+		}
+		return false, err
+	}
+
+	switch deletedItem.Type {
+	case DeletedInbound:
+		data := deletedInbound{}
+		if err := json.Unmarshal([]byte(deletedItem.Data), &data); err != nil {
+			return false, err
+		}
+		return s.restoreInbound(deletedItem, &data)
+	case DeletedClient:
+		data := deletedClient{}
+		if err := json.Unmarshal([]byte(deletedItem.Data), &data); err != nil {
+			return false, err
+		}
+		return s.restoreClient(deletedItem, &data)
+	default:
+		return false, common.NewError("unknown deleted item type:", deletedItem.Type)
+	}
+}
+
+// clearClientRecords removes traffic and IP records left behind for email, which
+// would prevent restoring a client with that email, and a group and scheduled actions
+// it was left in.
+func (s *InboundService) clearClientRecords(tx *gorm.DB, email string) error {
+	if err := s.DelClientStat(tx, email); err != nil {
+		return err
+	}
+	if err := s.delGroupMembers(tx, email); err != nil {
+		return err
+	}
+	if err := s.delScheduledActions(tx, email); err != nil {
+		return err
+	}
+	return s.DelClientIPs(tx, email)
+}
+
+// restoreScheduledActions puts back the scheduled actions of restored clients. A deletion
+// that was due has run already, it does not delete the client again.
+func (s *InboundService) restoreScheduledActions(tx *gorm.DB, actions []model.ScheduledAction) error {
+	now := time.Now().UnixMilli()
+	for i := range actions {
+		action := &actions[i]
+		action.Id = 0
+		if action.Action == BulkDelClients && action.Status == ScheduledActionPending && action.RunAt <= now {
+			action.Status = ScheduledActionDone
+		}
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(actions, 100).Error
+}
+
+func (s *InboundService) restoreInbound(deletedItem *model.DeletedItem, data *deletedInbound) (bool, error) {
+	inbound := data.Inbound
+	exist, err := s.checkPortExist(inbound.Listen, inbound.Port, 0)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		return false, common.NewError("Port already exists:", inbound.Port)
+	}
+	existEmail, err := s.checkEmailsExistForClients(data.Clients)
+	if err != nil {
+		return false, err
+	}
+	if existEmail != "" {
+		return false, common.NewError("Duplicate email:", existEmail)
+	}
+
+	db := database.GetDB()
+	var count int64
+	err = db.Model(model.Inbound{}).Where("tag = ?", inbound.Tag).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, common.NewError("Tag already exists:", inbound.Tag)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Keep the old id unless it was given to another inbound meanwhile
+		var count int64
+		err := tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			inbound.Id = 0
+		}
+		inbound.UserId = data.UserId
+		inbound.ClientStats = nil
+		if err := tx.Create(&inbound).Error; err != nil {
+			return err
+		}
+
+		for i := range data.Clients {
+			data.Clients[i].RowId = 0
+			data.Clients[i].InboundId = inbound.Id
+			if err := s.clearClientRecords(tx, data.Clients[i].Email); err != nil {
+				return err
+			}
+		}
+		if len(data.Clients) > 0 {
+			if err := tx.CreateInBatches(data.Clients, 100).Error; err != nil {
+				return err
+			}
+		}
+		for i := range data.Traffics {
+			data.Traffics[i].Id = 0
+			data.Traffics[i].InboundId = inbound.Id
+			data.Traffics[i].IdentityId = 0
+		}
+		if len(data.Traffics) > 0 {
+			if err := tx.CreateInBatches(data.Traffics, 100).Error; err != nil {
+				return err
+			}
+		}
+		for i := range data.ClientIps {
+			data.ClientIps[i].Id = 0
+		}
+		if len(data.ClientIps) > 0 {
+			if err := tx.CreateInBatches(data.ClientIps, 100).Error; err != nil {
+				return err
+			}
+		}
+		if err := s.restoreScheduledActions(tx, data.ScheduledActions); err != nil {
+			return err
+		}
+		return tx.Delete(deletedItem).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	logger.Info("Inbound restored from the recycle bin:", inbound.Tag)
+
+	// Depleted and disabled clients are left out of the running config only on restart
+	return inbound.Enable, nil
+}
+
+func (s *InboundService) restoreClient(deletedItem *model.DeletedItem, data *deletedClient) (bool, error) {
+	db := database.GetDB()
+	inbound, err := s.getInbound(db, deletedItem.InboundId)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return false, common.NewError("Inbound of the client was deleted, restore it first:", deletedItem.InboundId)
+		}
+		return false, err
+	}
+	client := data.Client
+	existEmail, err := s.checkEmailsExistForClients([]model.Client{client})
+	if err != nil {
+		return false, err
+	}
+	if existEmail != "" {
+		return false, common.NewError("Duplicate email:", existEmail)
+	}
+
+	trafficEnabled := true
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := s.clearClientRecords(tx, client.Email); err != nil {
+			return err
+		}
+		client.RowId = 0
+		client.InboundId = inbound.Id
+		if err := tx.Create(&client).Error; err != nil {
+			return err
+		}
+		if data.Traffic != nil {
+			traffic := *data.Traffic
+			traffic.Id = 0
+			traffic.InboundId = inbound.Id
+			// The identity may be gone, a restored client comes back on its own
+			traffic.IdentityId = 0
+			trafficEnabled = traffic.Enable
+			if err := tx.Create(&traffic).Error; err != nil {
+				return err
+			}
+		} else if err := s.AddClientStat(tx, inbound.Id, &client); err != nil {
+			return err
+		}
+		if data.ClientIps != nil {
+			clientIps := *data.ClientIps
+			clientIps.Id = 0
+			if err := tx.Create(&clientIps).Error; err != nil {
+				return err
+			}
+		}
+		if err := s.restoreScheduledActions(tx, data.ScheduledActions); err != nil {
+			return err
+		}
+		return tx.Delete(deletedItem).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	logger.Info("Client restored from the recycle bin:", client.Email)
+
+	needRestart := false
+	if inbound.Enable && client.Enable && trafficEnabled {
+		err1 := xrayAPI().AddUser(string(inbound.Protocol), inbound.Tag, s.xrayUser(inbound, &client))
+		if err1 == nil {
+			logger.Debug("Client added by api:", client.Email)
+		} else {
+			logger.Debug("Error in adding client by api:", err1)
+			needRestart = true
+		}
+	}
+	return needRestart, nil
+}
+
+// PurgeDeletedItem permanently removes an entry of the recycle bin.
+func (s *InboundService) PurgeDeletedItem(id int) error {
+	db := database.GetDB()
+	result := db.Delete(model.DeletedItem{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("Deleted item not found:", id)
+	}
+	return nil
+}
+
+// PurgeRecycleBin permanently removes every entry of the recycle bin.
+func (s *InboundService) PurgeRecycleBin() error {
+	db := database.GetDB()
+	return db.Where("1 = 1").Delete(model.DeletedItem{}).Error
+}
+
+// PurgeExpiredDeletedItems removes entries older than the retention period and returns their number.
+func (s *InboundService) PurgeExpiredDeletedItems() (int64, error) {
+	days, err := s.recycleBinDays()
+	if err != nil {
+		return 0, err
+	}
+	db := database.GetDB()
+	cutoff := time.Now().AddDate(0, 0, -days).Unix() * 1000
+	result := db.Where("deleted_at <= ?", cutoff).Delete(model.DeletedItem{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,276 @@
+package service
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+// Scheduled actions run the bulk client actions on a single client at a given time, like
+// enabling it on a date, disabling it for maintenance, raising its quota every month or
+// deleting it after a grace period. Due actions are run by a cron job.
+
+const (
+	ScheduledActionPending = "pending"
+	ScheduledActionDone    = "done"
+	ScheduledActionFailed  = "failed"
+)
+
+// scheduledActions are the bulk actions that may be scheduled.
+var scheduledActions = []string{
+	BulkUpdateClients,
+	BulkExtendClients,
+	BulkAddTraffic,
+	BulkEnableClients,
+	BulkDisableClients,
+	BulkDelClients,
+}
+
+type ScheduleService struct {
+	inboundService InboundService
+	settingService SettingService
+}
+
+// scheduledRequest returns the bulk request running action on its client.
+func scheduledRequest(action *model.ScheduledAction) (*ClientBulkRequest, error) {
+	req := &ClientBulkRequest{}
+	if len(action.Params) > 0 {
+		if err := json.Unmarshal(action.Params, req); err != nil {
+			return nil, common.NewError("invalid action params:", err)
+		}
+	}
+	return &ClientBulkRequest{
+		Emails:    []string{action.Email},
+		Update:    req.Update,
+		Days:      req.Days,
+		TrafficGB: req.TrafficGB,
+	}, nil
+}
+
+// nextRun returns the first time of schedule after now, in ms.
+func (s *ScheduleService) nextRun(schedule string, now time.Time) (int64, error) {
+	spec, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return 0, common.NewError("invalid schedule:", err)
+	}
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return 0, err
+	}
+	return spec.Next(now.In(loc)).UnixMilli(), nil
+}
+
+func (s *ScheduleService) checkAction(action *model.ScheduledAction) error {
+	action.Email = strings.TrimSpace(action.Email)
+	if action.Email == "" {
+		return common.NewError("empty client email")
+	}
+	if !slices.Contains(scheduledActions, action.Action) {
+		return common.NewError("unknown scheduled action:", action.Action)
+	}
+	req, err := scheduledRequest(action)
+	if err != nil {
+		return err
+	}
+	if _, err := bulkChange(action.Action, req); err != nil {
+		return err
+	}
+	action.Schedule = strings.TrimSpace(action.Schedule)
+	if action.Schedule != "" {
+		if action.Action == BulkDelClients {
+			return common.NewError("a deletion cannot be repeated")
+		}
+		next, err := s.nextRun(action.Schedule, time.Now())
+		if err != nil {
+			return err
+		}
+		if action.RunAt == 0 {
+			action.RunAt = next
+		}
+	}
+	if action.RunAt <= 0 {
+		return common.NewError("runAt or schedule required")
+	}
+	return nil
+}
+
+func (s *ScheduleService) getAction(tx *gorm.DB, id int) (*model.ScheduledAction, error) {
+	action := &model.ScheduledAction{}
+	err := tx.Model(model.ScheduledAction{}).First(action, id).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("Scheduled action not found:", id)
+	}
+	return action, err
+}
+
+// GetActions lists the scheduled actions of the client with email, or of every client
+// when email is empty, in the order they run.
+func (s *ScheduleService) GetActions(email string) ([]model.ScheduledAction, error) {
+	db := database.GetDB()
+	query := db.Model(model.ScheduledAction{})
+	if email != "" {
+		query = query.Where("email = ?", email)
+	}
+	var actions []model.ScheduledAction
+	err := query.Order("run_at, id").Find(&actions).Error
+	return actions, err
+}
+
+// AddAction schedules an action.
+func (s *ScheduleService) AddAction(action *model.ScheduledAction) error {
+	action.Id = 0
+	if err := s.checkAction(action); err != nil {
+		return err
+	}
+	action.Status = ScheduledActionPending
+	action.LastRunAt = 0
+	action.Result = ""
+	return database.GetDB().Create(action).Error
+}
+
+// UpdateAction changes a scheduled action, which is pending again afterwards.
+func (s *ScheduleService) UpdateAction(action *model.ScheduledAction) error {
+	db := database.GetDB()
+	oldAction, err := s.getAction(db, action.Id)
+	if err != nil {
+		return err
+	}
+	if err := s.checkAction(action); err != nil {
+		return err
+	}
+	action.Status = ScheduledActionPending
+	action.LastRunAt = oldAction.LastRunAt
+	action.Result = oldAction.Result
+	return db.Save(action).Error
+}
+
+// DelAction cancels a scheduled action.
+func (s *ScheduleService) DelAction(id int) error {
+	result := database.GetDB().Delete(model.ScheduledAction{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("Scheduled action not found:", id)
+	}
+	return nil
+}
+
+// runAction runs action and returns why it failed, if it did, and whether the
+// client changed.
+func (s *ScheduleService) runAction(action *model.ScheduledAction) (string, bool) {
+	req, err := scheduledRequest(action)
+	if err != nil {
+		return err.Error(), false
+	}
+	results, changed, err := s.inboundService.BulkClients(action.Action, req)
+	if err != nil {
+		return err.Error(), false
+	}
+	if len(results) == 0 {
+		return "Client Not Found For Email: " + action.Email, false
+	}
+	if !results[0].Success {
+		return results[0].Msg, false
+	}
+	return "", changed
+}
+
+// RunDueActions runs the pending actions whose time has come and returns them as they are
+// afterwards, along with whether any client changed. An action missed while the panel was
+// down runs once, a repeated one is then scheduled for its next time after now. An action
+// whose client is gone is marked failed and left out of the result.
+func (s *ScheduleService) RunDueActions(now time.Time) ([]model.ScheduledAction, bool, error) {
+	db := database.GetDB()
+	var actions []model.ScheduledAction
+	err := db.Model(model.ScheduledAction{}).
+		Where("status = ? AND run_at <= ?", ScheduledActionPending, now.UnixMilli()).
+		Order("run_at, id").Find(&actions).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	ran := make([]model.ScheduledAction, 0, len(actions))
+	anyChanged := false
+	for i := range actions {
+		action := &actions[i]
+		var count int64
+		err = db.Model(model.Client{}).Where("email = ?", action.Email).Count(&count).Error
+		if err != nil {
+			return ran, anyChanged, err
+		}
+		if count == 0 {
+			logger.Debugf("Scheduled %s of %s skipped, the client is gone", action.Action, action.Email)
+			err = db.Model(action).Updates(map[string]any{
+				"status": ScheduledActionFailed,
+				"result": "Client Not Found For Email: " + action.Email,
+			}).Error
+			if err != nil {
+				return ran, anyChanged, err
+			}
+			continue
+		}
+		result, changed := s.runAction(action)
+		anyChanged = anyChanged || changed
+		action.LastRunAt = now.UnixMilli()
+		action.Result = result
+		switch {
+		case action.Schedule != "":
+			action.RunAt, err = s.nextRun(action.Schedule, now)
+			if err != nil {
+				action.Status = ScheduledActionFailed
+				action.Result = err.Error()
+			}
+		case result == "":
+			action.Status = ScheduledActionDone
+		default:
+			action.Status = ScheduledActionFailed
+		}
+		if result == "" {
+			logger.Infof("Scheduled %s of %s done", action.Action, action.Email)
+		} else {
+			logger.Warningf("Scheduled %s of %s failed: %s", action.Action, action.Email, result)
+		}
+		ran = append(ran, *action)
+		err = db.Model(action).Select("run_at", "status", "last_run_at", "result").Updates(action).Error
+		if err != nil {
+			return ran, anyChanged, err
+		}
+	}
+	return ran, anyChanged, nil
+}
+
+// getScheduledActions returns the scheduled actions of the clients with emails.
+func (s *InboundService) getScheduledActions(tx *gorm.DB, emails ...string) ([]model.ScheduledAction, error) {
+	var actions []model.ScheduledAction
+	if len(emails) == 0 {
+		return actions, nil
+	}
+	err := tx.Model(model.ScheduledAction{}).Where("email IN ?", emails).Order("id").Find(&actions).Error
+	return actions, err
+}
+
+// delScheduledActions cancels the scheduled actions of deleted clients.
+func (s *InboundService) delScheduledActions(tx *gorm.DB, emails ...string) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	return tx.Where("email IN ?", emails).Delete(model.ScheduledAction{}).Error
+}
+
+// renameScheduledActions moves the scheduled actions of a client to its new email.
+func (s *InboundService) renameScheduledActions(tx *gorm.DB, oldEmail string, newEmail string) error {
+	if oldEmail == newEmail {
+		return nil
+	}
+	return tx.Model(model.ScheduledAction{}).Where("email = ?", oldEmail).Update("email", newEmail).Error
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+
+	"gorm.io/gorm"
+)
+
+// secretSettings lists the settings stored encrypted, see saveSetting and getString.
+var secretSettings = map[string]bool{
+	"secret":         true,
+	"tgBotToken":     true,
+	"twoFactorToken": true,
+	"dbPassword":     true,
+	"warp":           true,
+}
+
+var (
+	secretKeyLock    sync.Mutex
+	secretKey        []byte
+	secretKeyModTime time.Time // of the key file secretKey was read from
+)
+
+// SecretKeySource describes where the key encrypting secret settings comes from.
+func SecretKeySource() string {
+	if os.Getenv("XUI_SECRET_KEY") != "" {
+		return "environment variable XUI_SECRET_KEY"
+	}
+	return config.GetSecretKeyPath()
+}
+
+// loadSecretKey reads the key from XUI_SECRET_KEY or from the key file, creating the file if
+// neither exists yet. Keys are stored base64 encoded.
+func loadSecretKey() ([]byte, error) {
+	encoded := os.Getenv("XUI_SECRET_KEY")
+	if encoded == "" {
+		data, err := os.ReadFile(config.GetSecretKeyPath())
+		if os.IsNotExist(err) {
+			key, err := crypto.GenerateKey()
+			if err != nil {
+				return nil, err
+			}
+			if err := writeSecretKey(config.GetSecretKeyPath(), key); err != nil {
+				return nil, err
+			}
+			logger.Info("Generated a new secret key in", config.GetSecretKeyPath())
+			return key, nil
+		} else if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key in %s: %w", SecretKeySource(), err)
+	}
+	if len(key) != crypto.KeySize {
+		return nil, fmt.Errorf("invalid secret key in %s: want %d bytes, got %d", SecretKeySource(), crypto.KeySize, len(key))
+	}
+	return key, nil
+}
+
+// writeSecretKey atomically replaces the key file at path, readable by the owner only.
+func writeSecretKey(path string, key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// secretKeyFileModTime returns when the key file was last changed, zero when the key
+// does not come from a file.
+func secretKeyFileModTime() time.Time {
+	if os.Getenv("XUI_SECRET_KEY") != "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(config.GetSecretKeyPath())
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// getSecretKey returns the current key. The key is read again when reload is set or
+// when the key file changed, which picks up a key rotated by another process.
+func getSecretKey(reload bool) ([]byte, error) {
+	secretKeyLock.Lock()
+	defer secretKeyLock.Unlock()
+	modTime := secretKeyFileModTime()
+	if secretKey == nil || reload || !modTime.Equal(secretKeyModTime) {
+		key, err := loadSecretKey()
+		if err != nil {
+			return nil, err
+		}
+		secretKey = key
+		secretKeyModTime = secretKeyFileModTime()
+	}
+	return secretKey, nil
+}
+
+// encryptSetting returns the value to store for setting key.
+func encryptSetting(key string, value string) (string, error) {
+	if !secretSettings[key] || value == "" {
+		return value, nil
+	}
+	// A value sealed with the old key while another process rotates it would be lost
+	pendingPath := config.GetSecretKeyPath() + ".new"
+	if _, err := os.Stat(pendingPath); err == nil {
+		return "", common.NewErrorf("the secret key is being rotated (%s exists), try again in a moment", pendingPath)
+	}
+	secretKey, err := getSecretKey(false)
+	if err != nil {
+		return "", err
+	}
+	return crypto.Seal(secretKey, value)
+}
+
+// decryptSetting returns the plain value of a stored setting. Values saved before
+// encryption was introduced are returned as they are.
+func decryptSetting(key string, value string) (string, error) {
+	if !secretSettings[key] || !crypto.IsSealed(value) {
+		return value, nil
+	}
+	secretKey, err := getSecretKey(false)
+	if err != nil {
+		return "", err
+	}
+	plain, err := crypto.Open(secretKey, value)
+	if errors.Is(err, crypto.ErrWrongKey) {
+		if secretKey, err = getSecretKey(true); err == nil {
+			plain, err = crypto.Open(secretKey, value)
+		}
+	}
+	if errors.Is(err, crypto.ErrWrongKey) {
+		return "", common.NewErrorf("decrypt setting <%v>: it was encrypted with another key than the one in %s, "+
+			"restore the key kept with the backup of this database", key, SecretKeySource())
+	}
+	if err != nil {
+		return "", common.NewErrorf("decrypt setting <%v>: %v", key, err)
+	}
+	return plain, nil
+}
+
+// checkSecretSettings makes sure every secret setting among settings can be decrypted
+// with the current key.
+func checkSecretSettings(settings []*model.Setting) error {
+	for _, setting := range settings {
+		if _, err := decryptSetting(setting.Key, setting.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSecretSettings returns the stored rows of every secret setting.
+func getSecretSettings(tx *gorm.DB) ([]*model.Setting, error) {
+	keys := make([]string, 0, len(secretSettings))
+	for key := range secretSettings {
+		keys = append(keys, key)
+	}
+	settings := make([]*model.Setting, 0, len(keys))
+	err := tx.Model(model.Setting{}).Where(map[string]any{"key": keys}).Find(&settings).Error
+	return settings, err
+}
+
+// EncryptSecrets encrypts secret settings still stored as plain text.
+func (s *SettingService) EncryptSecrets() error {
+	db := database.GetDB()
+	settings, err := getSecretSettings(db)
+	if err != nil {
+		return err
+	}
+	for _, setting := range settings {
+		if setting.Value == "" || crypto.IsSealed(setting.Value) {
+			continue
+		}
+		setting.Value, err = encryptSetting(setting.Key, setting.Value)
+		if err != nil {
+			return err
+		}
+		if err := db.Save(setting).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateSecretKey re-encrypts every secret setting with a new key and returns it along with
+// the number of settings encrypted. The new key replaces the key file; a key given by
+// XUI_SECRET_KEY cannot be replaced, so the caller has to show it to the user.
+func (s *SettingService) RotateSecretKey() ([]byte, int, error) {
+	oldKey, err := getSecretKey(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	newKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Keep the new key on disk before any row depends on it, so a failure half way
+	// never leaves settings nobody can decrypt
+	fromFile := os.Getenv("XUI_SECRET_KEY") == ""
+	pendingPath := config.GetSecretKeyPath() + ".new"
+	if fromFile {
+		if err := writeSecretKey(pendingPath, newKey); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	count := 0
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		settings, err := getSecretSettings(tx)
+		if err != nil {
+			return err
+		}
+		for _, setting := range settings {
+			if setting.Value == "" {
+				continue
+			}
+			value := setting.Value
+			if crypto.IsSealed(value) {
+				value, err = crypto.Open(oldKey, value)
+				if err != nil {
+					return common.NewErrorf("decrypt setting <%v>: %v", setting.Key, err)
+				}
+			}
+			setting.Value, err = crypto.Seal(newKey, value)
+			if err != nil {
+				return err
+			}
+			if err := tx.Save(setting).Error; err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		if fromFile {
+			os.Remove(pendingPath)
+		}
+		return nil, 0, err
+	}
+
+	if fromFile {
+		if err := os.Rename(pendingPath, config.GetSecretKeyPath()); err != nil {
+			return nil, 0, fmt.Errorf("settings were encrypted with the key in %s, but it could not replace the old key: %w", pendingPath, err)
+		}
+	}
+	secretKeyLock.Lock()
+	secretKey = newKey
+	secretKeyModTime = secretKeyFileModTime()
+	secretKeyLock.Unlock()
+	return newKey, count, nil
+}
@@ -3,10 +3,11 @@ package service
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/fs"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -18,6 +19,7 @@ import (
 
 	"x-ui/config"
 	"x-ui/database"
+	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/util/common"
 	"x-ui/util/sys"
@@ -58,9 +60,10 @@ type Status struct {
 		Total   uint64 `json:"total"`
 	} `json:"disk"`
 	Xray struct {
-		State    ProcessState `json:"state"`
-		ErrorMsg string       `json:"errorMsg"`
-		Version  string       `json:"version"`
+		State        ProcessState `json:"state"`
+		ErrorMsg     string       `json:"errorMsg"`
+		Version      string       `json:"version"`
+		APIConnected bool         `json:"apiConnected"`
 	} `json:"xray"`
 	Uptime   uint64    `json:"uptime"`
 	Loads    []float64 `json:"loads"`
@@ -83,17 +86,35 @@ type Status struct {
 		Mem     uint64 `json:"mem"`
 		Uptime  uint64 `json:"uptime"`
 	} `json:"appStats"`
+	Database database.DBStatus `json:"database"`
 }
 
 type Release struct {
-	TagName string `json:"tag_name"`
+	TagName string         `json:"tag_name"`
+	Assets  []ReleaseAsset `json:"assets"`
+}
+
+// ReleaseAsset is a file of a GitHub release. GitHub fills Digest, like "sha256:<hex>",
+// for assets uploaded since mid 2025.
+type ReleaseAsset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+	Digest             string `json:"digest"`
+}
+
+func (r *Release) findAsset(name string) *ReleaseAsset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
 }
 
 type ServerService struct {
-	xrayService    XrayService
-	inboundService InboundService
-	cachedIPv4     string
-	cachedIPv6     string
+	xrayService XrayService
+	cachedIPv4  string
+	cachedIPv6  string
 }
 
 func getPublicIP(url string) string {
@@ -232,6 +253,7 @@ func (s *ServerService) GetStatus(lastStatus *Status) *Status {
 	if s.xrayService.IsXrayRunning() {
 		status.Xray.State = Running
 		status.Xray.ErrorMsg = ""
+		status.Xray.APIConnected = s.xrayService.IsXrayAPIConnected()
 	} else {
 		err := s.xrayService.GetXrayErr()
 		if err != nil {
@@ -254,6 +276,9 @@ func (s *ServerService) GetStatus(lastStatus *Status) *Status {
 		status.AppStats.Uptime = 0
 	}
 
+	// Database health
+	status.Database = database.GetDBStatus()
+
 	return status
 }
 
@@ -312,7 +337,7 @@ func (s *ServerService) StopXrayService() error {
 }
 
 func (s *ServerService) RestartXrayService() error {
-	s.xrayService.StopXray()
+	// RestartXray stops the running Xray only once the new config passed its test
 	err := s.xrayService.RestartXray(true)
 	if err != nil {
 		logger.Error("start xray failed:", err)
@@ -348,29 +373,125 @@ func (s *ServerService) downloadXRay(version string) (string, error) {
 	}
 
 	fileName := fmt.Sprintf("Xray-%s-%s.zip", osName, arch)
-	url := fmt.Sprintf("https://github.com/XTLS/Xray-core/releases/download/%s/%s", version, fileName)
-	resp, err := http.Get(url)
+	release, err := s.getXrayRelease(version)
+	if err != nil {
+		return "", err
+	}
+	asset := release.findAsset(fileName)
+	if asset == nil {
+		return "", common.NewErrorf("Xray %s has no %s", version, fileName)
+	}
+
+	resp, err := http.Get(asset.BrowserDownloadURL)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", common.NewErrorf("Failed to download %s: %s", fileName, resp.Status)
+	}
 
-	os.Remove(fileName)
-	file, err := os.Create(fileName)
+	file, err := os.CreateTemp(config.GetBinFolderPath(), "xray-*.zip")
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	if err == nil {
+		err = s.verifyXrayDownload(release, asset, hex.EncodeToString(hash.Sum(nil)))
+	}
 	if err != nil {
+		os.Remove(file.Name())
 		return "", err
 	}
 
-	return fileName, nil
+	return file.Name(), nil
 }
 
+func (s *ServerService) getXrayRelease(version string) (*Release, error) {
+	resp, err := http.Get("https://api.github.com/repos/XTLS/Xray-core/releases/tags/" + version)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, common.NewErrorf("Failed to get Xray release %s: %s", version, resp.Status)
+	}
+	release := &Release{}
+	if err := json.NewDecoder(resp.Body).Decode(release); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// verifyXrayDownload checks the SHA256 of a downloaded asset against the digest GitHub
+// keeps for it and against the .dgst file published with it. At least one of them has
+// to exist, and each one that exists has to match.
+func (s *ServerService) verifyXrayDownload(release *Release, asset *ReleaseAsset, sum string) error {
+	verified := false
+	if digest, ok := strings.CutPrefix(asset.Digest, "sha256:"); ok {
+		if !strings.EqualFold(digest, sum) {
+			return common.NewErrorf("SHA256 of %s does not match the release: %s, expected %s", asset.Name, sum, digest)
+		}
+		verified = true
+	}
+	if dgst := release.findAsset(asset.Name + ".dgst"); dgst != nil {
+		digest, err := s.getDgstSHA256(dgst.BrowserDownloadURL)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(digest, sum) {
+			return common.NewErrorf("SHA256 of %s does not match %s: %s, expected %s", asset.Name, dgst.Name, sum, digest)
+		}
+		verified = true
+	}
+	if !verified {
+		return common.NewErrorf("No checksum published for %s", asset.Name)
+	}
+	return nil
+}
+
+// getDgstSHA256 reads the SHA256 from a .dgst file, which lists one "ALGORITHM= hex" per line.
+func (s *ServerService) getDgstSHA256(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", common.NewErrorf("Failed to download %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		algorithm, digest, ok := strings.Cut(line, "=")
+		algorithm = strings.TrimSpace(algorithm)
+		if ok && (algorithm == "SHA2-256" || algorithm == "SHA256") {
+			return strings.TrimSpace(digest), nil
+		}
+	}
+	return "", common.NewErrorf("No SHA256 in %s", url)
+}
+
+// UpdateXray switches Xray to version, downloading and verifying it first unless it is
+// kept already.
 func (s *ServerService) UpdateXray(version string) error {
+	if !xray.IsValidVersion(version) {
+		return common.NewError("invalid xray version:", version)
+	}
+	if !xray.IsVersionInstalled(version) {
+		if err := s.installXrayVersion(version); err != nil {
+			return err
+		}
+	}
+	return s.switchXray(version)
+}
+
+func (s *ServerService) installXrayVersion(version string) error {
 	zipFileName, err := s.downloadXRay(version)
 	if err != nil {
 		return err
@@ -393,36 +514,59 @@ func (s *ServerService) UpdateXray(version string) error {
 	if err != nil {
 		return err
 	}
+	binary, err := reader.Open("xray")
+	if err != nil {
+		return err
+	}
+	defer binary.Close()
+	return xray.AddVersion(version, binary)
+}
 
-	s.xrayService.StopXray()
-	defer func() {
-		err := s.xrayService.RestartXray(true)
-		if err != nil {
-			logger.Error("start xray failed:", err)
-		}
-	}()
-
-	copyZipFile := func(zipName string, fileName string) error {
-		zipFile, err := reader.Open(zipName)
-		if err != nil {
-			return err
-		}
-		os.Remove(fileName)
-		file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, fs.ModePerm)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		_, err = io.Copy(file, zipFile)
+// switchXray makes version the binary and restarts Xray with it. When the config does not
+// pass the test of the new version, or Xray does not start, the version before is put back.
+func (s *ServerService) switchXray(version string) error {
+	previous := xray.GetCurrentVersion()
+	if err := xray.SwitchVersion(version); err != nil {
 		return err
 	}
+	xrayConfig, err := s.xrayService.GetXrayConfig()
+	if err == nil {
+		err = xray.ValidateConfig(xrayConfig)
+	}
+	if err == nil {
+		err = s.xrayService.RestartXray(true)
+	}
+	if err == nil {
+		logger.Info("Xray switched to", version)
+		return nil
+	}
+	logger.Error("start xray failed:", err)
 
-	err = copyZipFile("xray", xray.GetBinaryPath())
-	if err != nil {
+	if previous == "" || previous == version {
+		return err
+	}
+	if err1 := xray.SwitchVersion(previous); err1 != nil {
+		logger.Error("switching xray back failed:", err1)
 		return err
 	}
+	if err1 := s.xrayService.RestartXray(true); err1 != nil {
+		logger.Error("start xray failed:", err1)
+	}
+	return common.NewErrorf("Xray %s failed, switched back to %s: %v", version, previous, err)
+}
 
-	return nil
+// RollbackXray switches Xray back to the version used before the last switch and returns it.
+func (s *ServerService) RollbackXray() (string, error) {
+	previous := xray.GetPreviousVersion()
+	if previous == "" {
+		return "", common.NewError("no previous xray version to roll back to")
+	}
+	return previous, s.switchXray(previous)
+}
+
+// GetInstalledXrayVersions lists the versions of Xray kept to switch between, newest first.
+func (s *ServerService) GetInstalledXrayVersions() ([]xray.InstalledVersion, error) {
+	return xray.GetInstalledVersions()
 }
 
 func (s *ServerService) GetLogs(count string, level string, syslog string) []string {
@@ -447,6 +591,15 @@ func (s *ServerService) GetLogs(count string, level string, syslog string) []str
 	return lines
 }
 
+// GetCrashReports lists the reports written when Xray crashed, newest first.
+func (s *ServerService) GetCrashReports() ([]xray.CrashReport, error) {
+	return xray.GetCrashReports()
+}
+
+func (s *ServerService) GetCrashReport(name string) (string, error) {
+	return xray.ReadCrashReport(name)
+}
+
 func (s *ServerService) GetConfigJson() (any, error) {
 	config, err := s.xrayService.GetXrayConfig()
 	if err != nil {
@@ -467,6 +620,9 @@ func (s *ServerService) GetConfigJson() (any, error) {
 }
 
 func (s *ServerService) GetDb() ([]byte, error) {
+	if database.GetDialect() != config.DatabaseTypeSQLite {
+		return nil, common.NewError("Raw database file is only available for SQLite, use a dump instead")
+	}
 	// Update by manually trigger a checkpoint operation
 	err := database.Checkpoint()
 	if err != nil {
@@ -488,13 +644,37 @@ func (s *ServerService) GetDb() ([]byte, error) {
 	return fileContents, nil
 }
 
+// GetDbDump returns a portable JSON dump of the panel database, whatever its backend.
+func (s *ServerService) GetDbDump() ([]byte, error) {
+	dump, err := database.ExportDump(database.GetDB())
+	if err != nil {
+		return nil, err
+	}
+	return dump.Marshal()
+}
+
+// GetDbBackup returns the best backup for the current backend together with its file name:
+// the database file itself on SQLite, a portable dump otherwise.
+func (s *ServerService) GetDbBackup() ([]byte, string, error) {
+	if database.GetDialect() == config.DatabaseTypeSQLite {
+		data, err := s.GetDb()
+		return data, "x-ui.db", err
+	}
+	data, err := s.GetDbDump()
+	return data, "x-ui.json", err
+}
+
 func (s *ServerService) ImportDB(file multipart.File) error {
-	// Check if the file is a SQLite database
-	isValidDb, err := database.IsSQLiteDB(file)
+	// Check if the file is a SQLite database or a portable dump
+	isSQLiteDb, err := database.IsSQLiteDB(file)
+	if err != nil {
+		return common.NewErrorf("Error checking db file format: %v", err)
+	}
+	isDump, err := database.IsDump(file)
 	if err != nil {
 		return common.NewErrorf("Error checking db file format: %v", err)
 	}
-	if !isValidDb {
+	if !isSQLiteDb && !isDump {
 		return common.NewError("Invalid db file format")
 	}
 
@@ -504,6 +684,31 @@ func (s *ServerService) ImportDB(file multipart.File) error {
 		return common.NewErrorf("Error resetting file reader: %v", err)
 	}
 
+	if isDump {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return common.NewErrorf("Error reading dump: %v", err)
+		}
+		dump, err := database.ParseDump(data)
+		if err != nil {
+			return common.NewErrorf("Error checking dump: %v", err)
+		}
+		if err := checkSecretSettings(dumpSettings(dump)); err != nil {
+			return common.NewErrorf("Error checking dump: %v", err)
+		}
+		return s.importDump(dump)
+	}
+	if database.GetDialect() != config.DatabaseTypeSQLite {
+		dump, err := s.dumpSQLiteFile(file)
+		if err != nil {
+			return err
+		}
+		if err := checkSecretSettings(dumpSettings(dump)); err != nil {
+			return common.NewErrorf("Error checking db: %v", err)
+		}
+		return s.importDump(dump)
+	}
+
 	// Save the file as a temporary file
 	tempPath := fmt.Sprintf("%s.temp", config.GetDBPath())
 
@@ -539,8 +744,11 @@ func (s *ServerService) ImportDB(file multipart.File) error {
 		return common.NewErrorf("Error saving db: %v", err)
 	}
 
-	// Check if we can init the db or not
-	if err = database.InitDB(tempPath); err != nil {
+	// Check the upload on its own connection, the panel keeps its db until the file is in place
+	if err = database.CheckSQLiteFile(tempPath); err != nil {
+		return common.NewErrorf("Error checking db: %v", err)
+	}
+	if err = checkSQLiteSecrets(tempPath); err != nil {
 		return common.NewErrorf("Error checking db: %v", err)
 	}
 
@@ -585,11 +793,12 @@ func (s *ServerService) ImportDB(file multipart.File) error {
 		if errRename := os.Rename(fallbackPath, config.GetDBPath()); errRename != nil {
 			return common.NewErrorf("Error migrating db and restoring fallback: %v", errRename)
 		}
+		if errInit := database.InitDB(config.GetDBPath()); errInit != nil {
+			return common.NewErrorf("Error migrating db and reopening fallback: %v", errInit)
+		}
 		return common.NewErrorf("Error migrating db: %v", err)
 	}
 
-	s.inboundService.MigrateDB()
-
 	// Start Xray
 	if err = s.RestartXrayService(); err != nil {
 		return common.NewErrorf("Imported DB but failed to start Xray: %v", err)
@@ -598,6 +807,92 @@ func (s *ServerService) ImportDB(file multipart.File) error {
 	return nil
 }
 
+// dumpSettings returns the rows of the settings table of dump.
+func dumpSettings(dump *database.Dump) []*model.Setting {
+	records := dump.Tables["settings"]
+	settings := make([]*model.Setting, 0, len(records))
+	for _, record := range records {
+		key, _ := record["key"].(string)
+		value, _ := record["value"].(string)
+		settings = append(settings, &model.Setting{Key: key, Value: value})
+	}
+	return settings
+}
+
+// checkSQLiteSecrets makes sure the secret settings of the SQLite database at path can be
+// decrypted, a database restored without its key would leave the panel unable to start.
+func checkSQLiteSecrets(path string) error {
+	sqliteConfig := config.GetDefaultDatabaseConfig()
+	sqliteConfig.SQLite.Path = path
+	conn, err := database.OpenDB(sqliteConfig)
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := conn.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	settings, err := getSecretSettings(conn)
+	if err != nil {
+		return err
+	}
+	return checkSecretSettings(settings)
+}
+
+// dumpSQLiteFile converts an uploaded SQLite database into a dump so it can be restored into another backend.
+func (s *ServerService) dumpSQLiteFile(file multipart.File) (*database.Dump, error) {
+	tempFile, err := os.CreateTemp("", "x-ui-import-*.db")
+	if err != nil {
+		return nil, common.NewErrorf("Error creating temporary db file: %v", err)
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	_, err = io.Copy(tempFile, file)
+	tempFile.Close()
+	if err != nil {
+		return nil, common.NewErrorf("Error saving db: %v", err)
+	}
+
+	sqliteConfig := config.GetDefaultDatabaseConfig()
+	sqliteConfig.SQLite.Path = tempPath
+	sourceDB, err := database.OpenDB(sqliteConfig)
+	if err != nil {
+		return nil, common.NewErrorf("Error opening db: %v", err)
+	}
+	if sqlDB, err := sourceDB.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	// Bring an older database up to date before reading it
+	if err := database.ApplyMigrations(sourceDB); err != nil {
+		return nil, common.NewErrorf("Error migrating db: %v", err)
+	}
+
+	dump, err := database.ExportDump(sourceDB)
+	if err != nil {
+		return nil, common.NewErrorf("Error reading db: %v", err)
+	}
+	return dump, nil
+}
+
+// importDump restores a dump into the current database. The import runs in one
+// transaction, so the current data stays in place when anything goes wrong.
+func (s *ServerService) importDump(dump *database.Dump) error {
+	// Stop Xray
+	s.StopXrayService()
+
+	if err := database.ImportDump(database.GetDB(), dump); err != nil {
+		return common.NewErrorf("Error importing dump, current db kept: %v", err)
+	}
+
+	// Start Xray
+	if err := s.RestartXrayService(); err != nil {
+		return common.NewErrorf("Imported DB but failed to start Xray: %v", err)
+	}
+
+	return nil
+}
+
 func (s *ServerService) UpdateGeofile(fileName string) error {
 	files := []struct {
 		URL      string
@@ -659,27 +954,42 @@ func (s *ServerService) UpdateGeofile(fileName string) error {
 }
 
 func (s *ServerService) GetNewX25519Cert() (any, error) {
+	privateKey, publicKey, err := newX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair := map[string]any{
+		"privateKey": privateKey,
+		"publicKey":  publicKey,
+	}
+
+	return keyPair, nil
+}
+
+// newX25519KeyPair generates a key pair for Reality with the x25519 command of Xray.
+func newX25519KeyPair() (string, string, error) {
 	// Run the command
 	cmd := exec.Command(xray.GetBinaryPath(), "x25519")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
 
 	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 2 {
+		return "", "", common.NewError("unexpected output of xray x25519:", out.String())
+	}
 
 	privateKeyLine := strings.Split(lines[0], ":")
 	publicKeyLine := strings.Split(lines[1], ":")
+	if len(privateKeyLine) < 2 || len(publicKeyLine) < 2 {
+		return "", "", common.NewError("unexpected output of xray x25519:", out.String())
+	}
 
 	privateKey := strings.TrimSpace(privateKeyLine[1])
 	publicKey := strings.TrimSpace(publicKeyLine[1])
-
-	keyPair := map[string]any{
-		"privateKey": privateKey,
-		"publicKey":  publicKey,
-	}
-
-	return keyPair, nil
+	return privateKey, publicKey, nil
 }
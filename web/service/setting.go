@@ -35,6 +35,8 @@ var defaultValueMap = map[string]string{
 	"webBasePath":                 "/",
 	"sessionMaxAge":               "60",
 	"pageSize":                    "50",
+	"recycleBinDays":              "30",
+	"xrayReloadGrace":             "30",
 	"expireDiff":                  "0",
 	"trafficDiff":                 "0",
 	"remarkModel":                 "-ieo",
@@ -81,6 +83,8 @@ var defaultValueMap = map[string]string{
 	"dbPassword":                  "",
 	"dbSSLMode":                   "disable",
 	"dbTimeZone":                  "UTC",
+	"dbCharset":                   "utf8mb4",
+	"dbTLS":                       "false",
 }
 
 type SettingService struct{}
@@ -97,7 +101,7 @@ func (s *SettingService) GetDefaultJsonConfig() (any, error) {
 func (s *SettingService) GetAllSetting() (*entity.AllSetting, error) {
 	db := database.GetDB()
 	settings := make([]*model.Setting, 0)
-	err := db.Model(model.Setting{}).Not("key = ?", "xrayTemplateConfig").Find(&settings).Error
+	err := db.Model(model.Setting{}).Not(map[string]any{"key": "xrayTemplateConfig"}).Find(&settings).Error
 	if err != nil {
 		return nil, err
 	}
@@ -149,7 +153,11 @@ func (s *SettingService) GetAllSetting() (*entity.AllSetting, error) {
 
 	keyMap := map[string]bool{}
 	for _, setting := range settings {
-		err := setSetting(setting.Key, setting.Value)
+		value, err := decryptSetting(setting.Key, setting.Value)
+		if err != nil {
+			return nil, err
+		}
+		err = setSetting(setting.Key, value)
 		if err != nil {
 			return nil, err
 		}
@@ -182,7 +190,8 @@ func (s *SettingService) ResetSettings() error {
 func (s *SettingService) getSetting(key string) (*model.Setting, error) {
 	db := database.GetDB()
 	setting := &model.Setting{}
-	err := db.Model(model.Setting{}).Where("key = ?", key).First(setting).Error
+	// key is a reserved word in MySQL, a map condition lets gorm quote it
+	err := db.Model(model.Setting{}).Where(map[string]any{"key": key}).First(setting).Error
 	if err != nil {
 		return nil, err
 	}
@@ -190,6 +199,10 @@ func (s *SettingService) getSetting(key string) (*model.Setting, error) {
 }
 
 func (s *SettingService) saveSetting(key string, value string) error {
+	value, err := encryptSetting(key, value)
+	if err != nil {
+		return err
+	}
 	setting, err := s.getSetting(key)
 	db := database.GetDB()
 	if database.IsNotFound(err) {
@@ -216,7 +229,7 @@ func (s *SettingService) getString(key string) (string, error) {
 	} else if err != nil {
 		return "", err
 	}
-	return setting.Value, nil
+	return decryptSetting(key, setting.Value)
 }
 
 func (s *SettingService) setString(key string, value string) error {
@@ -476,6 +489,14 @@ func (s *SettingService) GetPageSize() (int, error) {
 	return s.getInt("pageSize")
 }
 
+func (s *SettingService) GetRecycleBinDays() (int, error) {
+	return s.getInt("recycleBinDays")
+}
+
+func (s *SettingService) GetXrayReloadGrace() (int, error) {
+	return s.getInt("xrayReloadGrace")
+}
+
 func (s *SettingService) GetSubURI() (string, error) {
 	return s.getString("subURI")
 }
@@ -593,6 +614,22 @@ func (s *SettingService) SetDbTimeZone(timeZone string) error {
 	return s.setString("dbTimeZone", timeZone)
 }
 
+func (s *SettingService) GetDbCharset() (string, error) {
+	return s.getString("dbCharset")
+}
+
+func (s *SettingService) SetDbCharset(charset string) error {
+	return s.setString("dbCharset", charset)
+}
+
+func (s *SettingService) GetDbTLS() (string, error) {
+	return s.getString("dbTLS")
+}
+
+func (s *SettingService) SetDbTLS(tls string) error {
+	return s.setString("dbTLS", tls)
+}
+
 // GetDatabaseConfig returns database configuration from settings
 func (s *SettingService) GetDatabaseConfig() (*config.DatabaseConfig, error) {
 	dbType, err := s.GetDbType()
@@ -604,7 +641,7 @@ func (s *SettingService) GetDatabaseConfig() (*config.DatabaseConfig, error) {
 		Type: config.DatabaseType(dbType),
 	}
 
-	if dbConfig.Type == config.DatabaseTypePostgreSQL {
+	if dbConfig.Type == config.DatabaseTypePostgreSQL || dbConfig.Type == config.DatabaseTypeMySQL {
 		host, err := s.GetDbHost()
 		if err != nil {
 			return nil, err
@@ -625,23 +662,46 @@ func (s *SettingService) GetDatabaseConfig() (*config.DatabaseConfig, error) {
 		if err != nil {
 			return nil, err
 		}
-		sslMode, err := s.GetDbSSLMode()
-		if err != nil {
-			return nil, err
-		}
 		timeZone, err := s.GetDbTimeZone()
 		if err != nil {
 			return nil, err
 		}
 
-		dbConfig.Postgres = config.PostgresConfig{
-			Host:     host,
-			Port:     port,
-			Database: name,
-			Username: user,
-			Password: password,
-			SSLMode:  sslMode,
-			TimeZone: timeZone,
+		if dbConfig.Type == config.DatabaseTypeMySQL {
+			charset, err := s.GetDbCharset()
+			if err != nil {
+				return nil, err
+			}
+			tls, err := s.GetDbTLS()
+			if err != nil {
+				return nil, err
+			}
+
+			dbConfig.MySQL = config.MySQLConfig{
+				Host:     host,
+				Port:     port,
+				Database: name,
+				Username: user,
+				Password: password,
+				Charset:  charset,
+				TLS:      tls,
+				TimeZone: timeZone,
+			}
+		} else {
+			sslMode, err := s.GetDbSSLMode()
+			if err != nil {
+				return nil, err
+			}
+
+			dbConfig.Postgres = config.PostgresConfig{
+				Host:     host,
+				Port:     port,
+				Database: name,
+				Username: user,
+				Password: password,
+				SSLMode:  sslMode,
+				TimeZone: timeZone,
+			}
 		}
 	} else {
 		// For SQLite, use default path
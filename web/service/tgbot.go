@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bytes"
 	"crypto/rand"
 	"embed"
 	"encoding/base64"
@@ -16,7 +17,6 @@ import (
 	"time"
 
 	"x-ui/config"
-	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/util/common"
@@ -2740,27 +2740,21 @@ func (t *Tgbot) sendBackup(chatId int64) {
 	output := t.I18nBot("tgbot.messages.backupTime", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
 	t.SendMsgToTgbot(chatId, output)
 
-	// Update by manually trigger a checkpoint operation
-	err := database.Checkpoint()
-	if err != nil {
-		logger.Error("Error in trigger a checkpoint operation: ", err)
-	}
-
-	file, err := os.Open(config.GetDBPath())
+	backup, fileName, err := t.serverService.GetDbBackup()
 	if err == nil {
 		document := tu.Document(
 			tu.ID(chatId),
-			tu.File(file),
+			tu.File(tu.NameReader(bytes.NewReader(backup), fileName)),
 		)
 		_, err = bot.SendDocument(document)
 		if err != nil {
 			logger.Error("Error in uploading backup: ", err)
 		}
 	} else {
-		logger.Error("Error in opening db file for backup: ", err)
+		logger.Error("Error in creating db backup: ", err)
 	}
 
-	file, err = os.Open(xray.GetConfigPath())
+	file, err := os.Open(xray.GetConfigPath())
 	if err == nil {
 		document := tu.Document(
 			tu.ID(chatId),
@@ -3,8 +3,15 @@ package service
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"x-ui/database"
+	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/xray"
 
@@ -19,15 +26,29 @@ var (
 )
 
 type XrayService struct {
-	inboundService InboundService
-	settingService SettingService
-	xrayAPI        xray.XrayAPI
+	inboundService      InboundService
+	settingService      SettingService
+	xrayRevisionService XrayRevisionService
+}
+
+// xrayAPI returns the API client of the running Xray. Its calls fail with
+// xray.ErrNotInitialized while Xray is not running.
+func xrayAPI() *xray.XrayAPI {
+	if p == nil {
+		return &xray.XrayAPI{}
+	}
+	return p.GetAPI()
 }
 
 func (s *XrayService) IsXrayRunning() bool {
 	return p != nil && p.IsRunning()
 }
 
+// IsXrayAPIConnected reports whether the panel can reach the API of the running Xray.
+func (s *XrayService) IsXrayAPIConnected() bool {
+	return s.IsXrayRunning() && p.GetAPI().IsConnected()
+}
+
 func (s *XrayService) GetXrayErr() error {
 	if p == nil {
 		return nil
@@ -56,71 +77,75 @@ func (s *XrayService) GetXrayVersion() string {
 	return p.GetVersion()
 }
 
-func RemoveIndex(s []any, index int) []any {
-	return append(s[:index], s[index+1:]...)
+func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
+	_, xrayConfig, err := s.getXrayConfig()
+	return xrayConfig, err
 }
 
-func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
+// getXrayConfig returns the current template along with the config generated from it.
+func (s *XrayService) getXrayConfig() (string, *xray.Config, error) {
 	templateConfig, err := s.settingService.GetXrayConfigTemplate()
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
+	s.inboundService.AddTraffic(nil, nil)
+
+	xrayConfig, err := s.BuildXrayConfig(templateConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	return templateConfig, xrayConfig, nil
+}
+
+// BuildXrayConfig returns the config Xray runs with the given template and the enabled inbounds.
+func (s *XrayService) BuildXrayConfig(templateConfig string) (*xray.Config, error) {
 	xrayConfig := &xray.Config{}
-	err = json.Unmarshal([]byte(templateConfig), xrayConfig)
+	err := json.Unmarshal([]byte(templateConfig), xrayConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = enableAPIServices(xrayConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	s.inboundService.AddTraffic(nil, nil)
-
-	inbounds, err := s.inboundService.GetAllInbounds()
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	err = db.Model(model.Inbound{}).Preload("ClientStats").Where("enable = ?", true).Find(&inbounds).Error
 	if err != nil {
 		return nil, err
 	}
+	inboundIds := make([]int, 0, len(inbounds))
 	for _, inbound := range inbounds {
-		if !inbound.Enable {
-			continue
-		}
-		// get settings clients
+		inboundIds = append(inboundIds, inbound.Id)
+	}
+	clientsByInbound, err := s.inboundService.getClientsByInbound(db, inboundIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, inbound := range inbounds {
+		// build settings clients from the clients table
 		settings := map[string]any{}
-		json.Unmarshal([]byte(inbound.Settings), &settings)
-		clients, ok := settings["clients"].([]any)
-		if ok {
+		if hasClients(inbound.Protocol) && json.Unmarshal([]byte(inbound.Settings), &settings) == nil {
 			// check users active or not
-			clientStats := inbound.ClientStats
-			for _, clientTraffic := range clientStats {
-				indexDecrease := 0
-				for index, client := range clients {
-					c := client.(map[string]any)
-					if c["email"] == clientTraffic.Email {
-						if !clientTraffic.Enable {
-							clients = RemoveIndex(clients, index-indexDecrease)
-							indexDecrease++
-							logger.Infof("Remove Inbound User %s due to expiration or traffic limit", c["email"])
-						}
-					}
+			depleted := make(map[string]bool)
+			for _, clientTraffic := range inbound.ClientStats {
+				if !clientTraffic.Enable {
+					depleted[clientTraffic.Email] = true
 				}
 			}
 
-			// clear client config for additional parameters
-			var final_clients []any
-			for _, client := range clients {
-				c := client.(map[string]any)
-				if c["enable"] != nil {
-					if enable, ok := c["enable"].(bool); ok && !enable {
-						continue
-					}
+			final_clients := []any{}
+			for _, client := range clientsByInbound[inbound.Id] {
+				if depleted[client.Email] {
+					logger.Infof("Remove Inbound User %s due to expiration or traffic limit", client.Email)
+					continue
 				}
-				for key := range c {
-					if key != "email" && key != "id" && key != "password" && key != "flow" && key != "method" {
-						delete(c, key)
-					}
-					if c["flow"] == "xtls-rprx-vision-udp443" {
-						c["flow"] = "xtls-rprx-vision"
-					}
+				if !client.Enable {
+					continue
 				}
-				final_clients = append(final_clients, any(c))
+				final_clients = append(final_clients, xrayClientConfig(&client))
 			}
 
 			settings["clients"] = final_clients
@@ -163,17 +188,75 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 	return xrayConfig, nil
 }
 
+// enableAPIServices turns on the API services behind the routing and outbound health
+// endpoints. The observatory service only works when an observatory is configured.
+func enableAPIServices(xrayConfig *xray.Config) error {
+	if len(xrayConfig.API) == 0 {
+		return nil
+	}
+	api := map[string]any{}
+	if err := json.Unmarshal(xrayConfig.API, &api); err != nil {
+		return err
+	}
+	wanted := []string{"RoutingService"}
+	if hasSection(xrayConfig.Observatory) || hasSection(xrayConfig.BurstObservatory) {
+		wanted = append(wanted, "ObservatoryService")
+	}
+	services, _ := api["services"].([]any)
+	changed := false
+	for _, service := range wanted {
+		if !slices.Contains(services, any(service)) {
+			services = append(services, service)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	api["services"] = services
+	data, err := json.MarshalIndent(api, "", "  ")
+	if err != nil {
+		return err
+	}
+	xrayConfig.API = data
+	return nil
+}
+
+func hasSection(section []byte) bool {
+	return len(section) > 0 && string(section) != "null"
+}
+
+// xrayClientConfig returns the fields of client that Xray needs, leaving out the panel ones.
+func xrayClientConfig(client *model.Client) map[string]any {
+	c := map[string]any{"email": client.Email}
+	if client.ID != "" {
+		c["id"] = client.ID
+	}
+	if client.Password != "" {
+		c["password"] = client.Password
+	}
+	if client.Method != "" {
+		c["method"] = client.Method
+	}
+	if client.Security != "" {
+		c["security"] = client.Security
+	}
+	if client.Flow != "" {
+		c["flow"] = client.Flow
+		if client.Flow == "xtls-rprx-vision-udp443" {
+			c["flow"] = "xtls-rprx-vision"
+		}
+	}
+	return c
+}
+
 func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, error) {
 	if !s.IsXrayRunning() {
 		err := errors.New("xray is not running")
 		logger.Debug("Attempted to fetch Xray traffic, but Xray is not running:", err)
 		return nil, nil, err
 	}
-	apiPort := p.GetAPIPort()
-	s.xrayAPI.Init(apiPort)
-	defer s.xrayAPI.Close()
-
-	traffic, clientTraffic, err := s.xrayAPI.GetTraffic(true)
+	traffic, clientTraffic, err := p.GetAPI().GetTraffic(true)
 	if err != nil {
 		logger.Debug("Failed to fetch Xray traffic:", err)
 		return nil, nil, err
@@ -186,38 +269,230 @@ func (s *XrayService) RestartXray(isForce bool) error {
 	defer lock.Unlock()
 	logger.Debug("restart xray, force:", isForce)
 
-	xrayConfig, err := s.GetXrayConfig()
+	templateConfig, xrayConfig, err := s.getXrayConfig()
 	if err != nil {
 		return err
 	}
+	// Only configs Xray actually runs are kept as revisions
+	applied := func() {
+		s.xrayRevisionService.addGeneratedRevision(templateConfig, xrayConfig)
+	}
 
-	if s.IsXrayRunning() {
-		if !isForce && p.GetConfig().Equals(xrayConfig) {
-			logger.Debug("It does not need to restart xray")
+	running := s.IsXrayRunning()
+	if running && !isForce && p.GetConfig().Equals(xrayConfig) {
+		logger.Debug("It does not need to restart xray")
+		return nil
+	}
+	// A broken config is not applied, a running Xray keeps its current one
+	if !running || !p.GetConfig().Equals(xrayConfig) {
+		if err := xray.ValidateConfig(xrayConfig); err != nil {
+			result = err.Error()
+			return err
+		}
+	}
+
+	if running {
+		if !isForce && s.applyConfigChanges(xrayConfig) {
+			applied()
+			return nil
+		}
+		if s.reloadXray(xrayConfig) {
+			applied()
 			return nil
 		}
+	}
+	// A crashed Xray waiting to be restarted by its supervisor is stopped too, or it
+	// would start again next to the new one
+	if p != nil {
 		p.Stop()
 	}
 
 	p = xray.NewProcess(xrayConfig)
+	p.SetCrashLoopHandler(s.notifyCrashLoop)
 	result = ""
 	err = p.Start()
 	if err != nil {
 		return err
 	}
+	applied()
 	return nil
 }
 
+// applyConfigChanges brings the running Xray to xrayConfig through the API, which keeps the
+// connections of unchanged inbounds alive. It returns false when Xray has to be restarted,
+// either because sections outside the inbounds changed or because an API call failed.
+func (s *XrayService) applyConfigChanges(xrayConfig *xray.Config) bool {
+	diff := xray.DiffConfig(p.GetConfig(), xrayConfig)
+	if diff.NeedRestart {
+		logger.Debug("Xray config template changed, restarting xray")
+		return false
+	}
+
+	xrayAPI := p.GetAPI()
+	if !xrayAPI.IsConnected() {
+		logger.Debug("Xray api is not connected, restarting xray")
+		return false
+	}
+
+	// Changes made earlier by the inbound service may already be live, so users
+	// that are already there or already gone are not errors
+	for _, user := range diff.RemovedUsers {
+		err := xrayAPI.RemoveUser(user.Tag, user.Email)
+		if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("User %s not found.", user.Email)) {
+			logger.Debug("Unable to remove client by api:", err)
+			return false
+		}
+	}
+	for _, tag := range diff.RemovedInbounds {
+		// A missing inbound fails the following AddInbound if it matters
+		if err := xrayAPI.DelInbound(tag); err != nil {
+			logger.Debug("Unable to delete inbound by api:", tag, err)
+		}
+	}
+	for _, inbound := range diff.AddedInbounds {
+		inboundJson, err := json.MarshalIndent(inbound, "", "  ")
+		if err == nil {
+			err = xrayAPI.AddInbound(inboundJson)
+		}
+		if err != nil {
+			logger.Debug("Unable to add inbound by api:", inbound.Tag, err)
+			return false
+		}
+	}
+	for _, user := range diff.AddedUsers {
+		err := xrayAPI.AddUser(user.Protocol, user.Tag, user.User)
+		if xray.IsUnsupported(err) {
+			logger.Debug("Client needs a restart to be added:", err)
+			return false
+		}
+		if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("User %s already exists.", user.Email)) {
+			logger.Debug("Unable to add client by api:", err)
+			return false
+		}
+	}
+
+	if err := p.SetConfig(xrayConfig); err != nil {
+		logger.Warning("Failed to save the applied xray config:", err)
+	}
+	logger.Infof("Xray config applied by api: %d inbounds removed, %d added, %d clients removed, %d added",
+		len(diff.RemovedInbounds), len(diff.AddedInbounds), len(diff.RemovedUsers), len(diff.AddedUsers))
+	return true
+}
+
+// reloadXray replaces the running Xray with one running xrayConfig without dropping the
+// established connections, see xray.Process.Reload. It returns false when Xray has to be
+// restarted, because graceful reloads are turned off or the new core did not come up.
+func (s *XrayService) reloadXray(xrayConfig *xray.Config) bool {
+	grace, err := s.settingService.GetXrayReloadGrace()
+	if err != nil || grace <= 0 {
+		return false
+	}
+	next := xray.NewProcess(xrayConfig)
+	next.SetCrashLoopHandler(s.notifyCrashLoop)
+	if err := p.Reload(next, time.Duration(grace)*time.Second, s.addDrainedTraffic); err != nil {
+		logger.Warning("Graceful xray reload failed, restarting xray:", err)
+		return false
+	}
+	p = next
+	result = ""
+	logger.Info("Xray reloaded gracefully")
+	return true
+}
+
+// addDrainedTraffic counts the traffic an old Xray carried during the grace period of a
+// reload, which the traffic job only asks the new one for.
+func (s *XrayService) addDrainedTraffic(traffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) {
+	outboundService := OutboundService{}
+	err, needRestart0 := s.inboundService.AddTraffic(traffics, clientTraffics)
+	if err != nil {
+		logger.Warning("add inbound traffic of the old xray failed:", err)
+	}
+	err, needRestart1 := outboundService.AddTraffic(traffics, clientTraffics)
+	if err != nil {
+		logger.Warning("add outbound traffic of the old xray failed:", err)
+	}
+	if needRestart0 || needRestart1 {
+		s.SetToNeedRestart()
+	}
+}
+
+// TestRoute returns the outbound the running Xray picks for a connection.
+func (s *XrayService) TestRoute(test *xray.RouteTest) (*xray.RouteResult, error) {
+	if !s.IsXrayRunning() {
+		return nil, errors.New("xray is not running")
+	}
+	return p.GetAPI().TestRoute(test)
+}
+
+// AddRoutingRules adds rules to the running Xray. They are not saved in the template
+// and last until the next restart.
+func (s *XrayService) AddRoutingRules(routing string, shouldAppend bool) error {
+	if !s.IsXrayRunning() {
+		return errors.New("xray is not running")
+	}
+	return p.GetAPI().AddRules([]byte(routing), shouldAppend)
+}
+
+// RemoveRoutingRule removes the rule with ruleTag from the running Xray until the next restart.
+func (s *XrayService) RemoveRoutingRule(ruleTag string) error {
+	if !s.IsXrayRunning() {
+		return errors.New("xray is not running")
+	}
+	return p.GetAPI().RemoveRule(ruleTag)
+}
+
+// GetOutboundsHealth returns the health and latency of the outbounds watched by the observatory.
+func (s *XrayService) GetOutboundsHealth() ([]*xray.OutboundStatus, error) {
+	if !s.IsXrayRunning() {
+		return nil, errors.New("xray is not running")
+	}
+	return p.GetAPI().GetOutboundStatus()
+}
+
+// IsXraySupervised reports whether the running process restarts Xray by itself after a crash.
+func (s *XrayService) IsXraySupervised() bool {
+	return p != nil && p.IsSupervised()
+}
+
+// notifyCrashLoop alerts the Telegram bot admins that Xray keeps crashing.
+func (s *XrayService) notifyCrashLoop(crashes int, window time.Duration, rolledBack bool) {
+	tgbot := Tgbot{}
+	if !tgbot.IsRunning() {
+		return
+	}
+	msg := tgbot.I18nBot("tgbot.messages.xrayCrashLoop",
+		"Count=="+strconv.Itoa(crashes),
+		"Minutes=="+strconv.Itoa(int(window.Minutes())))
+	if rolledBack {
+		msg += tgbot.I18nBot("tgbot.messages.xrayRolledBack")
+	} else {
+		msg += tgbot.I18nBot("tgbot.messages.xrayStopped")
+	}
+	tgbot.SendMsgToTgbotAdmins(msg)
+}
+
 func (s *XrayService) StopXray() error {
 	lock.Lock()
 	defer lock.Unlock()
 	logger.Debug("Attempting to stop Xray...")
-	if s.IsXrayRunning() {
+	if p != nil {
 		return p.Stop()
 	}
 	return errors.New("xray is not running")
 }
 
+// ReconcileXray brings a running Xray in line with the database at once, through the API
+// when only inbounds and clients changed. A stopped Xray picks the changes up on start.
+func (s *XrayService) ReconcileXray() {
+	if !s.IsXrayRunning() {
+		return
+	}
+	if err := s.RestartXray(false); err != nil {
+		logger.Warning("Unable to apply the changes to xray, retrying later:", err)
+		s.SetToNeedRestart()
+	}
+}
+
 func (s *XrayService) SetToNeedRestart() {
 	isNeedXrayRestart.Store(true)
 }
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/json_util"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// Every saved Xray template and every config Xray was started, reloaded or updated with is
+// kept as a revision, together with the changes against the revision before it. A revision
+// is only added when something changed, and the newest maxXrayRevisions of each kind are kept.
+
+const (
+	XrayRevisionTemplate = "template"
+	XrayRevisionConfig   = "config"
+
+	// XrayRevisionSystem is the author of the revisions made by the panel itself, like the
+	// generated configs and templates changed outside the panel.
+	XrayRevisionSystem = "system"
+
+	maxXrayRevisions = 50
+)
+
+var xrayRevisionLock sync.Mutex
+
+type XrayRevisionService struct{}
+
+// XrayRevisionDetail is a revision with its content and its changes against the previous one.
+type XrayRevisionDetail struct {
+	model.XrayRevision
+	Content json_util.RawMessage `json:"content"`
+	Diff    []json_util.Change   `json:"diff"`
+}
+
+// addRevision keeps content as a revision of kind unless it does not differ from the
+// latest one, which is returned instead.
+func (s *XrayRevisionService) addRevision(kind string, content string, author string, templateId int) (*model.XrayRevision, error) {
+	xrayRevisionLock.Lock()
+	defer xrayRevisionLock.Unlock()
+
+	db := database.GetDB()
+	revision := &model.XrayRevision{
+		Kind:       kind,
+		Author:     author,
+		TemplateId: templateId,
+		Content:    content,
+		CreatedAt:  time.Now().UnixMilli(),
+	}
+	latest := &model.XrayRevision{}
+	err := db.Model(model.XrayRevision{}).Where("kind = ?", kind).Order("id DESC").First(latest).Error
+	if err != nil && !database.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		changes, err := json_util.Diff([]byte(latest.Content), []byte(content))
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			return latest, nil
+		}
+		diff, err := json.Marshal(changes)
+		if err != nil {
+			return nil, err
+		}
+		revision.PreviousId = latest.Id
+		revision.Changes = len(changes)
+		revision.Diff = string(diff)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(revision).Error; err != nil {
+			return err
+		}
+		return s.pruneRevisions(tx, kind)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// pruneRevisions removes the revisions of kind beyond the newest maxXrayRevisions.
+func (s *XrayRevisionService) pruneRevisions(tx *gorm.DB, kind string) error {
+	var ids []int
+	err := tx.Model(model.XrayRevision{}).Where("kind = ?", kind).
+		Order("id DESC").Offset(maxXrayRevisions).Limit(1).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	return tx.Where("kind = ? AND id <= ?", kind, ids[0]).Delete(model.XrayRevision{}).Error
+}
+
+// AddTemplateRevision keeps a template saved by author.
+func (s *XrayRevisionService) AddTemplateRevision(template string, author string) error {
+	_, err := s.addRevision(XrayRevisionTemplate, template, author, 0)
+	return err
+}
+
+// addGeneratedRevision keeps a config generated from template once Xray runs it. The
+// template is kept too, in case it was changed outside the panel. Failures are only
+// logged, they must not keep Xray from starting.
+func (s *XrayRevisionService) addGeneratedRevision(template string, xrayConfig *xray.Config) {
+	templateRevision, err := s.addRevision(XrayRevisionTemplate, template, XrayRevisionSystem, 0)
+	if err != nil {
+		logger.Warning("Unable to keep the xray template revision:", err)
+		return
+	}
+	content, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err != nil {
+		logger.Warning("Unable to keep the xray config revision:", err)
+		return
+	}
+	_, err = s.addRevision(XrayRevisionConfig, string(content), XrayRevisionSystem, templateRevision.Id)
+	if err != nil {
+		logger.Warning("Unable to keep the xray config revision:", err)
+	}
+}
+
+// GetRevisions lists the revisions of kind, or of both kinds when it is empty, newest first.
+func (s *XrayRevisionService) GetRevisions(kind string) ([]model.XrayRevision, error) {
+	db := database.GetDB().Model(model.XrayRevision{}).Omit("content", "diff")
+	if kind != "" {
+		db = db.Where("kind = ?", kind)
+	}
+	revisions := make([]model.XrayRevision, 0)
+	err := db.Order("id DESC").Find(&revisions).Error
+	return revisions, err
+}
+
+func (s *XrayRevisionService) getRevision(id int) (*model.XrayRevision, error) {
+	db := database.GetDB()
+	revision := &model.XrayRevision{}
+	err := db.Model(model.XrayRevision{}).First(revision, id).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("Xray revision not found:", id)
+	}
+	return revision, err
+}
+
+// GetRevision returns a revision with its content and its changes against the previous one.
+func (s *XrayRevisionService) GetRevision(id int) (*XrayRevisionDetail, error) {
+	revision, err := s.getRevision(id)
+	if err != nil {
+		return nil, err
+	}
+	detail := &XrayRevisionDetail{
+		XrayRevision: *revision,
+		Content:      json_util.RawMessage(revision.Content),
+		Diff:         make([]json_util.Change, 0),
+	}
+	if revision.Diff != "" {
+		if err := json.Unmarshal([]byte(revision.Diff), &detail.Diff); err != nil {
+			return nil, err
+		}
+	}
+	return detail, nil
+}
+
+// DiffRevisions returns the changes that turn the revision with id against into the one with
+// id. When against is 0 the latest revision of the same kind is used, so the changes are
+// what restoring the revision would do.
+func (s *XrayRevisionService) DiffRevisions(id int, against int) ([]json_util.Change, error) {
+	revision, err := s.getRevision(id)
+	if err != nil {
+		return nil, err
+	}
+	if against == 0 {
+		var ids []int
+		err := database.GetDB().Model(model.XrayRevision{}).Where("kind = ?", revision.Kind).
+			Order("id DESC").Limit(1).Pluck("id", &ids).Error
+		if err != nil {
+			return nil, err
+		}
+		against = ids[0]
+	}
+	other, err := s.getRevision(against)
+	if err != nil {
+		return nil, err
+	}
+	if revision.Kind != other.Kind {
+		return nil, common.NewError("Xray revisions are of different kinds:", revision.Kind, other.Kind)
+	}
+	return json_util.Diff([]byte(other.Content), []byte(revision.Content))
+}
+
+// GetRestorableTemplate returns the template to save to go back to the revision with id.
+// A generated config goes back to the template it was generated from, its inbounds and
+// clients come from the database and are not restored.
+func (s *XrayRevisionService) GetRestorableTemplate(id int) (string, error) {
+	revision, err := s.getRevision(id)
+	if err != nil {
+		return "", err
+	}
+	if revision.Kind == XrayRevisionTemplate {
+		return revision.Content, nil
+	}
+	template, err := s.getRevision(revision.TemplateId)
+	if err != nil {
+		return "", common.NewError("Template of the xray config revision is no longer kept:", revision.TemplateId)
+	}
+	return template.Content, nil
+}
@@ -4,6 +4,7 @@ import (
 	_ "embed"
 	"encoding/json"
 
+	"x-ui/logger"
 	"x-ui/util/common"
 	"x-ui/xray"
 )
@@ -12,11 +13,49 @@ type XraySettingService struct {
 	SettingService
 }
 
-func (s *XraySettingService) SaveXraySetting(newXraySettings string) error {
+// SaveXraySetting saves the template once Xray accepts the config generated from it,
+// keeping it as a revision by author.
+func (s *XraySettingService) SaveXraySetting(newXraySettings string, author string) error {
 	if err := s.CheckXrayConfig(newXraySettings); err != nil {
 		return err
 	}
-	return s.SettingService.saveSetting("xrayTemplateConfig", newXraySettings)
+	xrayService := XrayService{}
+	xrayConfig, err := xrayService.BuildXrayConfig(newXraySettings)
+	if err != nil {
+		return err
+	}
+	if err := xray.ValidateConfig(xrayConfig); err != nil {
+		return err
+	}
+	// The template being replaced is kept first, it may predate the history or have been
+	// changed outside the panel
+	xrayRevisionService := XrayRevisionService{}
+	if current, err := s.SettingService.GetXrayConfigTemplate(); err == nil {
+		if err := xrayRevisionService.AddTemplateRevision(current, XrayRevisionSystem); err != nil {
+			logger.Warning("Unable to keep the xray template revision:", err)
+		}
+	}
+	if err := s.SettingService.saveSetting("xrayTemplateConfig", newXraySettings); err != nil {
+		return err
+	}
+	if err := xrayRevisionService.AddTemplateRevision(newXraySettings, author); err != nil {
+		logger.Warning("Unable to keep the xray template revision:", err)
+	}
+	return nil
+}
+
+// RestoreXrayRevision saves the template of the revision with id again, by author.
+func (s *XraySettingService) RestoreXrayRevision(id int, author string) error {
+	xrayRevisionService := XrayRevisionService{}
+	template, err := xrayRevisionService.GetRestorableTemplate(id)
+	if err != nil {
+		return err
+	}
+	if err := s.SaveXraySetting(template, author); err != nil {
+		return err
+	}
+	logger.Infof("Xray template restored from revision %d by %s", id, author)
+	return nil
 }
 
 func (s *XraySettingService) CheckXrayConfig(XrayTemplateConfig string) error {
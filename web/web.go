@@ -266,6 +266,12 @@ func (s *Server) startTask() {
 	// check client ips from log file every day
 	s.cron.AddJob("@daily", job.NewClearLogsJob())
 
+	// Purge expired entries of the recycle bin every hour
+	s.cron.AddJob("@hourly", job.NewPurgeRecycleBinJob())
+
+	// Run the scheduled client actions that are due every minute
+	s.cron.AddJob("@every 1m", job.NewScheduledActionsJob())
+
 	// Make a traffic condition every day, 8:30
 	var entry cron.EntryID
 	isTgbotenabled, err := s.settingService.GetTgbotEnabled()
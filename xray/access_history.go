@@ -0,0 +1,221 @@
+package xray
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+)
+
+// The access history keeps the records parsed from the access log as JSON lines. New
+// records go to the current file, which is rotated once it reaches maxAccessHistorySize;
+// rotated files are named after the time they were rotated and only the newest
+// maxAccessHistoryFiles of them are kept.
+const (
+	maxAccessHistorySize  = 16 << 20
+	maxAccessHistoryFiles = 8
+
+	defaultAccessQueryLimit = 100
+	maxAccessQueryLimit     = 1000
+)
+
+var (
+	accessHistoryLock     sync.Mutex
+	accessHistoryFileName = regexp.MustCompile(`^access-(\d+)\.jsonl$`)
+)
+
+// AccessQuery selects records of the access history. Empty fields match everything.
+type AccessQuery struct {
+	Email   string `json:"email" form:"email"`
+	Inbound string `json:"inbound" form:"inbound"`
+	Domain  string `json:"domain" form:"domain"` // the destination or a subdomain of it
+	Status  string `json:"status" form:"status"`
+	From    int64  `json:"from" form:"from"` // in ms
+	To      int64  `json:"to" form:"to"`
+	Limit   int    `json:"limit" form:"limit"`
+}
+
+func (q *AccessQuery) matches(record *AccessRecord) bool {
+	if q.Email != "" && record.Email != q.Email {
+		return false
+	}
+	if q.Inbound != "" && record.Inbound != q.Inbound {
+		return false
+	}
+	if q.Status != "" && record.Status != q.Status {
+		return false
+	}
+	if q.From > 0 && record.Time < q.From {
+		return false
+	}
+	if q.To > 0 && record.Time > q.To {
+		return false
+	}
+	if q.Domain != "" {
+		host := strings.ToLower(record.DestinationHost())
+		domain := strings.ToLower(strings.TrimPrefix(q.Domain, "."))
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetAccessHistoryFolderPath() string {
+	return config.GetLogFolder() + "/3x-ui-access"
+}
+
+func getAccessHistoryPath() string {
+	return GetAccessHistoryFolderPath() + "/access.jsonl"
+}
+
+// AddAccessRecords appends records to the access history.
+func AddAccessRecords(records []*AccessRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	accessHistoryLock.Lock()
+	defer accessHistoryLock.Unlock()
+
+	if err := os.MkdirAll(GetAccessHistoryFolderPath(), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(getAccessHistoryPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil || info.Size() < maxAccessHistorySize {
+		return err
+	}
+	return rotateAccessHistory()
+}
+
+// rotateAccessHistory renames the current file and prunes old ones. The caller holds accessHistoryLock.
+func rotateAccessHistory() error {
+	name := "access-" + strconv.FormatInt(time.Now().UnixMilli(), 10) + ".jsonl"
+	err := os.Rename(getAccessHistoryPath(), filepath.Join(GetAccessHistoryFolderPath(), name))
+	if err != nil {
+		return err
+	}
+	names, err := rotatedAccessHistoryNames()
+	if err != nil {
+		return err
+	}
+	for len(names) > maxAccessHistoryFiles {
+		if err := os.Remove(filepath.Join(GetAccessHistoryFolderPath(), names[len(names)-1])); err != nil {
+			return err
+		}
+		names = names[:len(names)-1]
+	}
+	return nil
+}
+
+// rotatedAccessHistoryNames returns the names of the rotated files, newest first.
+func rotatedAccessHistoryNames() ([]string, error) {
+	entries, err := os.ReadDir(GetAccessHistoryFolderPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && accessHistoryFileName.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Compare(accessHistoryRotated(b), accessHistoryRotated(a))
+	})
+	return names, nil
+}
+
+// accessHistoryRotated returns when the file called name was rotated, in ms.
+func accessHistoryRotated(name string) int64 {
+	matches := accessHistoryFileName.FindStringSubmatch(name)
+	if len(matches) < 2 {
+		return 0
+	}
+	rotated, _ := strconv.ParseInt(matches[1], 10, 64)
+	return rotated
+}
+
+// QueryAccessHistory returns the records matching query, newest first.
+func QueryAccessHistory(query *AccessQuery) ([]*AccessRecord, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultAccessQueryLimit
+	}
+	limit = min(limit, maxAccessQueryLimit)
+
+	accessHistoryLock.Lock()
+	names, err := rotatedAccessHistoryNames()
+	accessHistoryLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*AccessRecord, 0)
+	for _, name := range append([]string{filepath.Base(getAccessHistoryPath())}, names...) {
+		// A rotated file only has records from before it was rotated
+		if rotated := accessHistoryRotated(name); rotated > 0 && rotated < query.From {
+			break
+		}
+		matches, err := readAccessHistory(filepath.Join(GetAccessHistoryFolderPath(), name), query)
+		if err != nil {
+			return nil, err
+		}
+		slices.Reverse(matches)
+		records = append(records, matches...)
+		if len(records) >= limit {
+			return records[:limit], nil
+		}
+	}
+	return records, nil
+}
+
+// readAccessHistory returns the records of a file matching query, oldest first.
+func readAccessHistory(path string, query *AccessQuery) ([]*AccessRecord, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Rotated or pruned meanwhile
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]*AccessRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		record := &AccessRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil || !query.matches(record) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,109 @@
+package xray
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// accessTimeLayout is the time Xray puts in front of every access log line, in local time.
+const accessTimeLayout = "2006/01/02 15:04:05.999999"
+
+const (
+	AccessAccepted = "accepted"
+	AccessRejected = "rejected"
+)
+
+// AccessRecord is a connection as logged by Xray in its access log.
+type AccessRecord struct {
+	Time        int64  `json:"time"`
+	Source      string `json:"source"` // IP of the client
+	Email       string `json:"email,omitempty"`
+	Inbound     string `json:"inbound,omitempty"`
+	Network     string `json:"network,omitempty"`     // tcp or udp
+	Destination string `json:"destination,omitempty"` // host:port
+	Outbound    string `json:"outbound,omitempty"`
+	Status      string `json:"status"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// DestinationHost returns the domain or IP the connection went to.
+func (r *AccessRecord) DestinationHost() string {
+	host, _, err := net.SplitHostPort(r.Destination)
+	if err != nil {
+		return r.Destination
+	}
+	return host
+}
+
+// ParseAccessLine parses a line of the access log, which Xray writes as
+//
+//	2006/01/02 15:04:05.000000 from tcp:1.2.3.4:5678 accepted tcp:example.com:443 [in >> out] email: user
+//
+// The route and the email are only there when known, rejected connections have a
+// reason instead of a destination.
+func ParseAccessLine(line string) (*AccessRecord, bool) {
+	record := &AccessRecord{}
+	rest := strings.TrimSpace(line)
+	if index := strings.Index(rest, "from "); index > 0 {
+		t, err := time.ParseInLocation(accessTimeLayout, strings.TrimSpace(rest[:index]), time.Local)
+		if err == nil {
+			record.Time = t.UnixMilli()
+		}
+		rest = rest[index:]
+	}
+	rest, ok := strings.CutPrefix(rest, "from ")
+	if !ok {
+		return nil, false
+	}
+	if index := strings.LastIndex(rest, " email: "); index >= 0 {
+		record.Email = strings.TrimSpace(rest[index+len(" email: "):])
+		rest = rest[:index]
+	}
+
+	source, rest, _ := strings.Cut(rest, " ")
+	_, record.Source = splitNetwork(source)
+	if host, _, err := net.SplitHostPort(record.Source); err == nil {
+		record.Source = host
+	}
+	record.Status, rest, _ = strings.Cut(rest, " ")
+	if record.Status != AccessAccepted && record.Status != AccessRejected {
+		return nil, false
+	}
+
+	// A rejected connection has no destination, which leaves two spaces before the reason
+	if !strings.HasPrefix(rest, " ") {
+		var destination string
+		destination, rest, _ = strings.Cut(rest, " ")
+		record.Network, record.Destination = splitNetwork(destination)
+	}
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "[") {
+		if end := strings.Index(rest, "]"); end > 0 {
+			record.Inbound, record.Outbound = splitDetour(rest[1:end])
+			rest = strings.TrimSpace(rest[end+1:])
+		}
+	}
+	record.Reason = rest
+	return record, true
+}
+
+// splitNetwork splits an address like tcp:1.2.3.4:443 into its network and the rest.
+func splitNetwork(address string) (string, string) {
+	for _, network := range []string{"tcp", "udp"} {
+		if rest, ok := strings.CutPrefix(address, network+":"); ok {
+			return network, rest
+		}
+	}
+	return "", address
+}
+
+// splitDetour splits the route of a connection, written "in >> out" or "in -> out".
+func splitDetour(detour string) (string, string) {
+	for _, separator := range []string{" >> ", " -> "} {
+		if inbound, outbound, ok := strings.Cut(detour, separator); ok {
+			return inbound, outbound
+		}
+	}
+	return detour, ""
+}
@@ -3,14 +3,18 @@ package xray
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"x-ui/logger"
-	"x-ui/util/common"
 
+	observatoryService "github.com/xtls/xray-core/app/observatory/command"
 	"github.com/xtls/xray-core/app/proxyman/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
@@ -21,14 +25,31 @@ import (
 	"github.com/xtls/xray-core/proxy/vless"
 	"github.com/xtls/xray-core/proxy/vmess"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
+// apiTimeout bounds every call to the Xray API, so a hung core cannot block the panel.
+const apiTimeout = 10 * time.Second
+
+var (
+	ErrNotInitialized = errors.New("xray api is not initialized")
+	ErrUnavailable    = errors.New("xray api is unavailable")
+)
+
+// XrayAPI is a client of the gRPC API of a running Xray. Its connection is kept open
+// for the lifetime of the process and reconnects on its own, backing off while the
+// core is restarting. It is safe for concurrent use.
 type XrayAPI struct {
-	HandlerServiceClient *command.HandlerServiceClient
-	StatsServiceClient   *statsService.StatsServiceClient
-	grpcClient           *grpc.ClientConn
-	isConnected          bool
+	lock                     sync.RWMutex
+	HandlerServiceClient     *command.HandlerServiceClient
+	StatsServiceClient       *statsService.StatsServiceClient
+	RoutingServiceClient     *routerService.RoutingServiceClient
+	ObservatoryServiceClient *observatoryService.ObservatoryServiceClient
+	grpcClient               *grpc.ClientConn
 }
 
 func (x *XrayAPI) Init(apiPort int) error {
@@ -37,37 +58,107 @@ func (x *XrayAPI) Init(apiPort int) error {
 	}
 
 	addr := fmt.Sprintf("127.0.0.1:%d", apiPort)
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  500 * time.Millisecond,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   15 * time.Second,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}))
 	if err != nil {
 		return fmt.Errorf("failed to connect to Xray API: %w", err)
 	}
-
-	x.grpcClient = conn
-	x.isConnected = true
+	// Connect now instead of on the first call, so the status page is right from the start
+	conn.Connect()
 
 	hsClient := command.NewHandlerServiceClient(conn)
 	ssClient := statsService.NewStatsServiceClient(conn)
+	rsClient := routerService.NewRoutingServiceClient(conn)
+	osClient := observatoryService.NewObservatoryServiceClient(conn)
 
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if x.grpcClient != nil {
+		x.grpcClient.Close()
+	}
+	x.grpcClient = conn
 	x.HandlerServiceClient = &hsClient
 	x.StatsServiceClient = &ssClient
+	x.RoutingServiceClient = &rsClient
+	x.ObservatoryServiceClient = &osClient
 
 	return nil
 }
 
 func (x *XrayAPI) Close() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
 	if x.grpcClient != nil {
 		x.grpcClient.Close()
 	}
+	x.grpcClient = nil
 	x.HandlerServiceClient = nil
 	x.StatsServiceClient = nil
-	x.isConnected = false
+	x.RoutingServiceClient = nil
+	x.ObservatoryServiceClient = nil
+}
+
+// IsConnected reports whether the connection to Xray is up. An idle connection is
+// woken up, so it reports connected again on a later check.
+func (x *XrayAPI) IsConnected() bool {
+	x.lock.RLock()
+	conn := x.grpcClient
+	x.lock.RUnlock()
+	if conn == nil {
+		return false
+	}
+	state := conn.GetState()
+	if state == connectivity.Idle {
+		conn.Connect()
+	}
+	return state == connectivity.Ready
+}
+
+func (x *XrayAPI) handlerClient() (command.HandlerServiceClient, error) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	if x.HandlerServiceClient == nil {
+		return nil, ErrNotInitialized
+	}
+	return *x.HandlerServiceClient, nil
+}
+
+func (x *XrayAPI) statsClient() (statsService.StatsServiceClient, error) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	if x.StatsServiceClient == nil {
+		return nil, ErrNotInitialized
+	}
+	return *x.StatsServiceClient, nil
+}
+
+// callError marks errors caused by Xray not answering with ErrUnavailable,
+// keeping the message of errors returned by Xray itself.
+func callError(err error) error {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
 }
 
 func (x *XrayAPI) AddInbound(inbound []byte) error {
-	client := *x.HandlerServiceClient
+	client, err := x.handlerClient()
+	if err != nil {
+		return err
+	}
 
 	conf := new(conf.InboundDetourConfig)
-	err := json.Unmarshal(inbound, conf)
+	err = json.Unmarshal(inbound, conf)
 	if err != nil {
 		logger.Debug("Failed to unmarshal inbound:", err)
 		return err
@@ -79,38 +170,87 @@ func (x *XrayAPI) AddInbound(inbound []byte) error {
 	}
 	inboundConfig := command.AddInboundRequest{Inbound: config}
 
-	_, err = client.AddInbound(context.Background(), &inboundConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	_, err = client.AddInbound(ctx, &inboundConfig)
 
-	return err
+	return callError(err)
 }
 
 func (x *XrayAPI) DelInbound(tag string) error {
-	client := *x.HandlerServiceClient
-	_, err := client.RemoveInbound(context.Background(), &command.RemoveInboundRequest{
+	client, err := x.handlerClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	_, err = client.RemoveInbound(ctx, &command.RemoveInboundRequest{
 		Tag: tag,
 	})
-	return err
+	return callError(err)
+}
+
+// UnsupportedError is returned by AddUser for users the API cannot add to a running
+// inbound. Callers fall back to restarting Xray with the new config.
+type UnsupportedError struct {
+	Protocol string
+	Reason   string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("adding %s users through the Xray API is not supported: %s", e.Protocol, e.Reason)
+}
+
+// IsUnsupported reports whether err means the change has to be applied by a restart.
+func IsUnsupported(err error) bool {
+	var unsupported *UnsupportedError
+	return errors.As(err, &unsupported)
 }
 
+// AddUser adds a user to the inbound with inboundTag. The user map carries the client
+// fields email, id, flow, encryption, security and password, and for Shadowsocks the
+// cipher of the inbound or client. Missing fields are treated as empty.
 func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]any) error {
+	userString := func(key string) string {
+		value, _ := user[key].(string)
+		return value
+	}
+
 	var account *serial.TypedMessage
 	switch Protocol {
 	case "vmess":
 		account = serial.ToTypedMessage(&vmess.Account{
-			Id: user["id"].(string),
+			Id: userString("id"),
+			SecuritySettings: &protocol.SecurityConfig{
+				Type: vmessSecurity(userString("security")),
+			},
 		})
 	case "vless":
+		flow := userString("flow")
+		if flow == "xtls-rprx-vision-udp443" {
+			flow = vless.XRV
+		}
 		account = serial.ToTypedMessage(&vless.Account{
-			Id:   user["id"].(string),
-			Flow: user["flow"].(string),
+			Id:         userString("id"),
+			Flow:       flow,
+			Encryption: userString("encryption"),
 		})
 	case "trojan":
 		account = serial.ToTypedMessage(&trojan.Account{
-			Password: user["password"].(string),
+			Password: userString("password"),
 		})
 	case "shadowsocks":
+		cipher := userString("cipher")
+		if strings.HasPrefix(cipher, "2022-") {
+			// Users of a multi-user 2022 inbound only have their own key, the
+			// method and server key belong to the inbound
+			account = serial.ToTypedMessage(&shadowsocks_2022.Account{
+				Key: userString("password"),
+			})
+			break
+		}
 		var ssCipherType shadowsocks.CipherType
-		switch user["cipher"].(string) {
+		switch cipher {
 		case "aes-128-gcm":
 			ssCipherType = shadowsocks.CipherType_AES_128_GCM
 		case "aes-256-gcm":
@@ -119,41 +259,60 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]an
 			ssCipherType = shadowsocks.CipherType_CHACHA20_POLY1305
 		case "xchacha20-poly1305", "xchacha20-ietf-poly1305":
 			ssCipherType = shadowsocks.CipherType_XCHACHA20_POLY1305
-		default:
+		case "none", "plain":
 			ssCipherType = shadowsocks.CipherType_NONE
+		default:
+			return &UnsupportedError{Protocol: Protocol, Reason: fmt.Sprintf("unknown cipher %q", cipher)}
 		}
-
-		if ssCipherType != shadowsocks.CipherType_NONE {
-			account = serial.ToTypedMessage(&shadowsocks.Account{
-				Password:   user["password"].(string),
-				CipherType: ssCipherType,
-			})
-		} else {
-			account = serial.ToTypedMessage(&shadowsocks_2022.ServerConfig{
-				Key:   user["password"].(string),
-				Email: user["email"].(string),
-			})
-		}
+		account = serial.ToTypedMessage(&shadowsocks.Account{
+			Password:   userString("password"),
+			CipherType: ssCipherType,
+		})
 	default:
-		return nil
+		return &UnsupportedError{Protocol: Protocol, Reason: "the protocol has no per-user accounts"}
 	}
 
-	client := *x.HandlerServiceClient
+	client, err := x.handlerClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
 
-	_, err := client.AlterInbound(context.Background(), &command.AlterInboundRequest{
+	_, err = client.AlterInbound(ctx, &command.AlterInboundRequest{
 		Tag: inboundTag,
 		Operation: serial.ToTypedMessage(&command.AddUserOperation{
 			User: &protocol.User{
-				Email:   user["email"].(string),
+				Email:   userString("email"),
 				Account: account,
 			},
 		}),
 	})
-	return err
+	return callError(err)
+}
+
+// vmessSecurity converts a VMess security name the same way the Xray config loader does.
+func vmessSecurity(security string) protocol.SecurityType {
+	switch strings.ToLower(security) {
+	case "aes-128-gcm":
+		return protocol.SecurityType_AES128_GCM
+	case "chacha20-poly1305":
+		return protocol.SecurityType_CHACHA20_POLY1305
+	case "none":
+		return protocol.SecurityType_NONE
+	case "zero":
+		return protocol.SecurityType_ZERO
+	default:
+		return protocol.SecurityType_AUTO
+	}
 }
 
 func (x *XrayAPI) RemoveUser(inboundTag, email string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	client, err := x.handlerClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
 	defer cancel()
 
 	op := &command.RemoveUserOperation{Email: email}
@@ -162,33 +321,30 @@ func (x *XrayAPI) RemoveUser(inboundTag, email string) error {
 		Operation: serial.ToTypedMessage(op),
 	}
 
-	_, err := (*x.HandlerServiceClient).AlterInbound(ctx, req)
+	_, err = client.AlterInbound(ctx, req)
 	if err != nil {
-		return fmt.Errorf("failed to remove user: %w", err)
+		return fmt.Errorf("failed to remove user: %w", callError(err))
 	}
 
 	return nil
 }
 
 func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
-	if x.grpcClient == nil {
-		return nil, nil, common.NewError("xray api is not initialized")
+	client, err := x.statsClient()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	trafficRegex := regexp.MustCompile(`(inbound|outbound)>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
 	clientTrafficRegex := regexp.MustCompile(`user>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
 	defer cancel()
 
-	if x.StatsServiceClient == nil {
-		return nil, nil, common.NewError("xray StatusServiceClient is not initialized")
-	}
-
-	resp, err := (*x.StatsServiceClient).QueryStats(ctx, &statsService.QueryStatsRequest{Reset_: reset})
+	resp, err := client.QueryStats(ctx, &statsService.QueryStatsRequest{Reset_: reset})
 	if err != nil {
 		logger.Debug("Failed to query Xray stats:", err)
-		return nil, nil, err
+		return nil, nil, callError(err)
 	}
 
 	tagTrafficMap := make(map[string]*Traffic)
@@ -10,4 +10,5 @@ type ClientTraffic struct {
 	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
 	Total      int64  `json:"total" form:"total"`
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`
+	IdentityId int    `json:"identityId" form:"identityId" gorm:"index;default:0"`
 }
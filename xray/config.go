@@ -31,35 +31,29 @@ func (c *Config) Equals(other *Config) bool {
 			return false
 		}
 	}
-	if !bytes.Equal(c.LogConfig, other.LogConfig) {
-		return false
-	}
-	if !bytes.Equal(c.RouterConfig, other.RouterConfig) {
-		return false
-	}
-	if !bytes.Equal(c.DNSConfig, other.DNSConfig) {
-		return false
-	}
-	if !bytes.Equal(c.OutboundConfigs, other.OutboundConfigs) {
-		return false
-	}
-	if !bytes.Equal(c.Transport, other.Transport) {
-		return false
-	}
-	if !bytes.Equal(c.Policy, other.Policy) {
-		return false
-	}
-	if !bytes.Equal(c.API, other.API) {
-		return false
-	}
-	if !bytes.Equal(c.Stats, other.Stats) {
-		return false
-	}
-	if !bytes.Equal(c.Reverse, other.Reverse) {
-		return false
-	}
-	if !bytes.Equal(c.FakeDNS, other.FakeDNS) {
-		return false
+	return c.TemplateEquals(other)
+}
+
+// TemplateEquals reports whether c and other are the same apart from their inbounds.
+func (c *Config) TemplateEquals(other *Config) bool {
+	sections := [][2][]byte{
+		{c.LogConfig, other.LogConfig},
+		{c.RouterConfig, other.RouterConfig},
+		{c.DNSConfig, other.DNSConfig},
+		{c.OutboundConfigs, other.OutboundConfigs},
+		{c.Transport, other.Transport},
+		{c.Policy, other.Policy},
+		{c.API, other.API},
+		{c.Stats, other.Stats},
+		{c.Reverse, other.Reverse},
+		{c.FakeDNS, other.FakeDNS},
+		{c.Observatory, other.Observatory},
+		{c.BurstObservatory, other.BurstObservatory},
+	}
+	for _, section := range sections {
+		if !bytes.Equal(section[0], section[1]) {
+			return false
+		}
 	}
 	return true
 }
@@ -0,0 +1,96 @@
+package xray
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+
+	"x-ui/config"
+	"x-ui/util/common"
+)
+
+// maxCrashReports is how many crash reports are kept, older ones are removed.
+const maxCrashReports = 20
+
+var crashReportName = regexp.MustCompile(`^core_crash_\d{8}_\d{6}\.log$`)
+
+// CrashReport describes a report written when Xray exited unexpectedly.
+type CrashReport struct {
+	Name string `json:"name"`
+	Time int64  `json:"time"`
+	Size int64  `json:"size"`
+}
+
+func writeCrashReport(m []byte) error {
+	crashReportPath := config.GetBinFolderPath() + "/core_crash_" + time.Now().Format("20060102_150405") + ".log"
+	if err := os.WriteFile(crashReportPath, m, 0o644); err != nil {
+		return err
+	}
+	return pruneCrashReports()
+}
+
+// crashReportNames returns the names of the crash reports, newest first.
+func crashReportNames() ([]string, error) {
+	entries, err := os.ReadDir(config.GetBinFolderPath())
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() && crashReportName.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	// The names embed the time, so they sort chronologically
+	slices.Sort(names)
+	slices.Reverse(names)
+	return names, nil
+}
+
+func pruneCrashReports() error {
+	names, err := crashReportNames()
+	if err != nil || len(names) <= maxCrashReports {
+		return err
+	}
+	for _, name := range names[maxCrashReports:] {
+		if err := os.Remove(filepath.Join(config.GetBinFolderPath(), name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCrashReports lists the kept crash reports, newest first.
+func GetCrashReports() ([]CrashReport, error) {
+	names, err := crashReportNames()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]CrashReport, 0, len(names))
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(config.GetBinFolderPath(), name))
+		if err != nil {
+			continue
+		}
+		reports = append(reports, CrashReport{
+			Name: name,
+			Time: info.ModTime().Unix() * 1000,
+			Size: info.Size(),
+		})
+	}
+	return reports, nil
+}
+
+// ReadCrashReport returns the content of the crash report called name.
+func ReadCrashReport(name string) (string, error) {
+	if !crashReportName.MatchString(name) {
+		return "", common.NewError("invalid crash report name:", name)
+	}
+	data, err := os.ReadFile(filepath.Join(config.GetBinFolderPath(), name))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,171 @@
+package xray
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+)
+
+// userProtocols lists the protocols whose clients can be changed through the API.
+var userProtocols = []string{"vmess", "vless", "trojan", "shadowsocks"}
+
+// UserChange is a client to add to or remove from an inbound of the running Xray.
+type UserChange struct {
+	Tag      string
+	Protocol string
+	Email    string
+	User     map[string]any // in the form expected by XrayAPI.AddUser, nil for removals
+}
+
+// ConfigDiff lists the API calls turning a running config into a desired one.
+// An inbound that changed beyond its clients is both removed and added again.
+type ConfigDiff struct {
+	NeedRestart     bool // sections outside the inbounds changed, the API cannot apply them
+	RemovedInbounds []string
+	AddedInbounds   []InboundConfig
+	RemovedUsers    []UserChange
+	AddedUsers      []UserChange
+}
+
+// DiffConfig compares the config Xray is running with the desired one.
+func DiffConfig(running *Config, desired *Config) *ConfigDiff {
+	diff := &ConfigDiff{}
+	if !running.TemplateEquals(desired) {
+		diff.NeedRestart = true
+		return diff
+	}
+
+	runningInbounds := make(map[string]*InboundConfig, len(running.InboundConfigs))
+	for i := range running.InboundConfigs {
+		runningInbounds[running.InboundConfigs[i].Tag] = &running.InboundConfigs[i]
+	}
+	desiredTags := make(map[string]bool, len(desired.InboundConfigs))
+	for i := range desired.InboundConfigs {
+		inbound := &desired.InboundConfigs[i]
+		desiredTags[inbound.Tag] = true
+		old, ok := runningInbounds[inbound.Tag]
+		switch {
+		case !ok:
+			diff.AddedInbounds = append(diff.AddedInbounds, *inbound)
+		case old.Equals(inbound):
+		case inbound.Tag == "api":
+			// The panel talks to Xray through this inbound
+			diff.NeedRestart = true
+			return diff
+		case !diffUsers(diff, old, inbound):
+			diff.RemovedInbounds = append(diff.RemovedInbounds, inbound.Tag)
+			diff.AddedInbounds = append(diff.AddedInbounds, *inbound)
+		}
+	}
+	for _, inbound := range running.InboundConfigs {
+		if desiredTags[inbound.Tag] {
+			continue
+		}
+		if inbound.Tag == "api" {
+			diff.NeedRestart = true
+			return diff
+		}
+		diff.RemovedInbounds = append(diff.RemovedInbounds, inbound.Tag)
+	}
+	return diff
+}
+
+// diffUsers adds the user changes between two versions of an inbound to diff. It returns
+// false when anything but the clients changed, so that the inbound has to be replaced.
+func diffUsers(diff *ConfigDiff, old *InboundConfig, inbound *InboundConfig) bool {
+	if !slices.Contains(userProtocols, inbound.Protocol) ||
+		old.Protocol != inbound.Protocol ||
+		old.Port != inbound.Port ||
+		!bytes.Equal(old.Listen, inbound.Listen) ||
+		!bytes.Equal(old.StreamSettings, inbound.StreamSettings) ||
+		!bytes.Equal(old.Sniffing, inbound.Sniffing) ||
+		!bytes.Equal(old.Allocate, inbound.Allocate) {
+		return false
+	}
+	oldSettings, oldClients, ok1 := splitClients(old.Settings)
+	settings, clients, ok2 := splitClients(inbound.Settings)
+	if !ok1 || !ok2 || !bytes.Equal(oldSettings, settings) {
+		return false
+	}
+
+	method := ""
+	if inbound.Protocol == "shadowsocks" {
+		var s map[string]any
+		json.Unmarshal(inbound.Settings, &s)
+		method, _ = s["method"].(string)
+	}
+	for email, client := range oldClients {
+		newClient, ok := clients[email]
+		if ok && bytes.Equal(client, newClient) {
+			continue
+		}
+		diff.RemovedUsers = append(diff.RemovedUsers, UserChange{Tag: inbound.Tag, Protocol: inbound.Protocol, Email: email})
+	}
+	for email, client := range clients {
+		oldClient, ok := oldClients[email]
+		if ok && bytes.Equal(client, oldClient) {
+			continue
+		}
+		user, err := apiUser(client, method)
+		if err != nil {
+			return false
+		}
+		diff.AddedUsers = append(diff.AddedUsers, UserChange{Tag: inbound.Tag, Protocol: inbound.Protocol, Email: email, User: user})
+	}
+	return true
+}
+
+// splitClients returns settings without their "clients" array in canonical form,
+// and the clients keyed by email.
+func splitClients(settings []byte) ([]byte, map[string][]byte, bool) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(settings, &fields); err != nil {
+		return nil, nil, false
+	}
+	var items []json.RawMessage
+	if rawClients, ok := fields["clients"]; ok {
+		if err := json.Unmarshal(rawClients, &items); err != nil {
+			return nil, nil, false
+		}
+	}
+	delete(fields, "clients")
+
+	clients := make(map[string][]byte, len(items))
+	for _, item := range items {
+		var client struct {
+			Email string `json:"email"`
+		}
+		if err := json.Unmarshal(item, &client); err != nil || client.Email == "" {
+			// Users without an email cannot be removed through the API
+			return nil, nil, false
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, item); err != nil {
+			return nil, nil, false
+		}
+		clients[client.Email] = compact.Bytes()
+	}
+	// Marshaling a map sorts its keys, which makes the result comparable
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, false
+	}
+	return rest, clients, true
+}
+
+// apiUser converts a client of the Xray config to the user map taken by XrayAPI.AddUser.
+func apiUser(client []byte, method string) (map[string]any, error) {
+	var c map[string]any
+	if err := json.Unmarshal(client, &c); err != nil {
+		return nil, err
+	}
+	user := map[string]any{"cipher": method}
+	for _, key := range []string{"email", "id", "security", "flow", "password"} {
+		value, _ := c[key].(string)
+		user[key] = value
+	}
+	if clientMethod, _ := c["method"].(string); clientMethod != "" {
+		user["cipher"] = clientMethod
+	}
+	return user, nil
+}
@@ -3,6 +3,7 @@ package xray
 import (
 	"regexp"
 	"strings"
+	"sync"
 
 	"x-ui/logger"
 )
@@ -11,8 +12,38 @@ func NewLogWriter() *LogWriter {
 	return &LogWriter{}
 }
 
+// logTailLines is how many lines of Xray output are kept for crash reports.
+const logTailLines = 100
+
 type LogWriter struct {
 	lastLine string
+
+	tailLock sync.Mutex
+	tail     []string
+}
+
+// Tail returns the last lines Xray wrote, oldest first.
+func (lw *LogWriter) Tail() []string {
+	lw.tailLock.Lock()
+	defer lw.tailLock.Unlock()
+	return append([]string(nil), lw.tail...)
+}
+
+func (lw *LogWriter) clearTail() {
+	lw.tailLock.Lock()
+	defer lw.tailLock.Unlock()
+	lw.tail = nil
+}
+
+func (lw *LogWriter) addToTail(message string) {
+	lw.tailLock.Lock()
+	defer lw.tailLock.Unlock()
+	for line := range strings.SplitSeq(message, "\n") {
+		lw.tail = append(lw.tail, line)
+	}
+	if len(lw.tail) > logTailLines {
+		lw.tail = append(lw.tail[:0], lw.tail[len(lw.tail)-logTailLines:]...)
+	}
 }
 
 func (lw *LogWriter) Write(m []byte) (n int, err error) {
@@ -20,15 +51,12 @@ func (lw *LogWriter) Write(m []byte) (n int, err error) {
 
 	// Convert the data to a string
 	message := strings.TrimSpace(string(m))
+	lw.addToTail(message)
 
-	// Check if the message contains a crash
+	// Check if the message contains a crash, the report is written when the process exits
 	if crashRegex.MatchString(message) {
 		logger.Debug("Core crash detected:\n", message)
 		lw.lastLine = message
-		err1 := writeCrachReport(m)
-		if err1 != nil {
-			logger.Error("Unable to write crash report:", err1)
-		}
 		return len(m), nil
 	}
 
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 
@@ -49,14 +50,6 @@ func GetIPLimitBannedPrevLogPath() string {
 	return config.GetLogFolder() + "/3xipl-banned.prev.log"
 }
 
-func GetAccessPersistentLogPath() string {
-	return config.GetLogFolder() + "/3xipl-ap.log"
-}
-
-func GetAccessPersistentPrevLogPath() string {
-	return config.GetLogFolder() + "/3xipl-ap.prev.log"
-}
-
 func GetAccessLogPath() (string, error) {
 	config, err := os.ReadFile(GetConfigPath())
 	if err != nil {
@@ -96,10 +89,14 @@ func NewProcess(xrayConfig *Config) *Process {
 }
 
 type process struct {
-	cmd *exec.Cmd
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	running bool // cmd was started and has not exited yet
+	runID   int
 
 	version string
 	apiPort int
+	api     *XrayAPI
 
 	onlineClients []string
 
@@ -107,11 +104,15 @@ type process struct {
 	logWriter *LogWriter
 	exitErr   error
 	startTime time.Time
+
+	configTime time.Time // when config was started or applied, see markGood
+	supervisor supervisor
 }
 
 func newProcess(config *Config) *process {
 	return &process{
 		version:   "Unknown",
+		api:       &XrayAPI{},
 		config:    config,
 		logWriter: NewLogWriter(),
 		startTime: time.Now(),
@@ -119,22 +120,20 @@ func newProcess(config *Config) *process {
 }
 
 func (p *process) IsRunning() bool {
-	if p.cmd == nil || p.cmd.Process == nil {
-		return false
-	}
-	if p.cmd.ProcessState == nil {
-		return true
-	}
-	return false
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running
 }
 
 func (p *process) GetErr() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return p.exitErr
 }
 
 func (p *process) GetResult() string {
-	if len(p.logWriter.lastLine) == 0 && p.exitErr != nil {
-		return p.exitErr.Error()
+	if err := p.GetErr(); len(p.logWriter.lastLine) == 0 && err != nil {
+		return err.Error()
 	}
 	return p.logWriter.lastLine
 }
@@ -144,10 +143,20 @@ func (p *process) GetVersion() string {
 }
 
 func (p *Process) GetAPIPort() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return p.apiPort
 }
 
+// GetAPI returns the API client of the process. It stays connected while Xray runs,
+// calls fail with ErrNotInitialized before Start and after Stop.
+func (p *Process) GetAPI() *XrayAPI {
+	return p.api
+}
+
 func (p *Process) GetConfig() *Config {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return p.config
 }
 
@@ -173,22 +182,27 @@ func (p *process) refreshAPIPort() {
 }
 
 func (p *process) refreshVersion() {
-	cmd := exec.Command(GetBinaryPath(), "-version")
+	p.version = readBinaryVersion(GetBinaryPath())
+}
+
+// readBinaryVersion returns the version the Xray binary at path reports, like 25.5.16.
+func readBinaryVersion(path string) string {
+	cmd := exec.Command(path, "-version")
 	data, err := cmd.Output()
 	if err != nil {
-		p.version = "Unknown"
-	} else {
-		datas := bytes.Split(data, []byte(" "))
-		if len(datas) <= 1 {
-			p.version = "Unknown"
-		} else {
-			p.version = string(datas[1])
-		}
+		return "Unknown"
+	}
+	datas := bytes.Split(data, []byte(" "))
+	if len(datas) <= 1 {
+		return "Unknown"
 	}
+	return string(datas[1])
 }
 
 func (p *process) Start() (err error) {
-	if p.IsRunning() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.running {
 		return errors.New("xray is already running")
 	}
 
@@ -196,53 +210,73 @@ func (p *process) Start() (err error) {
 		if err != nil {
 			logger.Error("Failure in running xray-core process: ", err)
 			p.exitErr = err
+			// Not supervised, CheckXrayRunningJob starts it again
+			p.supervisor.stopped = true
 		}
 	}()
 
-	data, err := json.MarshalIndent(p.config, "", "  ")
-	if err != nil {
-		return common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
-	}
-
 	err = os.MkdirAll(config.GetLogFolder(), 0o770)
 	if err != nil {
 		logger.Warningf("Failed to create log folder: %s", err)
 	}
 
-	configPath := GetConfigPath()
-	err = os.WriteFile(configPath, data, fs.ModePerm)
+	err = p.writeConfig()
 	if err != nil {
-		return common.NewErrorf("Failed to write configuration file: %v", err)
+		return err
 	}
 
-	cmd := exec.Command(GetBinaryPath(), "-c", configPath)
-	p.cmd = cmd
-
-	cmd.Stdout = p.logWriter
-	cmd.Stderr = p.logWriter
-
-	go func() {
-		err := cmd.Run()
-		if err != nil {
-			logger.Error("Failure in running xray-core:", err)
-			p.exitErr = err
-		}
-	}()
+	err = p.run()
+	if err != nil {
+		return err
+	}
 
 	p.refreshVersion()
 	p.refreshAPIPort()
+	if err := p.api.Init(p.apiPort); err != nil {
+		logger.Warning("Failed to initialize xray api:", err)
+	}
 
 	return nil
 }
 
-func (p *process) Stop() error {
-	if !p.IsRunning() {
-		return errors.New("xray is not running")
+func (p *process) writeConfig() error {
+	data, err := json.MarshalIndent(p.config, "", "  ")
+	if err != nil {
+		return common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
 	}
-	return p.cmd.Process.Signal(syscall.SIGTERM)
+	err = os.WriteFile(GetConfigPath(), data, fs.ModePerm)
+	if err != nil {
+		return common.NewErrorf("Failed to write configuration file: %v", err)
+	}
+	return nil
+}
+
+// SetConfig records a config that was applied to the running process through the API,
+// so that the next comparison and the config file match what Xray is serving.
+func (p *Process) SetConfig(config *Config) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config = config
+	p.configTime = time.Now()
+	p.scheduleMarkGood()
+	return p.writeConfig()
 }
 
-func writeCrachReport(m []byte) error {
-	crashReportPath := config.GetBinFolderPath() + "/core_crash_" + time.Now().Format("20060102_150405") + ".log"
-	return os.WriteFile(crashReportPath, m, os.ModePerm)
+// Stop terminates Xray for good, the supervisor does not restart it. A process waiting
+// to be restarted after a crash is stopped as well, which only returns an error when it
+// was neither running nor supervised.
+func (p *process) Stop() error {
+	p.lock.Lock()
+	supervised := !p.supervisor.stopped
+	p.supervisor.stopped = true
+	running, cmd := p.running, p.cmd
+	p.lock.Unlock()
+	p.api.Close()
+	if !running {
+		if supervised {
+			return nil
+		}
+		return errors.New("xray is not running")
+	}
+	return cmd.Process.Signal(syscall.SIGTERM)
 }
@@ -0,0 +1,145 @@
+package xray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"x-ui/logger"
+)
+
+// A graceful reload starts the new core next to the old one instead of stopping the old
+// one first. Xray opens its listeners with SO_REUSEPORT, so the new core binds the same
+// ports. The API port is the exception: the old core's API inbound is moved to a free
+// port first, so the panel keeps talking to the right process. Once the new core is up,
+// the old core's inbounds are removed, which closes their listeners but not the
+// connections already accepted, and it is terminated after the grace period.
+const (
+	reloadTimeout = 10 * time.Second
+	reloadSettle  = time.Second // a core that fails to bind an inbound exits right after starting
+)
+
+// TrafficHandler takes the traffic a drained process carried since it was last counted.
+type TrafficHandler func(traffics []*Traffic, clientTraffics []*ClientTraffic)
+
+// Reload starts next and drains p once next is serving, terminating p after grace and
+// handing its traffic to onDrained. On error next is stopped and p keeps serving with its
+// API on another port; the caller falls back to stopping p before starting a new process.
+func (p *Process) Reload(next *Process, grace time.Duration, onDrained TrafficHandler) error {
+	if !p.IsRunning() || !p.api.IsConnected() {
+		return errors.New("xray api is not connected")
+	}
+	if err := p.moveAPI(); err != nil {
+		return fmt.Errorf("failed to move the xray api: %w", err)
+	}
+	if err := next.Start(); err != nil {
+		return err
+	}
+	if err := next.waitReady(); err != nil {
+		next.Stop()
+		return err
+	}
+	p.drain(grace, onDrained)
+	return nil
+}
+
+// moveAPI moves the API inbound of p to a free port, leaving the configured one to the
+// process replacing p. The connection of the panel is kept, as it was accepted before.
+func (p *Process) moveAPI() error {
+	var apiInbound *InboundConfig
+	config := p.GetConfig()
+	for i := range config.InboundConfigs {
+		if config.InboundConfigs[i].Tag == "api" {
+			apiInbound = &config.InboundConfigs[i]
+			break
+		}
+	}
+	if apiInbound == nil {
+		return errors.New("api inbound not found")
+	}
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	moved := *apiInbound
+	moved.Port = port
+	data, err := json.Marshal(moved)
+	if err != nil {
+		return err
+	}
+
+	if err := p.api.DelInbound("api"); err != nil {
+		return err
+	}
+	if err := p.api.AddInbound(data); err != nil {
+		if original, err := json.Marshal(apiInbound); err == nil {
+			p.api.AddInbound(original)
+		}
+		return err
+	}
+	p.lock.Lock()
+	p.apiPort = port
+	p.lock.Unlock()
+	return p.api.Init(port)
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitReady waits until the API of a started process answers and it keeps running.
+func (p *Process) waitReady() error {
+	deadline := time.Now().Add(reloadTimeout)
+	for time.Now().Before(deadline) {
+		if !p.IsRunning() {
+			return fmt.Errorf("xray exited while starting: %s", p.GetResult())
+		}
+		if p.api.IsConnected() {
+			time.Sleep(reloadSettle)
+			if !p.IsRunning() {
+				return fmt.Errorf("xray exited while starting: %s", p.GetResult())
+			}
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("xray api did not answer within %v", reloadTimeout)
+}
+
+// drain closes the listeners of p and terminates it after grace, once its traffic is
+// handed to onDrained. The supervisor lets it go from now on.
+func (p *Process) drain(grace time.Duration, onDrained TrafficHandler) {
+	p.lock.Lock()
+	p.supervisor.stopped = true
+	inbounds := p.config.InboundConfigs
+	p.lock.Unlock()
+
+	for _, inbound := range inbounds {
+		if inbound.Tag == "api" {
+			continue
+		}
+		if err := p.api.DelInbound(inbound.Tag); err != nil {
+			logger.Warning("Unable to close inbound of the old xray:", inbound.Tag, err)
+		}
+	}
+	logger.Infof("Old xray keeps its connections for %v", grace)
+	time.AfterFunc(grace, func() {
+		// Only the old core knows the traffic of the connections it kept
+		if p.IsRunning() && onDrained != nil {
+			traffics, clientTraffics, err := p.api.GetTraffic(true)
+			if err != nil {
+				logger.Warning("Unable to collect the traffic of the old xray:", err)
+			} else {
+				onDrained(traffics, clientTraffics)
+			}
+		}
+		p.Stop()
+	})
+}
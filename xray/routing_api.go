@@ -0,0 +1,194 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	observatoryService "github.com/xtls/xray-core/app/observatory/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// RouteTest describes a connection to run through the routing rules of the running Xray.
+type RouteTest struct {
+	InboundTag string `json:"inboundTag" form:"inboundTag"`
+	Network    string `json:"network" form:"network"` // tcp or udp, tcp when empty
+	Domain     string `json:"domain" form:"domain"`
+	IP         string `json:"ip" form:"ip"`
+	Port       uint32 `json:"port" form:"port"`
+	SourceIP   string `json:"sourceIp" form:"sourceIp"`
+	Protocol   string `json:"protocol" form:"protocol"` // sniffed protocol like http, tls or bittorrent
+	User       string `json:"user" form:"user"`         // client email
+}
+
+// RouteResult is the outbound the routing rules picked for a RouteTest.
+type RouteResult struct {
+	OutboundTag       string   `json:"outboundTag"`
+	OutboundGroupTags []string `json:"outboundGroupTags"`
+}
+
+// OutboundStatus is the health of an outbound as measured by the observatory.
+type OutboundStatus struct {
+	Tag          string `json:"tag"`
+	Alive        bool   `json:"alive"`
+	Delay        int64  `json:"delay"` // milliseconds
+	LastError    string `json:"lastError"`
+	LastSeenTime int64  `json:"lastSeenTime"` // unix seconds
+	LastTryTime  int64  `json:"lastTryTime"`
+}
+
+func (x *XrayAPI) routingClient() (routerService.RoutingServiceClient, error) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	if x.RoutingServiceClient == nil {
+		return nil, ErrNotInitialized
+	}
+	return *x.RoutingServiceClient, nil
+}
+
+func (x *XrayAPI) observatoryClient() (observatoryService.ObservatoryServiceClient, error) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	if x.ObservatoryServiceClient == nil {
+		return nil, ErrNotInitialized
+	}
+	return *x.ObservatoryServiceClient, nil
+}
+
+// AddRules adds the routing rules of a routing config, {"rules": [...]}, to the running
+// Xray, after the existing rules when shouldAppend is set and instead of them otherwise.
+// Rules need a ruleTag to be removed again.
+func (x *XrayAPI) AddRules(routing []byte, shouldAppend bool) error {
+	client, err := x.routingClient()
+	if err != nil {
+		return err
+	}
+
+	routerConfig := new(conf.RouterConfig)
+	if err := json.Unmarshal(routing, routerConfig); err != nil {
+		return err
+	}
+	config, err := routerConfig.Build()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	_, err = client.AddRule(ctx, &routerService.AddRuleRequest{
+		Config:       serial.ToTypedMessage(config),
+		ShouldAppend: shouldAppend,
+	})
+	return callError(err)
+}
+
+// RemoveRule removes the routing rule with ruleTag from the running Xray.
+func (x *XrayAPI) RemoveRule(ruleTag string) error {
+	client, err := x.routingClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	_, err = client.RemoveRule(ctx, &routerService.RemoveRuleRequest{RuleTag: ruleTag})
+	return callError(err)
+}
+
+// TestRoute returns the outbound the running Xray picks for a connection.
+func (x *XrayAPI) TestRoute(test *RouteTest) (*RouteResult, error) {
+	client, err := x.routingClient()
+	if err != nil {
+		return nil, err
+	}
+	if test.Domain == "" && test.IP == "" {
+		return nil, fmt.Errorf("a domain or an IP is required")
+	}
+
+	routingContext := &routerService.RoutingContext{
+		InboundTag:   test.InboundTag,
+		Network:      xnet.Network_TCP,
+		TargetDomain: test.Domain,
+		TargetPort:   test.Port,
+		Protocol:     test.Protocol,
+		User:         test.User,
+	}
+	switch strings.ToLower(test.Network) {
+	case "", "tcp":
+	case "udp":
+		routingContext.Network = xnet.Network_UDP
+	default:
+		return nil, fmt.Errorf("unknown network: %s", test.Network)
+	}
+	if test.IP != "" {
+		ip, err := parseIP(test.IP)
+		if err != nil {
+			return nil, err
+		}
+		routingContext.TargetIPs = [][]byte{ip}
+	}
+	if test.SourceIP != "" {
+		ip, err := parseIP(test.SourceIP)
+		if err != nil {
+			return nil, err
+		}
+		routingContext.SourceIPs = [][]byte{ip}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	resp, err := client.TestRoute(ctx, &routerService.TestRouteRequest{
+		RoutingContext: routingContext,
+		FieldSelectors: []string{"outbound"},
+	})
+	if err != nil {
+		return nil, callError(err)
+	}
+	return &RouteResult{
+		OutboundTag:       resp.GetOutboundTag(),
+		OutboundGroupTags: resp.GetOutboundGroupTags(),
+	}, nil
+}
+
+func parseIP(value string) ([]byte, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP: %s", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// GetOutboundStatus returns the health of the outbounds watched by the observatory
+// or the burst observatory of the running Xray.
+func (x *XrayAPI) GetOutboundStatus() ([]*OutboundStatus, error) {
+	client, err := x.observatoryClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+	defer cancel()
+	resp, err := client.GetOutboundStatus(ctx, &observatoryService.GetOutboundStatusRequest{})
+	if err != nil {
+		return nil, callError(err)
+	}
+
+	result := make([]*OutboundStatus, 0, len(resp.GetStatus().GetStatus()))
+	for _, status := range resp.GetStatus().GetStatus() {
+		result = append(result, &OutboundStatus{
+			Tag:          status.GetOutboundTag(),
+			Alive:        status.GetAlive(),
+			Delay:        status.GetDelay(),
+			LastError:    status.GetLastErrorReason(),
+			LastSeenTime: status.GetLastSeenTime(),
+			LastTryTime:  status.GetLastTryTime(),
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,232 @@
+package xray
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+)
+
+// The supervisor restarts Xray when it exits without Stop being called, waiting twice as
+// long after each crash. When Xray crashes crashLoopCount times within crashLoopWindow,
+// the last config that ran for stableUptime is restored; if that one crash loops as well,
+// Xray stays stopped until it is restarted from the panel.
+const (
+	restartMinDelay = time.Second
+	restartMaxDelay = time.Minute
+	stableUptime    = time.Minute
+	crashLoopCount  = 5
+	crashLoopWindow = 5 * time.Minute
+)
+
+// CrashLoopHandler is told that Xray crashed crashes times within window. rolledBack
+// reports whether the last known-good config was restored, otherwise Xray was left stopped.
+type CrashLoopHandler func(crashes int, window time.Duration, rolledBack bool)
+
+type supervisor struct {
+	stopped     bool // Stop was called, or the process never started
+	failed      bool // gave up restarting after a crash loop
+	rolledBack  bool
+	crashes     []time.Time
+	restarts    int
+	runStart    time.Time
+	onCrashLoop CrashLoopHandler
+}
+
+func GetLastGoodConfigPath() string {
+	return config.GetBinFolderPath() + "/config.last-good.json"
+}
+
+func (p *Process) SetCrashLoopHandler(handler CrashLoopHandler) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.supervisor.onCrashLoop = handler
+}
+
+// IsSupervised reports whether the supervisor takes care of the process: it is running,
+// waiting to be restarted after a crash, or kept stopped after a crash loop.
+func (p *Process) IsSupervised() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.supervisor.stopped
+}
+
+// IsCrashLooping reports whether the supervisor gave up restarting Xray.
+func (p *Process) IsCrashLooping() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.supervisor.failed
+}
+
+// run starts Xray with the config file. The caller holds p.lock.
+func (p *process) run() error {
+	cmd := exec.Command(GetBinaryPath(), "-c", GetConfigPath())
+	cmd.Stdout = p.logWriter
+	cmd.Stderr = p.logWriter
+	// Crash reports only show the output of the run that crashed
+	p.logWriter.clearTail()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	p.running = true
+	p.runID++
+	p.supervisor.runStart = time.Now()
+	p.configTime = p.supervisor.runStart
+	p.scheduleMarkGood()
+	go p.wait(cmd)
+	return nil
+}
+
+func (p *process) wait(cmd *exec.Cmd) {
+	err := cmd.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.running = false
+	if err != nil {
+		p.exitErr = err
+	}
+	if p.supervisor.stopped {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("exited without being stopped")
+	}
+	logger.Error("Failure in running xray-core:", err)
+	p.handleCrash(err)
+}
+
+// handleCrash records a crash and schedules a restart. The caller holds p.lock.
+func (p *process) handleCrash(err error) {
+	s := &p.supervisor
+	now := time.Now()
+	uptime := now.Sub(s.runStart)
+	if err := writeCrashReport(p.crashReport(err, uptime)); err != nil {
+		logger.Warning("Unable to write crash report:", err)
+	}
+
+	if uptime >= stableUptime {
+		s.restarts = 0
+	}
+	recent := s.crashes[:0]
+	for _, crash := range s.crashes {
+		if now.Sub(crash) < crashLoopWindow {
+			recent = append(recent, crash)
+		}
+	}
+	s.crashes = append(recent, now)
+
+	if len(s.crashes) >= crashLoopCount {
+		crashes := len(s.crashes)
+		s.crashes = nil
+		rolledBack := !s.rolledBack && p.rollback()
+		if s.onCrashLoop != nil {
+			go s.onCrashLoop(crashes, crashLoopWindow, rolledBack)
+		}
+		if !rolledBack {
+			s.failed = true
+			logger.Errorf("Xray crashed %d times in %v, it stays stopped until restarted from the panel", crashes, crashLoopWindow)
+			return
+		}
+		logger.Warningf("Xray crashed %d times in %v, rolled back to the last known-good config", crashes, crashLoopWindow)
+		s.restarts = 0
+	}
+
+	delay := restartMaxDelay
+	if s.restarts < 16 && restartMinDelay<<s.restarts < restartMaxDelay {
+		delay = restartMinDelay << s.restarts
+	}
+	s.restarts++
+	logger.Infof("Restarting xray in %v", delay)
+	time.AfterFunc(delay, p.restart)
+}
+
+func (p *process) restart() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.supervisor.stopped || p.running {
+		return
+	}
+	err := p.writeConfig()
+	if err == nil {
+		err = p.run()
+	}
+	if err != nil {
+		p.exitErr = err
+		p.supervisor.runStart = time.Now()
+		logger.Error("Failure in restarting xray-core:", err)
+		p.handleCrash(err)
+	}
+}
+
+// rollback replaces the config with the last known-good one. The caller holds p.lock.
+func (p *process) rollback() bool {
+	data, err := os.ReadFile(GetLastGoodConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning("Unable to read the last known-good xray config:", err)
+		}
+		return false
+	}
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		logger.Warning("Unable to parse the last known-good xray config:", err)
+		return false
+	}
+	if p.config.Equals(config) {
+		return false
+	}
+	p.config = config
+	p.supervisor.rolledBack = true
+	p.refreshAPIPort()
+	if err := p.api.Init(p.apiPort); err != nil {
+		logger.Warning("Failed to initialize xray api:", err)
+	}
+	return true
+}
+
+func (p *process) scheduleMarkGood() {
+	runID := p.runID
+	time.AfterFunc(stableUptime, func() { p.markGood(runID) })
+}
+
+// markGood saves the config as the last known-good one once Xray has been running it
+// for stableUptime.
+func (p *process) markGood(runID int) {
+	p.lock.Lock()
+	if !p.running || p.supervisor.stopped || p.runID != runID || time.Since(p.configTime) < stableUptime {
+		p.lock.Unlock()
+		return
+	}
+	data, err := json.MarshalIndent(p.config, "", "  ")
+	p.lock.Unlock()
+	if err == nil {
+		path := GetLastGoodConfigPath()
+		err = os.WriteFile(path+".tmp", data, 0o644)
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		logger.Warning("Unable to save the last known-good xray config:", err)
+	}
+}
+
+func (p *process) crashReport(err error, uptime time.Duration) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Xray version: %s\n", p.version)
+	fmt.Fprintf(&b, "Uptime: %v\n", uptime.Round(time.Second))
+	fmt.Fprintf(&b, "Error: %v\n\n", err)
+	for _, line := range p.logWriter.Tail() {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
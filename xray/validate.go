@@ -0,0 +1,80 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+)
+
+// validateTimeout bounds a config test, which loads geo files and can take a while.
+const validateTimeout = 30 * time.Second
+
+// ValidationError is returned by ValidateConfig with what Xray reported about the config.
+type ValidationError struct {
+	Output string
+}
+
+func (e *ValidationError) Error() string {
+	return "xray rejected the config: " + e.Output
+}
+
+// ValidateConfig runs the Xray binary in test mode on xrayConfig without touching the
+// running process. Without a binary there is nothing to test with and nil is returned.
+func ValidateConfig(xrayConfig *Config) error {
+	if _, err := os.Stat(GetBinaryPath()); err != nil {
+		logger.Debug("Skipping xray config test, binary not found:", err)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(config.GetBinFolderPath(), "config-test-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, GetBinaryPath(), "-test", "-c", file.Name()).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	return &ValidationError{Output: validationOutput(string(output))}
+}
+
+// validationOutput keeps the lines explaining the failure, dropping the version banner.
+func validationOutput(output string) string {
+	lines := make([]string, 0)
+	for line := range strings.SplitSeq(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Xray ") || strings.HasPrefix(line, "A unified platform") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return strings.TrimSpace(output)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,257 @@
+package xray
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"x-ui/config"
+	"x-ui/util/common"
+)
+
+// Installed versions of Xray are kept side by side in the versions folder, one folder per
+// version. Switching copies a version next to the binary and renames it over the binary,
+// so the binary is never seen half written; a running Xray keeps the file it started from.
+
+// maxKeptVersions is how many versions are kept, the least recently installed ones are
+// removed except for the current and the previous version.
+const maxKeptVersions = 5
+
+var versionRegex = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+
+// InstalledVersion describes a version of Xray kept in the versions folder.
+type InstalledVersion struct {
+	Version     string `json:"version"`
+	InstalledAt int64  `json:"installedAt"`
+	Current     bool   `json:"current"`
+	Previous    bool   `json:"previous"`
+}
+
+// versionState is what is remembered across switches. The current version is read from
+// the binary instead, as updating the panel can replace it.
+type versionState struct {
+	Previous string `json:"previous"`
+}
+
+func GetVersionsFolderPath() string {
+	return config.GetBinFolderPath() + "/versions"
+}
+
+func getVersionBinaryPath(version string) string {
+	return filepath.Join(GetVersionsFolderPath(), version, GetBinaryName())
+}
+
+func getVersionStatePath() string {
+	return GetVersionsFolderPath() + "/versions.json"
+}
+
+// IsValidVersion reports whether version is a release tag like v25.5.16.
+func IsValidVersion(version string) bool {
+	return versionRegex.MatchString(version)
+}
+
+// IsVersionInstalled reports whether version is kept in the versions folder.
+func IsVersionInstalled(version string) bool {
+	if !IsValidVersion(version) {
+		return false
+	}
+	_, err := os.Stat(getVersionBinaryPath(version))
+	return err == nil
+}
+
+// GetCurrentVersion returns the release tag of the binary, empty when it is missing.
+func GetCurrentVersion() string {
+	version := readBinaryVersion(GetBinaryPath())
+	if version == "Unknown" {
+		return ""
+	}
+	return "v" + version
+}
+
+// GetPreviousVersion returns the version in use before the last switch, empty if none.
+func GetPreviousVersion() string {
+	state := readVersionState()
+	if !IsVersionInstalled(state.Previous) {
+		return ""
+	}
+	return state.Previous
+}
+
+func readVersionState() *versionState {
+	state := &versionState{}
+	if data, err := os.ReadFile(getVersionStatePath()); err == nil {
+		json.Unmarshal(data, state)
+	}
+	return state
+}
+
+func writeVersionState(state *versionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := getVersionStatePath()
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// GetInstalledVersions lists the kept versions, newest first.
+func GetInstalledVersions() ([]InstalledVersion, error) {
+	entries, err := os.ReadDir(GetVersionsFolderPath())
+	if os.IsNotExist(err) {
+		return []InstalledVersion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	current, previous := GetCurrentVersion(), GetPreviousVersion()
+	versions := make([]InstalledVersion, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || !IsValidVersion(entry.Name()) {
+			continue
+		}
+		info, err := os.Stat(getVersionBinaryPath(entry.Name()))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, InstalledVersion{
+			Version:     entry.Name(),
+			InstalledAt: info.ModTime().Unix() * 1000,
+			Current:     entry.Name() == current,
+			Previous:    entry.Name() == previous,
+		})
+	}
+	slices.SortFunc(versions, func(a, b InstalledVersion) int {
+		return compareVersions(b.Version, a.Version)
+	})
+	return versions, nil
+}
+
+// compareVersions compares two release tags by their numbers.
+func compareVersions(a, b string) int {
+	partsA := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	partsB := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		if len(partsA[i]) != len(partsB[i]) {
+			return len(partsA[i]) - len(partsB[i])
+		}
+		if c := strings.Compare(partsA[i], partsB[i]); c != 0 {
+			return c
+		}
+	}
+	return len(partsA) - len(partsB)
+}
+
+// AddVersion keeps the binary read from r as version. The binary has to report that
+// version, which also proves it runs on this system.
+func AddVersion(version string, r io.Reader) error {
+	if !IsValidVersion(version) {
+		return common.NewError("invalid xray version:", version)
+	}
+	path := getVersionBinaryPath(version)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := writeBinary(tmp, r); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if got := readBinaryVersion(tmp); "v"+got != version {
+		os.Remove(tmp)
+		return common.NewErrorf("downloaded xray reports version %s instead of %s", got, version)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	pruneVersions()
+	return nil
+}
+
+func writeBinary(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// pruneVersions removes the oldest versions beyond maxKeptVersions.
+func pruneVersions() {
+	versions, err := GetInstalledVersions()
+	if err != nil || len(versions) <= maxKeptVersions {
+		return
+	}
+	slices.SortFunc(versions, func(a, b InstalledVersion) int {
+		return cmp.Compare(b.InstalledAt, a.InstalledAt)
+	})
+	kept := 0
+	for _, version := range versions {
+		if version.Current || version.Previous || kept < maxKeptVersions {
+			kept++
+			continue
+		}
+		os.RemoveAll(filepath.Join(GetVersionsFolderPath(), version.Version))
+	}
+}
+
+// SwitchVersion makes the kept version the binary and remembers the one it replaces as
+// the previous version. A binary not kept yet, like the one installed with the panel, is
+// kept first so that it can be switched back to.
+func SwitchVersion(version string) error {
+	if !IsVersionInstalled(version) {
+		return common.NewError("xray version is not installed:", version)
+	}
+	current := GetCurrentVersion()
+	if current == version {
+		return nil
+	}
+	if current != "" && !IsVersionInstalled(current) {
+		if err := keepBinary(current); err != nil {
+			return err
+		}
+	}
+
+	source, err := os.Open(getVersionBinaryPath(version))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tmp := GetBinaryPath() + ".new"
+	if err := writeBinary(tmp, source); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, GetBinaryPath()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if current == "" {
+		return nil
+	}
+	return writeVersionState(&versionState{Previous: current})
+}
+
+// keepBinary copies the binary to the versions folder as version.
+func keepBinary(version string) error {
+	source, err := os.Open(GetBinaryPath())
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if err := AddVersion(version, source); err != nil {
+		return common.NewError("unable to keep the current xray binary:", err)
+	}
+	return nil
+}